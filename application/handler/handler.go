@@ -2,65 +2,149 @@ package handler
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"mrbarrel/lib/deadline"
+	"mrbarrel/lib/logging"
+	"mrbarrel/lib/tlsconfig"
+	"net"
 	"net/http"
+	"os"
+	"sync/atomic"
 	"time"
 )
 
 const handledByHeader = "X-Handled-By"
 
+var logger = logging.Logger(logging.Handler)
+
 type Config struct {
 	Addr string
 	Id   string
+	// ShutdownDelay is the time between reporting not-ready and shutting down.
+	ShutdownDelay time.Duration
+	// TLS serves over HTTPS, mutual TLS when it has CAs.
+	TLS tlsconfig.Config
 }
 
 type Handler struct {
-	addr string
-	id   string
-	mux  *http.ServeMux
+	addr          string
+	tls           tlsconfig.Config
+	id            string
+	mux           *http.ServeMux
+	ready         atomic.Bool
+	shutdownDelay time.Duration
 }
 
 func New(cfg *Config) *Handler {
 	h := &Handler{
-		addr: cfg.Addr,
-		mux:  http.NewServeMux(),
-		id:   cfg.Id,
+		addr:          cfg.Addr,
+		tls:           cfg.TLS,
+		mux:           http.NewServeMux(),
+		id:            cfg.Id,
+		shutdownDelay: cfg.ShutdownDelay,
 	}
 
-	h.mux.HandleFunc(fmt.Sprintf("%s /json", http.MethodPost), h.handlePostJson)
+	h.mux.HandleFunc(fmt.Sprintf("%s /json", http.MethodPost), withDeadline(h.handlePostJson))
+	h.mux.HandleFunc(fmt.Sprintf("%s /healthz", http.MethodGet), h.handleHealthz)
+	h.mux.HandleFunc(fmt.Sprintf("%s /readyz", http.MethodGet), h.handleReadyz)
 
 	return h
 }
 
 func (h *Handler) ListenAndServe(ctx context.Context) error {
 	server := &http.Server{Addr: h.addr, Handler: h.mux}
+	listener, err := net.Listen("tcp", h.addr)
+	if err != nil {
+		return err
+	}
+	if h.tls.Enabled() {
+		files, err := tlsconfig.Load(h.tls)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, files.ServerConfig())
+	}
+	// we're listening, so from here on requests will be served
+	h.ready.Store(true)
 
 	// listen for context to stop server gracefully
 	go func() {
 		<-ctx.Done()
-		log.Printf("Gracefully shutting down handler..")
+		h.ready.Store(false)
+		logger.Info("gracefully shutting down handler")
+		time.Sleep(h.shutdownDelay)
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		if err := server.Shutdown(ctx); err != nil {
-			log.Fatalf("Handler shutdown failed: %v", err)
+			logger.Error("handler shutdown failed", "error", err)
+			os.Exit(1)
 		}
 	}()
 
-	return server.ListenAndServe()
+	return server.Serve(listener)
+}
+
+// Drain marks the handler as not ready, it keeps serving.
+func (h *Handler) Drain() {
+	h.ready.Store(false)
+}
+
+// IsReady tells whether the handler is listening and not shutting down.
+func (h *Handler) IsReady() bool {
+	return h.ready.Load()
+}
+
+// handleHealthz is the liveness check: if we can answer, we're alive.
+func (h *Handler) handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleReadyz is the readiness check, it fails during shutdown.
+func (h *Handler) handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	if !h.IsReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// withDeadline ends the request context with the deadline the router sends.
+func withDeadline(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := deadline.FromRequest(req)
+		defer cancel()
+		if ctx.Err() != nil {
+			requestLog(req).Debug("out of time before it got here")
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		next(w, req.WithContext(ctx))
+	}
 }
 
 func (h *Handler) handlePostJson(w http.ResponseWriter, req *http.Request) {
 	bytes, err := io.ReadAll(req.Body)
 	defer req.Body.Close()
 	if err != nil {
+		requestLog(req).Warn("while reading body", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	// the router gave up on us while the body came in, nobody is waiting for the answer
+	if req.Context().Err() != nil {
+		requestLog(req).Debug("out of time while reading the body")
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+
 	if !json.Valid(bytes) {
+		requestLog(req).Debug("body isn't valid JSON")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -72,3 +156,8 @@ func (h *Handler) handlePostJson(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 }
+
+// requestLog returns the logger for req, with the id the router gave it.
+func requestLog(req *http.Request) *slog.Logger {
+	return logger.With(logging.RequestIDKey, req.Header.Get(logging.RequestIDHeader))
+}
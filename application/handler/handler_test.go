@@ -2,6 +2,7 @@ package handler
 
 import (
 	"io"
+	"mrbarrel/lib/deadline"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -85,3 +86,83 @@ func TestHandlePostJson(t *testing.T) {
 		})
 	}
 }
+
+func TestHealthEndpoints(t *testing.T) {
+	handler := New(&Config{Addr: ":8080", Id: "g4rble"})
+
+	tests := map[string]struct {
+		path         string
+		ready        bool
+		wantRespCode int
+	}{
+		"liveness while not ready": {
+			path:         "/healthz",
+			wantRespCode: http.StatusOK,
+		},
+		"liveness while ready": {
+			path:         "/healthz",
+			ready:        true,
+			wantRespCode: http.StatusOK,
+		},
+		"readiness while not ready": {
+			path:         "/readyz",
+			wantRespCode: http.StatusServiceUnavailable,
+		},
+		"readiness while ready": {
+			path:         "/readyz",
+			ready:        true,
+			wantRespCode: http.StatusOK,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			handler.ready.Store(test.ready)
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			res := httptest.NewRecorder()
+
+			handler.mux.ServeHTTP(res, req)
+
+			if res.Code != test.wantRespCode {
+				t.Fatalf("got status %d but wanted %d", res.Code, test.wantRespCode)
+			}
+		})
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	handler := New(&Config{Addr: ":8080", Id: "g4rble"})
+
+	tests := map[string]struct {
+		header       string
+		wantRespCode int
+	}{
+		"no deadline": {
+			wantRespCode: http.StatusOK,
+		},
+		"time left": {
+			header:       "1000",
+			wantRespCode: http.StatusOK,
+		},
+		"no time left": {
+			header:       "0",
+			wantRespCode: http.StatusGatewayTimeout,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/json", strings.NewReader(`{"foo": 123}`))
+			if test.header != "" {
+				req.Header.Set(deadline.Header, test.header)
+			}
+			res := httptest.NewRecorder()
+
+			handler.mux.ServeHTTP(res, req)
+
+			if res.Code != test.wantRespCode {
+				t.Fatalf("got status %d but wanted %d", res.Code, test.wantRespCode)
+			}
+		})
+	}
+}
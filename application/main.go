@@ -5,43 +5,81 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
-	"log"
 	"mrbarrel/application/handler"
 	"mrbarrel/application/registrator"
 	"mrbarrel/lib/env"
+	"mrbarrel/lib/logging"
+	"mrbarrel/lib/registration"
 	"mrbarrel/lib/shutdown"
+	"mrbarrel/lib/tlsconfig"
+	"os"
 	"sync"
 	"time"
 )
 
+var logger = logging.Logger(logging.Main)
+
 func main() {
+	levels, err := logging.ParseLevels(env.MustGetStringOrDefault("LOG_LEVEL", "info"))
+	if err != nil {
+		fatal("while reading LOG_LEVEL", err)
+	}
+	logging.Setup(levels)
+
 	// configure application phase
 	host := env.MustGetStringOrDefault("HTTP_HOST", "")
 	port := env.MustGetIntOrDefault("HTTP_PORT", 8080)
 	idBytes := make([]byte, 8)
 	if _, err := rand.Read(idBytes); err != nil {
-		log.Fatalf("while creating random id: %v", err)
+		fatal("while creating random id", err)
 	}
 
 	handlerCfg := &handler.Config{
 		Addr: fmt.Sprintf("%s:%d", host, port),
 		Id:   base64.StdEncoding.EncodeToString(idBytes),
+
+		ShutdownDelay: env.MustGetDurationOrDefault("SHUTDOWN_DELAY", 0),
+		TLS: tlsconfig.Config{
+			CertFile: env.MustGetStringOrDefault("TLS_CERT_FILE", ""),
+			KeyFile:  env.MustGetStringOrDefault("TLS_KEY_FILE", ""),
+			CAFile:   env.MustGetStringOrDefault("TLS_CA_FILE", ""),
+		},
+	}
+	myAddr := fmt.Sprintf("%s:%d", env.MustGetString("HOSTNAME"), port) // here we need the docker host name
+	if handlerCfg.TLS.Enabled() {
+		// the router calls us the way we register
+		myAddr = "https://" + myAddr
 	}
 
 	routerConfig := &registrator.Config{
 		RegistryAddr:  env.MustGetString("REGISTRY_ADDR"),
-		MyAddr:        fmt.Sprintf("%s:%d", env.MustGetString("HOSTNAME"), port), // here we need the docker host name
+		MyAddr:        myAddr,
 		NotifInterval: env.MustGetDurationOrDefault("REGISTRY_INTERVAL", time.Second),
+		Weight:        int(env.MustGetIntOrDefault("REGISTRY_WEIGHT", registration.DefaultWeight)),
+		DrainTimeout:  env.MustGetDurationOrDefault("REGISTRY_DRAIN_TIMEOUT", time.Second*10),
+		Pool:          env.MustGetStringOrDefault("REGISTRY_POOL", ""),
+		Secret:        env.MustGetStringOrDefault("REGISTRY_SECRET", ""),
+		TLS: tlsconfig.Config{
+			CertFile: env.MustGetStringOrDefault("REGISTRY_TLS_CERT_FILE", ""),
+			KeyFile:  env.MustGetStringOrDefault("REGISTRY_TLS_KEY_FILE", ""),
+			CAFile:   env.MustGetStringOrDefault("REGISTRY_TLS_CA_FILE", ""),
+		},
 	}
 
 	handler := handler.New(handlerCfg)
-	routerNotifier := registrator.New(routerConfig)
+	// the registrator waits for the handler to be ready
+	routerNotifier, err := registrator.New(routerConfig, handler)
+	if err != nil {
+		fatal("while creating registrator", err)
+	}
 
 	// run application phase
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
+	// the server keeps serving until the router confirmed it drained us, so it gets its own context.
+	serverCtx, stopServer := context.WithCancel(context.Background())
 	var wg sync.WaitGroup
-	wg.Add(3)
+	wg.Add(4)
 	go func() {
 		defer wg.Done()
 		shutdown.ListenStopSignal(ctx, cancelFunc)
@@ -49,25 +87,36 @@ func main() {
 
 	go func() {
 		defer wg.Done()
-		err := handler.ListenAndServe(ctx)
+		<-ctx.Done()
+		handler.Drain()
+	}()
+
+	go func() {
+		defer wg.Done()
+		err := handler.ListenAndServe(serverCtx)
 		if err != nil {
-			log.Printf("ERROR in handler: %v", err)
+			logger.Error("handler stopped", "error", err)
 		}
 		cancelFunc()
 	}()
 
-	// TODO: can add a check to make sure handler is up before it registers itself to eliminate potential race conditions
-
 	go func() {
 		defer wg.Done()
 		err := routerNotifier.Run(ctx)
 		if err != nil {
-			log.Printf("ERROR in router notifier: %v", err)
+			logger.Error("registrator stopped", "error", err)
 		}
 		cancelFunc()
+		// drained & de-registered, safe to stop serving now
+		stopServer()
 	}()
 
-	log.Printf("API service %s up and running.", handlerCfg.Id)
+	logger.Info("API service up and running", "id", handlerCfg.Id)
 	wg.Wait()
-	log.Print("API Service shutdown complete, exiting. May I rise again.")
+	logger.Info("API service shutdown complete, exiting. May I rise again.")
+}
+
+func fatal(msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
 }
@@ -1,69 +1,259 @@
 package registrator
 
 import (
+	"bytes"
 	"context"
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mrbarrel/lib/logging"
+	"mrbarrel/lib/registration"
+	"mrbarrel/lib/tlsconfig"
 	"net/http"
-	"strings"
+	"net/url"
 	"time"
 )
 
+const drainPollInterval = 100 * time.Millisecond
+
+var logger = logging.Logger(logging.Registrator)
+
+var errUnknownToRouter = errors.New("router doesn't know about us, the next heartbeat registers us again")
+
 type Config struct {
 	RegistryAddr  string
 	MyAddr        string
 	NotifInterval time.Duration
+	// Weight is the share of traffic this instance asks for, relative to the other instances.
+	Weight int
+	// DrainTimeout is the longest we wait for the router to confirm it drained us when shutting down.
+	DrainTimeout time.Duration
+	// Pool is the router pool this instance joins, the router's default pool when empty.
+	Pool string
+	// Secret is shared with the router, every call to the registry is signed with it when set.
+	Secret string
+	// TLS is used to call a registry at an https:// address.
+	TLS tlsconfig.Config
+}
+
+// ReadinessChecker tells whether the application is ready to receive traffic.
+type ReadinessChecker interface {
+	IsReady() bool
 }
 
 type Registrator struct {
 	registryAddr string
 	interval     time.Duration
 	myAddr       string
+	weight       int
+	pool         string
+	readiness    ReadinessChecker
+	drainTimeout time.Duration
+	secret       []byte
+	client       *http.Client
+	logger       *slog.Logger
+	registered   bool
+	// draining is set once we asked the router to drain us, the heartbeats tell it so.
+	draining bool
 }
 
-func New(cfg *Config) *Registrator {
+func New(cfg *Config, readiness ReadinessChecker) (*Registrator, error) {
+	client := http.DefaultClient
+	if !cfg.TLS.IsZero() {
+		files, err := tlsconfig.Load(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		u, err := url.Parse(cfg.RegistryAddr)
+		if err != nil {
+			return nil, err
+		}
+		rt := http.DefaultTransport.(*http.Transport).Clone()
+		rt.TLSClientConfig = files.ClientConfig(u.Hostname())
+		client = &http.Client{Transport: rt}
+	}
 	return &Registrator{
 		registryAddr: cfg.RegistryAddr,
 		myAddr:       cfg.MyAddr,
 		interval:     cfg.NotifInterval,
-	}
+		weight:       cfg.Weight,
+		pool:         cfg.Pool,
+		readiness:    readiness,
+		drainTimeout: cfg.DrainTimeout,
+		secret:       []byte(cfg.Secret),
+		client:       client,
+		logger:       logger.With(logging.BackendKey, cfg.MyAddr),
+	}, nil
 }
 
+// Run keeps the registration alive until ctx is done, then drains and de-registers.
 func (r *Registrator) Run(ctx context.Context) error {
 	t := time.NewTicker(r.interval)
 	defer r.deregister()
 	for {
 		select {
 		case <-ctx.Done():
-			log.Print("INFO: Gracefully shutting down registrator..")
+			r.logger.Info("gracefully shutting down registrator")
+			r.drain()
 			return nil
 		case <-t.C:
-			body := strings.NewReader(r.myAddr)
-			req, err := http.NewRequest(http.MethodPost, r.registryAddr, body)
-			if err != nil {
+			if !r.readiness.IsReady() {
+				// don't send traffic our way (yet)
+				r.logger.Info("not ready, skipping registration")
+				continue
+			}
+			if err := r.heartbeat(context.Background()); err != nil {
 				return err
 			}
+		}
+	}
+}
 
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				log.Printf("ERROR: while calling registrator: %v", err)
-				// don't want to die here
-				continue
-			}
+// heartbeat registers us, only a request that can't be built is an error.
+func (r *Registrator) heartbeat(ctx context.Context) error {
+	req, err := r.newRequest(ctx, http.MethodPost, r.registryAddr, true)
+	if err != nil {
+		return err
+	}
 
-			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-				log.Printf("WARN: registrator returned non-200: %d", resp.StatusCode)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		r.logger.Error("while calling registry", "error", err)
+		// don't want to die here
+		return nil
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		r.logger.Warn("registry returned non-200", "status", resp.StatusCode)
+	} else {
+		r.registered = true
+	}
+	return nil
+}
+
+// drain asks the router to stop sending requests and waits for the ones in flight, heartbeating meanwhile.
+func (r *Registrator) drain() {
+	if !r.registered {
+		// the router never knew about us, nothing to drain
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.drainTimeout)
+	defer cancel()
+
+	drainURL, err := url.JoinPath(r.registryAddr, "drain")
+	if err != nil {
+		r.logger.Error("while building drain url", "error", err)
+		return
+	}
+	req, err := r.newRequest(ctx, http.MethodPost, drainURL, true)
+	if err != nil {
+		r.logger.Error("while building drain request", "error", err)
+		return
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		r.logger.Error("while asking router to drain", "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// the router already forgot about us
+		return
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		r.logger.Warn("router returned non-202 on drain request", "status", resp.StatusCode)
+		return
+	}
+	r.draining = true
+
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+	heartbeat := time.NewTicker(r.interval)
+	defer heartbeat.Stop()
+	for {
+		drained, err := r.drained(ctx, drainURL)
+		if err != nil {
+			r.logger.Error("while checking drain status", "error", err)
+		}
+		if drained {
+			r.logger.Info("router confirmed drain")
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			r.logger.Warn("router did not confirm drain in time, shutting down anyway", "drain_timeout", r.drainTimeout.String())
+			return
+		case <-heartbeat.C:
+			if err := r.heartbeat(ctx); err != nil {
+				r.logger.Error("while building heartbeat", "error", err)
 			}
+		case <-t.C:
 		}
 	}
 }
 
+func (r *Registrator) drained(ctx context.Context, drainURL string) (bool, error) {
+	query := url.Values{"addr": {r.myAddr}}
+	if r.pool != "" {
+		query.Set("pool", r.pool)
+	}
+	req, err := r.newRequest(ctx, http.MethodGet, drainURL+"?"+query.Encode(), false)
+	if err != nil {
+		return false, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		// expired or the router restarted, the requests it was sending us may still be in flight
+		return false, errUnknownToRouter
+	case http.StatusOK:
+		status := &registration.DrainStatus{}
+		if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+			return false, err
+		}
+		return status.Drained, nil
+	}
+	return false, fmt.Errorf("router returned %d on drain status", resp.StatusCode)
+}
+
 func (r *Registrator) deregister() {
-	body := strings.NewReader(r.myAddr)
-	req, err := http.NewRequest(http.MethodDelete, r.registryAddr, body)
+	req, err := r.newRequest(context.Background(), http.MethodDelete, r.registryAddr, true)
 	if err != nil {
 		// we're shutting down anyway, best effort here
 		return
 	}
-	_, _ = http.DefaultClient.Do(req)
+	_, _ = r.client.Do(req)
 	// we're shutting down anyway, best effort here.. not much to do with error or response code at this point.
 }
+
+// newRequest creates a call to the registry, signed when there's a secret.
+func (r *Registrator) newRequest(ctx context.Context, method, url string, withPayload bool) (*http.Request, error) {
+	var body []byte
+	if withPayload {
+		reg := &registration.Registration{Addr: r.myAddr, Weight: r.weight, Pool: r.pool, Draining: r.draining}
+		data, err := reg.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		body = data
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(r.secret) > 0 {
+		if err := registration.Sign(req, body, r.secret); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
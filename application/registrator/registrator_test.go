@@ -0,0 +1,176 @@
+package registrator
+
+import (
+	"encoding/json"
+	"io"
+	"mrbarrel/lib/registration"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	tests := map[string]struct {
+		drainStatus     int
+		inFlightPolls   int32 // number of status polls that still report requests in flight
+		unknownPolls    int32 // number of status polls, after those, where the router doesn't know us
+		drainTimeout    time.Duration
+		wantStatusPolls int32
+		// timing based, so a range instead of an exact count
+		wantMaxPolls int32
+	}{
+		"drained right away": {
+			drainStatus:     http.StatusAccepted,
+			drainTimeout:    time.Second,
+			wantStatusPolls: 1,
+		},
+		"drained after a while": {
+			drainStatus:     http.StatusAccepted,
+			inFlightPolls:   3,
+			drainTimeout:    time.Second,
+			wantStatusPolls: 4,
+		},
+		"router doesn't know us": {
+			drainStatus:     http.StatusNotFound,
+			drainTimeout:    time.Second,
+			wantStatusPolls: 0,
+		},
+		"expired while draining": {
+			drainStatus:     http.StatusAccepted,
+			inFlightPolls:   1,
+			unknownPolls:    2,
+			drainTimeout:    time.Second,
+			wantStatusPolls: 4,
+		},
+		"never drained": {
+			drainStatus:     http.StatusAccepted,
+			inFlightPolls:   1000,
+			drainTimeout:    250 * time.Millisecond,
+			wantStatusPolls: 2,
+			wantMaxPolls:    4,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var polls atomic.Int32
+			mux := http.NewServeMux()
+			mux.HandleFunc("POST /drain", func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(test.drainStatus)
+			})
+			mux.HandleFunc("GET /drain", func(w http.ResponseWriter, req *http.Request) {
+				n := polls.Add(1)
+				if n > test.inFlightPolls && n <= test.inFlightPolls+test.unknownPolls {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				_ = json.NewEncoder(w).Encode(&registration.DrainStatus{
+					Addr:    req.URL.Query().Get("addr"),
+					Drained: n > test.inFlightPolls,
+				})
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			r, err := New(&Config{RegistryAddr: server.URL + "/", MyAddr: "purple:80", NotifInterval: time.Hour, DrainTimeout: test.drainTimeout}, nil)
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			r.registered = true
+			r.drain()
+
+			got := polls.Load()
+			if test.wantMaxPolls == 0 && got != test.wantStatusPolls {
+				t.Fatalf("got %d status polls want %d", got, test.wantStatusPolls)
+			}
+			if test.wantMaxPolls != 0 && (got < test.wantStatusPolls || got > test.wantMaxPolls) {
+				t.Fatalf("got %d status polls want %d to %d", got, test.wantStatusPolls, test.wantMaxPolls)
+			}
+		})
+	}
+}
+
+func TestHeartbeatWhileDraining(t *testing.T) {
+	var heartbeats, drainingHeartbeats, polls atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /", func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		reg, err := registration.Parse(body)
+		if err != nil {
+			t.Errorf("got unexpected error: %v", err)
+			return
+		}
+		heartbeats.Add(1)
+		if reg.Draining {
+			drainingHeartbeats.Add(1)
+		}
+	})
+	mux.HandleFunc("POST /drain", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("GET /drain", func(w http.ResponseWriter, req *http.Request) {
+		// in flight for longer than a few heartbeats
+		_ = json.NewEncoder(w).Encode(&registration.DrainStatus{Drained: polls.Add(1) > 5})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	r, err := New(&Config{RegistryAddr: server.URL + "/", MyAddr: "purple:80", NotifInterval: 120 * time.Millisecond, DrainTimeout: 5 * time.Second}, nil)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	r.registered = true
+	r.drain()
+
+	if got := heartbeats.Load(); got == 0 || got != drainingHeartbeats.Load() {
+		t.Fatalf("got %d heartbeats, %d of them draining, want at least one and all draining", got, drainingHeartbeats.Load())
+	}
+}
+
+func TestSignedCalls(t *testing.T) {
+	tests := map[string]struct {
+		secret       string
+		wantVerified int32
+	}{
+		"signed with the router's secret": {secret: "s3cret", wantVerified: 3},
+		"signed with another secret":      {secret: "guess", wantVerified: 0},
+		"not signed":                      {wantVerified: 0},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var verified atomic.Int32
+			verifier := registration.NewVerifier([]byte("s3cret"), 0)
+			mux := http.NewServeMux()
+			mux.HandleFunc("POST /drain", func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+			})
+			mux.HandleFunc("GET /drain", func(w http.ResponseWriter, req *http.Request) {
+				_ = json.NewEncoder(w).Encode(&registration.DrainStatus{Drained: true})
+			})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, _ := io.ReadAll(req.Body)
+				if verifier.Verify(req, body) == nil {
+					verified.Add(1)
+				}
+				mux.ServeHTTP(w, req)
+			}))
+			defer server.Close()
+
+			r, err := New(&Config{RegistryAddr: server.URL + "/", MyAddr: "purple:80", NotifInterval: time.Hour, DrainTimeout: time.Second, Secret: test.secret}, nil)
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			r.registered = true
+			// drain posts and polls, deregister deletes
+			r.drain()
+			r.deregister()
+
+			if got := verified.Load(); got != test.wantVerified {
+				t.Fatalf("got %d verified calls want %d", got, test.wantVerified)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package deadline
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Header carries the milliseconds a backend has left to answer, so clocks don't need to agree.
+const Header = "X-Request-Deadline"
+
+// Set writes the time left until the deadline of ctx to h.
+func Set(ctx context.Context, h http.Header) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		h.Del(Header)
+		return
+	}
+	left := time.Until(deadline).Milliseconds()
+	if left < 0 {
+		left = 0
+	}
+	h.Set(Header, strconv.FormatInt(left, 10))
+}
+
+// FromRequest returns the context of req, ending when the time in its header runs out.
+func FromRequest(req *http.Request) (context.Context, context.CancelFunc) {
+	left, err := strconv.ParseInt(req.Header.Get(Header), 10, 64)
+	if err != nil || left < 0 {
+		return context.WithCancel(req.Context())
+	}
+	return context.WithTimeout(req.Context(), time.Duration(left)*time.Millisecond)
+}
@@ -0,0 +1,71 @@
+package deadline
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSet(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	h := http.Header{}
+	Set(ctx, h)
+	left, err := time.ParseDuration(h.Get(Header) + "ms")
+	if err != nil || left > 2*time.Second || left < time.Second {
+		t.Fatalf("got %q, want about 2000", h.Get(Header))
+	}
+
+	// without a deadline a header sent by the client doesn't get through
+	Set(context.Background(), h)
+	if got := h.Get(Header); got != "" {
+		t.Fatalf("got %q, want no header", got)
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	tests := map[string]struct {
+		header       string
+		wantDeadline bool
+		wantExpired  bool
+	}{
+		"no header": {},
+		"invalid header": {
+			header: "soon",
+		},
+		"negative header": {
+			header: "-5",
+		},
+		"time left": {
+			header:       "1500",
+			wantDeadline: true,
+		},
+		"no time left": {
+			header:       "0",
+			wantDeadline: true,
+			wantExpired:  true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.header != "" {
+				req.Header.Set(Header, test.header)
+			}
+			ctx, cancel := FromRequest(req)
+			defer cancel()
+
+			deadline, ok := ctx.Deadline()
+			if ok != test.wantDeadline {
+				t.Fatalf("got deadline %v, want one: %v", deadline, test.wantDeadline)
+			}
+			if expired := ctx.Err() != nil; expired != test.wantExpired {
+				t.Fatalf("got expired %v want %v", expired, test.wantExpired)
+			}
+		})
+	}
+}
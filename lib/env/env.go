@@ -44,6 +44,84 @@ func MustGetDurationOrDefault(key string, defaultVal time.Duration) time.Duratio
 	return dur
 }
 
+func MustGetFloatOrDefault(key string, defaultVal float64) float64 {
+	val, present := os.LookupEnv(key)
+	if !present {
+		return defaultVal
+	}
+	val = strings.TrimSpace(val)
+	if val == "" {
+		panic(fmt.Sprintf("env var %s is provided but empty", key))
+	}
+
+	floatVal, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		panic(fmt.Sprintf("env var %s is not a float: %q", key, val))
+	}
+
+	return floatVal
+}
+
+func MustGetBoolOrDefault(key string, defaultVal bool) bool {
+	val, present := os.LookupEnv(key)
+	if !present {
+		return defaultVal
+	}
+	val = strings.TrimSpace(val)
+	if val == "" {
+		panic(fmt.Sprintf("env var %s is provided but empty", key))
+	}
+
+	boolVal, err := strconv.ParseBool(val)
+	if err != nil {
+		panic(fmt.Sprintf("env var %s is not a bool: %q", key, val))
+	}
+
+	return boolVal
+}
+
+// MustGetIntListOrDefault reads a comma separated list of ints.
+func MustGetIntListOrDefault(key string, defaultVal []int) []int {
+	val, present := os.LookupEnv(key)
+	if !present {
+		return defaultVal
+	}
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return []int{}
+	}
+
+	var res []int
+	for _, part := range strings.Split(val, ",") {
+		intVal, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			panic(fmt.Sprintf("env var %s is not a list of ints: %q", key, val))
+		}
+		res = append(res, intVal)
+	}
+
+	return res
+}
+
+// MustGetStringListOrDefault reads a comma separated list of strings, surrounding spaces are trimmed.
+func MustGetStringListOrDefault(key string, defaultVal []string) []string {
+	val, present := os.LookupEnv(key)
+	if !present {
+		return defaultVal
+	}
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return []string{}
+	}
+
+	var res []string
+	for _, part := range strings.Split(val, ",") {
+		res = append(res, strings.TrimSpace(part))
+	}
+
+	return res
+}
+
 func MustGetIntOrDefault(key string, defaultVal int64) int64 {
 	val, present := os.LookupEnv(key)
 	if !present {
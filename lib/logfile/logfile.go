@@ -0,0 +1,110 @@
+package logfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type Config struct {
+	Path string
+	// MaxSize is the size in bytes a file can grow to before it's rotated, 0 never rotates.
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept, Path.1 is the most recent.
+	MaxBackups int
+}
+
+// File appends to Config.Path and rotates it past MaxSize, it's safe for concurrent writes.
+type File struct {
+	cfg  Config
+	lock sync.Mutex
+	// f is nil when the file couldn't be opened again after a rotation, the next write tries again.
+	f    *os.File
+	size int64
+}
+
+func Open(cfg Config) (*File, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("no path")
+	}
+	if cfg.MaxSize < 0 || cfg.MaxBackups < 0 {
+		return nil, fmt.Errorf("maxSize and maxBackups can't be negative")
+	}
+	f := &File{cfg: cfg}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.f, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p to the file, even when the rotation before it failed.
+func (f *File) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var rotateErr error
+	if f.f != nil && f.cfg.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.cfg.MaxSize {
+		if rotateErr = f.rotate(); rotateErr != nil {
+			rotateErr = fmt.Errorf("while rotating %s: %w", f.cfg.Path, rotateErr)
+		}
+	}
+	if f.f == nil {
+		if err := f.open(); err != nil {
+			return 0, errors.Join(rotateErr, err)
+		}
+	}
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate shifts the backups up by one and opens Path again, even when that failed.
+func (f *File) rotate() error {
+	closeErr := f.f.Close()
+	f.f = nil
+	err := errors.Join(closeErr, f.shift())
+	return errors.Join(err, f.open())
+}
+
+func (f *File) shift() error {
+	if f.cfg.MaxBackups == 0 {
+		return os.Remove(f.cfg.Path)
+	}
+	for i := f.cfg.MaxBackups - 1; i > 0; i-- {
+		err := os.Rename(f.backup(i), f.backup(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.cfg.Path, f.backup(1))
+}
+
+func (f *File) backup(i int) string {
+	return fmt.Sprintf("%s.%d", f.cfg.Path, i)
+}
+
+func (f *File) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.f == nil {
+		return nil
+	}
+	return f.f.Close()
+}
@@ -0,0 +1,118 @@
+package logfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotation(t *testing.T) {
+	tests := map[string]struct {
+		maxSize    int64
+		maxBackups int
+		writes     []string
+		want       map[string]string
+	}{
+		"no rotation": {
+			writes: []string{"one\n", "two\n"},
+			want:   map[string]string{"access.log": "one\ntwo\n"},
+		},
+		"rotated": {
+			maxSize:    8,
+			maxBackups: 2,
+			writes:     []string{"one\n", "two\n", "three\n", "four\n", "five\n"},
+			want:       map[string]string{"access.log": "five\n", "access.log.1": "four\n", "access.log.2": "three\n"},
+		},
+		"no backups": {
+			maxSize: 8,
+			writes:  []string{"one\n", "two\n", "three\n"},
+			want:    map[string]string{"access.log": "three\n"},
+		},
+		"write larger than max": {
+			maxSize:    4,
+			maxBackups: 1,
+			writes:     []string{"three\n", "four\n"},
+			want:       map[string]string{"access.log": "four\n", "access.log.1": "three\n"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			f, err := Open(Config{Path: filepath.Join(dir, "access.log"), MaxSize: test.maxSize, MaxBackups: test.maxBackups})
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			for _, w := range test.writes {
+				if _, err := f.Write([]byte(w)); err != nil {
+					t.Fatalf("got unexpected error: %v", err)
+				}
+			}
+			f.Close()
+
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != len(test.want) {
+				t.Fatalf("got %d files want %d", len(entries), len(test.want))
+			}
+			for name, want := range test.want {
+				got, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil || string(got) != want {
+					t.Fatalf("got %q (%v) in %s want %q", got, err, name, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAppendsToExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	if err := os.WriteFile(path, []byte("one\n"), 0o644); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	f, err := Open(Config{Path: path, MaxSize: 8, MaxBackups: 1})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	f.Write([]byte("two\n"))
+	f.Write([]byte("three\n"))
+	f.Close()
+
+	for name, want := range map[string]string{path: "three\n", path + ".1": "one\ntwo\n"} {
+		if got, _ := os.ReadFile(name); string(got) != want {
+			t.Fatalf("got %q in %s want %q", got, name, want)
+		}
+	}
+}
+
+func TestRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	// a directory can't be renamed over, so the rotation fails.
+	if err := os.Mkdir(path+".1", 0o755); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	f, err := Open(Config{Path: path, MaxSize: 8, MaxBackups: 1})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	defer f.Close()
+	f.Write([]byte("one\n"))
+	f.Write([]byte("two\n"))
+	if n, err := f.Write([]byte("three\n")); err == nil || n != 6 {
+		t.Fatalf("got %d, %v want 6 and an error", n, err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "one\ntwo\nthree\n" {
+		t.Fatalf("got %q want all the lines", got)
+	}
+
+	if err := os.Remove(path + ".1"); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if _, err := f.Write([]byte("four\n")); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	for name, want := range map[string]string{path: "four\n", path + ".1": "one\ntwo\nthree\n"} {
+		if got, err := os.ReadFile(name); err != nil || string(got) != want {
+			t.Fatalf("got %q (%v) in %s want %q", got, err, name, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// The components that have their own level.
+const (
+	Main        = "main"
+	Config      = "config"
+	TLS         = "tls"
+	Router      = "router"
+	Registry    = "registry"
+	Admin       = "admin"
+	Pool        = "pool"
+	RateLimit   = "ratelimit"
+	Handler     = "handler"
+	Registrator = "registrator"
+)
+
+// The keys of the attributes shared by the components.
+const (
+	ComponentKey = "component"
+	// BackendKey is the address a backend registered with.
+	BackendKey = "backend"
+	// RequestIDKey is the id the router gives each request, it's passed on in the RequestIDHeader.
+	RequestIDKey = "request_id"
+	// FromKey and ToKey are the states of a transition.
+	FromKey = "from"
+	ToKey   = "to"
+)
+
+// RequestIDHeader carries the request id from the router to the backends.
+const RequestIDHeader = "X-Request-Id"
+
+// Levels are the minimum levels that get logged, per component. Default is used for the others.
+type Levels struct {
+	Default    slog.Level
+	Components map[string]slog.Level
+}
+
+func (l *Levels) of(component string) slog.Level {
+	if level, ok := l.Components[component]; ok {
+		return level
+	}
+	return l.Default
+}
+
+var levels atomic.Pointer[Levels]
+
+func init() {
+	levels.Store(&Levels{Default: slog.LevelInfo})
+}
+
+// ParseLevels reads a default level and levels per component, like "info,pool=debug,ratelimit=warn".
+func ParseLevels(s string) (Levels, error) {
+	res := Levels{Default: slog.LevelInfo, Components: map[string]slog.Level{}}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		component, text, found := strings.Cut(entry, "=")
+		if !found {
+			text = component
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(strings.TrimSpace(text))); err != nil {
+			return Levels{}, fmt.Errorf("invalid level in %q: %w", entry, err)
+		}
+		if found {
+			res.Components[strings.TrimSpace(component)] = level
+		} else {
+			res.Default = level
+		}
+	}
+	return res, nil
+}
+
+// Setup applies l, and sends the default loggers to the Main component.
+func Setup(l Levels) {
+	SetLevels(l)
+	slog.SetDefault(Logger(Main))
+}
+
+// SetLevels applies l to every Logger, those created before included.
+func SetLevels(l Levels) {
+	levels.Store(&l)
+}
+
+// Logger returns the logger of component, it writes JSON to stderr.
+func Logger(component string) *slog.Logger {
+	return newLogger(os.Stderr, component)
+}
+
+func newLogger(w io.Writer, component string) *slog.Logger {
+	h := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug})
+	return slog.New(&levelHandler{Handler: h, component: component}).With(ComponentKey, component)
+}
+
+// levelHandler filters on the current level of its component.
+type levelHandler struct {
+	slog.Handler
+	component string
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= levels.Load().of(h.component)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithAttrs(attrs), component: h.component}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithGroup(name), component: h.component}
+}
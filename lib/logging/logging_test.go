@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+func TestParseLevels(t *testing.T) {
+	tests := map[string]struct {
+		s       string
+		want    Levels
+		wantErr bool
+	}{
+		"empty":         {want: Levels{Default: slog.LevelInfo, Components: map[string]slog.Level{}}},
+		"default":       {s: "debug", want: Levels{Default: slog.LevelDebug, Components: map[string]slog.Level{}}},
+		"per component": {s: "warn, pool=debug,ratelimit=ERROR", want: Levels{Default: slog.LevelWarn, Components: map[string]slog.Level{Pool: slog.LevelDebug, RateLimit: slog.LevelError}}},
+		"unknown level": {s: "pool=loud", wantErr: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseLevels(test.s)
+			if test.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error: %t", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got levels %+v want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	defer SetLevels(*levels.Load())
+	var buf bytes.Buffer
+	pool, router := newLogger(&buf, Pool), newLogger(&buf, Router)
+
+	SetLevels(Levels{Default: slog.LevelWarn, Components: map[string]slog.Level{Pool: slog.LevelDebug}})
+	pool.Debug("added backend", BackendKey, "purple:80")
+	router.Info("not logged")
+	router.With(RequestIDKey, "abc").Warn("retry budget exhausted")
+
+	var lines []map[string]any
+	for dec := json.NewDecoder(&buf); dec.More(); {
+		line := map[string]any{}
+		if err := dec.Decode(&line); err != nil {
+			t.Fatalf("got unexpected error: %v", err)
+		}
+		delete(line, slog.TimeKey)
+		lines = append(lines, line)
+	}
+	want := []map[string]any{
+		{"level": "DEBUG", "msg": "added backend", ComponentKey: Pool, BackendKey: "purple:80"},
+		{"level": "WARN", "msg": "retry budget exhausted", ComponentKey: Router, RequestIDKey: "abc"},
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("got lines %v want %v", lines, want)
+	}
+}
@@ -0,0 +1,293 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Minimal metrics in the Prometheus text exposition format (version 0.0.4), standard library only.
+// See https://prometheus.io/docs/instrumenting/exposition_formats/
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type Type string
+
+const (
+	Counter   Type = "counter"
+	Gauge     Type = "gauge"
+	Histogram Type = "histogram"
+)
+
+// DefaultBuckets are latency buckets in seconds, same as the Prometheus client libraries use.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Sample is a single value for a set of label values, as returned by collector functions.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type family interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds all metric families and writes them out in the order they were registered.
+type Registry struct {
+	lock     sync.Mutex
+	families []family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f family) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.families = append(r.families, f)
+}
+
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	families := make([]family, len(r.families))
+	copy(families, r.families)
+	r.lock.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		f.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	_, _ = r.WriteTo(w)
+}
+
+type desc struct {
+	name       string
+	help       string
+	typ        Type
+	labelNames []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	desc
+	lock   sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, typ: Counter, labelNames: labelNames},
+		values: map[string]*counterValue{},
+	}
+	r.register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cv, ok := c.values[key]
+	if !ok {
+		cv = &counterValue{labelValues: labelValues}
+		c.values[key] = cv
+	}
+	cv.value += v
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeHeader(w)
+	for _, key := range sortedKeys(c.values) {
+		cv := c.values[key]
+		writeSample(w, c.name, c.labelNames, cv.labelValues, "", "", cv.value)
+	}
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative
+	sum         float64
+	count       uint64
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: Histogram, labelNames: labelNames},
+		buckets: sorted,
+		values:  map[string]*histogramValue{},
+	}
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	idx := sort.SearchFloat64s(h.buckets, v)
+	if idx < len(h.buckets) {
+		hv.counts[idx]++
+	}
+	hv.sum += v
+	hv.count++
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.writeHeader(w)
+	for _, key := range sortedKeys(h.values) {
+		hv := h.values[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hv.counts[i]
+			writeSample(w, h.name+"_bucket", h.labelNames, hv.labelValues, "le", formatFloat(upper), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", h.labelNames, hv.labelValues, "le", "+Inf", float64(hv.count))
+		writeSample(w, h.name+"_sum", h.labelNames, hv.labelValues, "", "", hv.sum)
+		writeSample(w, h.name+"_count", h.labelNames, hv.labelValues, "", "", float64(hv.count))
+	}
+}
+
+// collector gets its samples from a function, for values that live elsewhere.
+type collector struct {
+	desc
+	collect func() []Sample
+}
+
+// NewCollector registers a family whose samples come from collect.
+func (r *Registry) NewCollector(name, help string, typ Type, collect func() []Sample, labelNames ...string) {
+	r.register(&collector{
+		desc:    desc{name: name, help: help, typ: typ, labelNames: labelNames},
+		collect: collect,
+	})
+}
+
+func (c *collector) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	for _, s := range c.collect() {
+		writeSample(w, c.name, c.labelNames, s.LabelValues, "", "", s.Value)
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labelNames, labelValues []string, extraName, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labelNames) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, ln := range labelNames {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			lv := ""
+			if i < len(labelValues) {
+				lv = labelValues[i]
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", ln, escapeLabelValue(lv))
+		}
+		if extraName != "" {
+			if len(labelNames) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
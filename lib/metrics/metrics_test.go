@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	tests := map[string]struct {
+		setup func(r *Registry)
+		want  string
+	}{
+		"empty registry": {
+			setup: func(r *Registry) {},
+			want:  "",
+		},
+		"counter": {
+			setup: func(r *Registry) {
+				c := r.NewCounterVec("requests_total", "Number of requests.", "method", "code")
+				c.Inc("POST", "200")
+				c.Inc("POST", "200")
+				c.Add(3, "GET", "502")
+			},
+			want: `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{method="GET",code="502"} 3
+requests_total{method="POST",code="200"} 2
+`,
+		},
+		"counter without labels": {
+			setup: func(r *Registry) {
+				c := r.NewCounterVec("requests_total", "Number of requests.")
+				c.Inc()
+			},
+			want: `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total 1
+`,
+		},
+		"histogram": {
+			setup: func(r *Registry) {
+				h := r.NewHistogramVec("duration_seconds", "Request duration.", []float64{0.1, 1}, "method")
+				h.Observe(0.05, "POST")
+				h.Observe(0.1, "POST")
+				h.Observe(0.5, "POST")
+				h.Observe(5, "POST")
+			},
+			want: `# HELP duration_seconds Request duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{method="POST",le="0.1"} 2
+duration_seconds_bucket{method="POST",le="1"} 3
+duration_seconds_bucket{method="POST",le="+Inf"} 4
+duration_seconds_sum{method="POST"} 5.65
+duration_seconds_count{method="POST"} 4
+`,
+		},
+		"collector": {
+			setup: func(r *Registry) {
+				r.NewCollector("pool_size", "Number of backends.", Gauge, func() []Sample {
+					return []Sample{{Value: 3}}
+				})
+				r.NewCollector("backend_wait_seconds", "Wait time.", Gauge, func() []Sample {
+					return []Sample{{LabelValues: []string{"a:80"}, Value: 0.1}, {LabelValues: []string{"b:80"}, Value: 0}}
+				}, "backend")
+			},
+			want: `# HELP pool_size Number of backends.
+# TYPE pool_size gauge
+pool_size 3
+# HELP backend_wait_seconds Wait time.
+# TYPE backend_wait_seconds gauge
+backend_wait_seconds{backend="a:80"} 0.1
+backend_wait_seconds{backend="b:80"} 0
+`,
+		},
+		"escaping": {
+			setup: func(r *Registry) {
+				c := r.NewCounterVec("escaped_total", "Help with \\ and\nnewline.", "path")
+				c.Inc("/say \"hi\"\\\n")
+			},
+			want: `# HELP escaped_total Help with \\ and\nnewline.
+# TYPE escaped_total counter
+escaped_total{path="/say \"hi\"\\\n"} 1
+`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := NewRegistry()
+			test.setup(r)
+			var sb strings.Builder
+			if _, err := r.WriteTo(&sb); err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			if sb.String() != test.want {
+				t.Fatalf("output differs:\ngot:\n%s\nwant:\n%s", sb.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("requests_total", "Number of requests.").Inc()
+
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d want %d", res.Code, http.StatusOK)
+	}
+	if ct := res.Header().Get("Content-Type"); ct != contentType {
+		t.Fatalf("got content type %q want %q", ct, contentType)
+	}
+	if !strings.Contains(res.Body.String(), "requests_total 1\n") {
+		t.Fatalf("missing sample in %q", res.Body.String())
+	}
+}
@@ -0,0 +1,111 @@
+package registration
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The headers of a signed request, the signature is an HMAC-SHA256 of the request.
+const (
+	SignatureHeader = "X-Registration-Signature"
+	TimestampHeader = "X-Registration-Timestamp"
+	NonceHeader     = "X-Registration-Nonce"
+)
+
+// DefaultMaxSkew is how far the timestamp of a request may be from the clock of the router.
+const DefaultMaxSkew = 30 * time.Second
+
+var (
+	errUnsigned     = errors.New("request is not signed")
+	errBadSignature = errors.New("signature doesn't match")
+	errReplayed     = errors.New("request was already seen")
+)
+
+// Sign adds the signature headers to req, body must be what req sends.
+func Sign(req *http.Request, body []byte, secret []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("while creating nonce: %w", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, hex.EncodeToString(nonce))
+	req.Header.Set(SignatureHeader, signature(secret, req, body))
+	return nil
+}
+
+func signature(secret []byte, req *http.Request, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	for _, part := range []string{req.Method, req.URL.RequestURI(), req.Header.Get(TimestampHeader), req.Header.Get(NonceHeader)} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{'\n'})
+	}
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verifier checks the signature of requests, and that they are recent and not replayed.
+type Verifier struct {
+	secret  []byte
+	maxSkew time.Duration
+	lock    sync.Mutex
+	seen    map[string]time.Time
+	swept   time.Time
+	now     func() time.Time
+}
+
+// NewVerifier returns a Verifier for secret, DefaultMaxSkew is used when maxSkew isn't positive.
+func NewVerifier(secret []byte, maxSkew time.Duration) *Verifier {
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	return &Verifier{secret: secret, maxSkew: maxSkew, seen: map[string]time.Time{}, now: time.Now}
+}
+
+// Verify returns an error when req, sending body, isn't signed with the secret or was sent before.
+func (v *Verifier) Verify(req *http.Request, body []byte) error {
+	sig, nonce := req.Header.Get(SignatureHeader), req.Header.Get(NonceHeader)
+	millis, err := strconv.ParseInt(req.Header.Get(TimestampHeader), 10, 64)
+	if sig == "" || nonce == "" || err != nil {
+		return errUnsigned
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(v.secret, req, body))) {
+		return errBadSignature
+	}
+
+	now := v.now()
+	sent := time.UnixMilli(millis)
+	if sent.Before(now.Add(-v.maxSkew)) || sent.After(now.Add(v.maxSkew)) {
+		return fmt.Errorf("timestamp %s is more than %s away from now", sent.Format(time.RFC3339), v.maxSkew)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.sweep(now)
+	if _, ok := v.seen[nonce]; ok {
+		return errReplayed
+	}
+	v.seen[nonce] = sent.Add(v.maxSkew)
+	return nil
+}
+
+// sweep forgets the nonces of requests that are too old to be accepted anyway.
+func (v *Verifier) sweep(now time.Time) {
+	if now.Sub(v.swept) < v.maxSkew {
+		return
+	}
+	v.swept = now
+	for nonce, expires := range v.seen {
+		if expires.Before(now) {
+			delete(v.seen, nonce)
+		}
+	}
+}
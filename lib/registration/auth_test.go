@@ -0,0 +1,97 @@
+package registration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("s3cret")
+	body := []byte(`{"addr":"purple:80"}`)
+
+	tests := map[string]struct {
+		sign    func(req *http.Request)
+		body    []byte
+		wantErr string
+	}{
+		"signed": {
+			sign: func(req *http.Request) { Sign(req, body, secret) },
+		},
+		"unsigned": {
+			sign:    func(req *http.Request) {},
+			wantErr: "not signed",
+		},
+		"other secret": {
+			sign:    func(req *http.Request) { Sign(req, body, []byte("guess")) },
+			wantErr: "doesn't match",
+		},
+		"other body": {
+			sign:    func(req *http.Request) { Sign(req, body, secret) },
+			body:    []byte(`{"addr":"evil:80"}`),
+			wantErr: "doesn't match",
+		},
+		"other path": {
+			sign: func(req *http.Request) {
+				Sign(req, body, secret)
+				req.URL.Path = "/drain"
+			},
+			wantErr: "doesn't match",
+		},
+		"too old": {
+			sign: func(req *http.Request) {
+				req.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Add(-time.Minute).UnixMilli(), 10))
+				req.Header.Set(NonceHeader, "abc")
+				req.Header.Set(SignatureHeader, signature(secret, req, body))
+			},
+			wantErr: "away from now",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			test.sign(req)
+			sent := body
+			if test.body != nil {
+				sent = test.body
+			}
+			err := NewVerifier(secret, 0).Verify(req, sent)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	secret := []byte("s3cret")
+	v := NewVerifier(secret, time.Second)
+	now := time.Now()
+	v.now = func() time.Time { return now }
+
+	req := httptest.NewRequest(http.MethodDelete, "/", nil)
+	Sign(req, nil, secret)
+	if err := v.Verify(req, nil); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if err := v.Verify(req, nil); err != errReplayed {
+		t.Fatalf("got error %v on replay, want %v", err, errReplayed)
+	}
+
+	// the nonce is forgotten once the request is too old anyway
+	now = now.Add(3 * time.Second)
+	if err := v.Verify(req, nil); err == nil || err == errReplayed {
+		t.Fatalf("got error %v, want the timestamp to be refused", err)
+	}
+	v.sweep(now)
+	if len(v.seen) != 0 {
+		t.Fatalf("got %d nonces kept, want none", len(v.seen))
+	}
+}
@@ -0,0 +1,65 @@
+package registration
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	DefaultWeight = 1
+	// MaxWeight keeps the sums of the weights from overflowing.
+	MaxWeight = 1000
+)
+
+var errEmptyAddr = errors.New("registration without address")
+
+// Registration is the payload instances send to the router's registry.
+type Registration struct {
+	Addr string `json:"addr"`
+	// Weight is the relative share of traffic, 1 to MaxWeight.
+	Weight int `json:"weight,omitempty"`
+	// Pool is the name of the pool this instance belongs to, the router's default pool when empty.
+	Pool string `json:"pool,omitempty"`
+	// Draining is set on the heartbeats of an instance that is shutting down.
+	Draining bool `json:"draining,omitempty"`
+}
+
+func (r *Registration) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// Parse reads a registration payload, or the bare address older instances post.
+func Parse(body []byte) (*Registration, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, errEmptyAddr
+	}
+
+	if body[0] != '{' {
+		return &Registration{Addr: string(body), Weight: DefaultWeight}, nil
+	}
+
+	reg := &Registration{}
+	if err := json.Unmarshal(body, reg); err != nil {
+		return nil, fmt.Errorf("invalid registration payload: %w", err)
+	}
+	if reg.Addr == "" {
+		return nil, errEmptyAddr
+	}
+	if reg.Weight < 0 || reg.Weight > MaxWeight {
+		return nil, fmt.Errorf("invalid weight %d for %s", reg.Weight, reg.Addr)
+	}
+	if reg.Weight == 0 {
+		reg.Weight = DefaultWeight
+	}
+	return reg, nil
+}
+
+// DrainStatus is how the router answers an instance asking whether it has been drained.
+type DrainStatus struct {
+	Addr     string `json:"addr"`
+	Drained  bool   `json:"drained"`
+	InFlight int64  `json:"inFlight"`
+}
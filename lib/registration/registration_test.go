@@ -0,0 +1,77 @@
+package registration
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]struct {
+		body    string
+		want    *Registration
+		wantErr bool
+	}{
+		"empty body": {
+			body:    "",
+			wantErr: true,
+		},
+		"bare address": {
+			body: "somewhere.org:8080",
+			want: &Registration{Addr: "somewhere.org:8080", Weight: DefaultWeight},
+		},
+		"json without weight": {
+			body: `{"addr": "somewhere.org:8080"}`,
+			want: &Registration{Addr: "somewhere.org:8080", Weight: DefaultWeight},
+		},
+		"json with weight": {
+			body: `{"addr": "somewhere.org:8080", "weight": 5}`,
+			want: &Registration{Addr: "somewhere.org:8080", Weight: 5},
+		},
+		"json with pool": {
+			body: `{"addr": "somewhere.org:8080", "pool": "payments"}`,
+			want: &Registration{Addr: "somewhere.org:8080", Weight: DefaultWeight, Pool: "payments"},
+		},
+		"json without address": {
+			body:    `{"weight": 5}`,
+			wantErr: true,
+		},
+		"json with negative weight": {
+			body:    `{"addr": "somewhere.org:8080", "weight": -1}`,
+			wantErr: true,
+		},
+		"json with max weight": {
+			body: `{"addr": "somewhere.org:8080", "weight": 1000}`,
+			want: &Registration{Addr: "somewhere.org:8080", Weight: MaxWeight},
+		},
+		"json with weight above max": {
+			body:    `{"addr": "somewhere.org:8080", "weight": 1001}`,
+			wantErr: true,
+		},
+		"json with huge weight": {
+			body:    `{"addr": "somewhere.org:8080", "weight": 9223372036854775807}`,
+			wantErr: true,
+		},
+		"broken json": {
+			body:    `{"addr": "somewhere.org:8080"`,
+			wantErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := Parse([]byte(test.body))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error but got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %+v want %+v", got, test.want)
+			}
+		})
+	}
+}
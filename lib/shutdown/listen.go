@@ -2,7 +2,7 @@ package shutdown
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
@@ -13,7 +13,7 @@ func ListenStopSignal(ctx context.Context, cancelFunc context.CancelFunc) {
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 	select {
 	case <-stop:
-		log.Println("Stop signal received, shutting down service...")
+		slog.Info("stop signal received, shutting down service")
 		cancelFunc()
 	case <-ctx.Done():
 	}
@@ -0,0 +1,231 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"mrbarrel/lib/logging"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+var logger = logging.Logger(logging.TLS)
+
+// the files are checked for changes at most this often, on the handshakes that happen after it.
+const reloadInterval = time.Second
+
+// Config points to the PEM files of a TLS endpoint, the zero Config is plain HTTP.
+type Config struct {
+	// CertFile and KeyFile are what this side presents, a server needs them.
+	CertFile string
+	KeyFile  string
+	// CAFile holds the CAs the other side is verified against, mutual TLS for a server.
+	CAFile string
+	// Certificates are served by name (SNI), CertFile to the clients that ask for another one.
+	Certificates []KeyPair
+}
+
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Enabled tells whether a server should use TLS.
+func (c Config) Enabled() bool {
+	return c.CertFile != ""
+}
+
+func (c Config) IsZero() bool {
+	return c.Equal(Config{})
+}
+
+func (c Config) Equal(other Config) bool {
+	return c.CertFile == other.CertFile && c.KeyFile == other.KeyFile && c.CAFile == other.CAFile &&
+		slices.Equal(c.Certificates, other.Certificates)
+}
+
+func (c Config) Validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("certFile and keyFile go together")
+	}
+	if len(c.Certificates) > 0 && c.CertFile == "" {
+		return errors.New("certificates need a default certFile")
+	}
+	for i, pair := range c.Certificates {
+		if pair.CertFile == "" || pair.KeyFile == "" {
+			return fmt.Errorf("certificates[%d]: certFile and keyFile are required", i)
+		}
+	}
+	return nil
+}
+
+// paths lists every file of c, the ones that aren't set are empty.
+func (c Config) paths() []string {
+	paths := []string{c.CertFile, c.KeyFile, c.CAFile}
+	for _, pair := range c.Certificates {
+		paths = append(paths, pair.CertFile, pair.KeyFile)
+	}
+	return paths
+}
+
+// Files holds what was loaded from the files of a Config, and reloads them when they change.
+type Files struct {
+	cfg      Config
+	lock     sync.Mutex
+	checked  time.Time
+	modTimes []time.Time
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	// byName are the Certificates, in order.
+	byName []*tls.Certificate
+}
+
+// Load reads the files of cfg, it fails when they can't be used.
+func Load(cfg Config) (*Files, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	f := &Files{cfg: cfg}
+	if err := f.load(f.stat()); err != nil {
+		return nil, err
+	}
+	f.checked = time.Now()
+	return f, nil
+}
+
+func (f *Files) stat() []time.Time {
+	paths := f.cfg.paths()
+	modTimes := make([]time.Time, len(paths))
+	for i, path := range paths {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (f *Files) load(modTimes []time.Time) error {
+	var cert *tls.Certificate
+	if f.cfg.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(f.cfg.CertFile, f.cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("while loading certificate: %w", err)
+		}
+		cert = &pair
+	}
+	var pool *x509.CertPool
+	if f.cfg.CAFile != "" {
+		pem, err := os.ReadFile(f.cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("while loading CAs: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no CA certificate found in %s", f.cfg.CAFile)
+		}
+	}
+	byName := make([]*tls.Certificate, 0, len(f.cfg.Certificates))
+	for _, kp := range f.cfg.Certificates {
+		pair, err := tls.LoadX509KeyPair(kp.CertFile, kp.KeyFile)
+		if err != nil {
+			return fmt.Errorf("while loading certificate %s: %w", kp.CertFile, err)
+		}
+		byName = append(byName, &pair)
+	}
+	f.cert, f.pool, f.byName, f.modTimes = cert, pool, byName, modTimes
+	return nil
+}
+
+// current returns the certificate and CAs, reloaded when a file changed.
+func (f *Files) current() (*tls.Certificate, *x509.CertPool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.reload()
+	return f.cert, f.pool
+}
+
+// forName is current with the certificate for the name the client asked for.
+func (f *Files) forName(hello *tls.ClientHelloInfo) (*tls.Certificate, *x509.CertPool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.reload()
+	if hello.ServerName != "" {
+		for _, cert := range f.byName {
+			if hello.SupportsCertificate(cert) == nil {
+				return cert, f.pool
+			}
+		}
+	}
+	return f.cert, f.pool
+}
+
+func (f *Files) reload() {
+	if time.Since(f.checked) >= reloadInterval {
+		f.checked = time.Now()
+		if modTimes := f.stat(); !slices.Equal(modTimes, f.modTimes) {
+			if err := f.load(modTimes); err != nil {
+				logger.Warn("keeping the previous certificates", "error", err)
+			} else {
+				logger.Info("reloaded certificates", "cert_file", f.cfg.CertFile, "ca_file", f.cfg.CAFile)
+			}
+		}
+	}
+}
+
+// ServerConfig returns the tls.Config of a server.
+func (f *Files) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := f.forName(hello)
+			cfg := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{*cert}}
+			if pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// ClientConfig returns the tls.Config of a client of serverName, the host or IP it dials.
+func (f *Files) ClientConfig(serverName string) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert, _ := f.current(); cert != nil {
+				return cert, nil
+			}
+			// no certificate, the server decides whether that's fine
+			return &tls.Certificate{}, nil
+		},
+	}
+	if f.cfg.CAFile == "" {
+		return cfg
+	}
+	// the CAs can change, so the server is verified here. cs.ServerName is empty for an IP.
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		_, pool := f.current()
+		if serverName == "" {
+			return errors.New("no server name to verify the certificate against")
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("server didn't present a certificate")
+		}
+		opts := x509.VerifyOptions{DNSName: serverName, Roots: pool, Intermediates: x509.NewCertPool()}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+	return cfg
+}
@@ -0,0 +1,195 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"mrbarrel/lib/tlsconfig/tlstest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMutualTLS(t *testing.T) {
+	ca, other := tlstest.NewCA(t), tlstest.NewCA(t)
+	serverCert, serverKey := ca.Issue(t, "server", "127.0.0.1")
+	clientCert, clientKey := ca.Issue(t, "client")
+	strangerCert, strangerKey := other.Issue(t, "stranger")
+
+	server := newServer(t, Config{CertFile: serverCert, KeyFile: serverKey, CAFile: ca.CertFile})
+
+	tests := map[string]struct {
+		cfg     Config
+		wantErr bool
+	}{
+		"trusted client":   {cfg: Config{CertFile: clientCert, KeyFile: clientKey, CAFile: ca.CertFile}},
+		"no certificate":   {cfg: Config{CAFile: ca.CertFile}, wantErr: true},
+		"other CA's cert":  {cfg: Config{CertFile: strangerCert, KeyFile: strangerKey, CAFile: ca.CertFile}, wantErr: true},
+		"untrusted server": {cfg: Config{CertFile: clientCert, KeyFile: clientKey, CAFile: other.CertFile}, wantErr: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := get(t, server.URL, test.cfg)
+			if test.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestServerName(t *testing.T) {
+	ca := tlstest.NewCA(t)
+
+	tests := map[string]struct {
+		names   []string
+		wantErr bool
+	}{
+		"dialed IP":   {names: []string{"127.0.0.1"}},
+		"other IP":    {names: []string{"10.0.0.1"}, wantErr: true},
+		"other host":  {names: []string{"other.test"}, wantErr: true},
+		"no names":    {wantErr: true},
+		"one of many": {names: []string{"other.test", "127.0.0.1"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			certFile, keyFile := ca.Issue(t, "server", test.names...)
+			server := newServer(t, Config{CertFile: certFile, KeyFile: keyFile})
+			_, err := get(t, server.URL, Config{CAFile: ca.CertFile})
+			if test.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	certFile, keyFile := ca.Issue(t, "server", "127.0.0.1")
+	server := newServer(t, Config{CertFile: certFile, KeyFile: keyFile})
+	client := Config{CAFile: ca.CertFile}
+
+	first, err := get(t, server.URL, client)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+
+	ca.Issue(t, "server", "127.0.0.1")
+	// past the interval the files are checked again
+	server.files.lock.Lock()
+	server.files.checked = time.Time{}
+	server.files.lock.Unlock()
+	second, err := get(t, server.URL, client)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if first.SerialNumber.Cmp(second.SerialNumber) == 0 {
+		t.Fatalf("got the same certificate %s after the rotation", first.SerialNumber)
+	}
+}
+
+func TestSNI(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	defaultCert, defaultKey := ca.Issue(t, "default", "shop.test")
+	paymentsCert, paymentsKey := ca.Issue(t, "payments", "payments.test")
+	apiCert, apiKey := ca.Issue(t, "api", "*.api.test")
+	server := newServer(t, Config{
+		CertFile:     defaultCert,
+		KeyFile:      defaultKey,
+		Certificates: []KeyPair{{CertFile: paymentsCert, KeyFile: paymentsKey}, {CertFile: apiCert, KeyFile: apiKey}},
+	})
+
+	tests := map[string]struct {
+		serverName string
+		want       string
+	}{
+		"by name":     {serverName: "payments.test", want: "payments"},
+		"by wildcard": {serverName: "v2.api.test", want: "api"},
+		"other name":  {serverName: "other.test", want: "default"},
+		"no name":     {want: "default"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+				ServerName:         test.serverName,
+				InsecureSkipVerify: true,
+			})
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			defer conn.Close()
+			if got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; got != test.want {
+				t.Fatalf("got certificate %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	certFile, keyFile := ca.Issue(t, "server")
+
+	tests := map[string]struct {
+		cfg     Config
+		wantErr bool
+	}{
+		"certificate":       {cfg: Config{CertFile: certFile, KeyFile: keyFile}},
+		"CAs only":          {cfg: Config{CAFile: ca.CertFile}},
+		"no key":            {cfg: Config{CertFile: certFile}, wantErr: true},
+		"mismatched key":    {cfg: Config{CertFile: certFile, KeyFile: ca.CertFile}, wantErr: true},
+		"missing file":      {cfg: Config{CAFile: ca.CertFile + ".missing"}, wantErr: true},
+		"no CA in the file": {cfg: Config{CAFile: keyFile}, wantErr: true},
+		"by name":           {cfg: Config{CertFile: certFile, KeyFile: keyFile, Certificates: []KeyPair{{CertFile: certFile, KeyFile: keyFile}}}},
+		"no default":        {cfg: Config{Certificates: []KeyPair{{CertFile: certFile, KeyFile: keyFile}}}, wantErr: true},
+		"missing by name":   {cfg: Config{CertFile: certFile, KeyFile: keyFile, Certificates: []KeyPair{{CertFile: certFile}}}, wantErr: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Load(test.cfg)
+			if test.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+type testServer struct {
+	*httptest.Server
+	files *Files
+}
+
+func newServer(t *testing.T, cfg Config) *testServer {
+	files, err := Load(cfg)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	server.TLS = files.ServerConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return &testServer{Server: server, files: files}
+}
+
+// get calls rawURL with a client using cfg, and returns the certificate the server presented.
+func get(t *testing.T, rawURL string, cfg Config) (*x509.Certificate, error) {
+	files, err := Load(cfg)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: files.ClientConfig(u.Hostname())}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp.TLS.PeerCertificates[0], nil
+}
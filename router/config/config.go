@@ -0,0 +1,745 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mrbarrel/lib/env"
+	"mrbarrel/lib/logfile"
+	"mrbarrel/lib/logging"
+	"mrbarrel/lib/registration"
+	"mrbarrel/lib/tlsconfig"
+	"mrbarrel/router/handler"
+	"mrbarrel/router/pool"
+	"mrbarrel/router/pool/circuitbreaker"
+	"mrbarrel/router/pool/concurrency"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+var logger = logging.Logger(logging.Config)
+
+// Config holds all router settings, the config file overrides the env vars.
+// Listeners, Registry, AccessLog and Pool.HealthCheck need a restart to change.
+type Config struct {
+	Listeners      Listeners           `json:"listeners"`
+	Registry       Registry            `json:"registry"`
+	Pool           Pool                `json:"pool"`
+	RateLimiter    RateLimiter         `json:"rateLimiter"`
+	StaticBackends []pool.StaticClient `json:"staticBackends"`
+	Retry          Retry               `json:"retry"`
+	Hedge          Hedge               `json:"hedge"`
+	IngressLimit   IngressLimit        `json:"ingressLimit"`
+	Routes         []Route             `json:"routes"`
+	// Methods are the proxied methods, "*" stands for the others.
+	Methods   map[string]MethodPolicy `json:"methods"`
+	Log       Log                     `json:"log"`
+	AccessLog AccessLog               `json:"accessLog"`
+}
+
+type Listeners struct {
+	HTTP     string `json:"http"`
+	Registry string `json:"registry"`
+	// Admin isn't authenticated, it listens on loopback by default.
+	Admin string `json:"admin"`
+	// HTTPTLS and RegistryTLS serve the listeners over HTTPS, mutual TLS when they have CAs.
+	HTTPTLS     TLS `json:"httpTLS"`
+	RegistryTLS TLS `json:"registryTLS"`
+	// HTTPRedirect redirects plain HTTP requests to the https one, it needs httpTLS.
+	HTTPRedirect string `json:"httpRedirect"`
+}
+
+func (l Listeners) equal(other Listeners) bool {
+	return l.HTTP == other.HTTP && l.Registry == other.Registry && l.Admin == other.Admin &&
+		l.HTTPRedirect == other.HTTPRedirect && l.HTTPTLS.config().Equal(other.HTTPTLS.config()) &&
+		l.RegistryTLS.config().Equal(other.RegistryTLS.config())
+}
+
+// Log sets the levels per component, like "info,pool=debug".
+type Log struct {
+	Levels string `json:"levels"`
+}
+
+// AccessLog goes to stdout, or to path where it's rotated after maxSize bytes. It's off without a format.
+type AccessLog struct {
+	Format     string `json:"format"`
+	Path       string `json:"path"`
+	MaxSize    int64  `json:"maxSize"`
+	MaxBackups int    `json:"maxBackups"`
+}
+
+// TLS points to PEM files, they are reloaded when they change.
+type TLS struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	CAFile   string `json:"caFile"`
+	// Certificates are served by name (SNI), certFile to the clients that ask for another one.
+	Certificates []KeyPair `json:"certificates"`
+}
+
+type KeyPair struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+type Registry struct {
+	// AllowedBackends are CIDRs and domains, see handler.RegistryHandlerConfig.
+	AllowedBackends []string `json:"allowedBackends"`
+	// Secret signs the registrations, they aren't checked when empty.
+	Secret       string   `json:"secret"`
+	MaxClockSkew Duration `json:"maxClockSkew"`
+}
+
+func (r Registry) equal(other Registry) bool {
+	return slices.Equal(r.AllowedBackends, other.AllowedBackends) && r.Secret == other.Secret &&
+		r.MaxClockSkew == other.MaxClockSkew
+}
+
+type Pool struct {
+	MaxClientNoNotif Duration    `json:"maxClientNoNotif"`
+	Balancer         string      `json:"balancer"`
+	HashKey          string      `json:"hashKey"`
+	HashHeader       string      `json:"hashHeader"`
+	HashBodyField    string      `json:"hashBodyField"`
+	Breaker          Breaker     `json:"breaker"`
+	Concurrency      Concurrency `json:"concurrency"`
+	Affinity         Affinity    `json:"affinity"`
+	Timeouts         Timeouts    `json:"timeouts"`
+	Transport        Transport   `json:"transport"`
+	// HealthCheck isn't reloaded, it needs a restart.
+	HealthCheck HealthCheck `json:"healthCheck"`
+	// TLS is used to call the backends that registered an https:// address.
+	TLS TLS `json:"tls"`
+}
+
+type HealthCheck struct {
+	Path               string   `json:"path"`
+	Interval           Duration `json:"interval"`
+	Timeout            Duration `json:"timeout"`
+	UnhealthyThreshold int      `json:"unhealthyThreshold"`
+	HealthyThreshold   int      `json:"healthyThreshold"`
+}
+
+// Breaker is off by default, consecutiveFailures or errorRate turn it on.
+type Breaker struct {
+	ConsecutiveFailures int      `json:"consecutiveFailures"`
+	ErrorRate           float64  `json:"errorRate"`
+	MinRequests         int      `json:"minRequests"`
+	OpenDuration        Duration `json:"openDuration"`
+	HalfOpenProbes      int      `json:"halfOpenProbes"`
+}
+
+// Concurrency is off without an algorithm, see concurrency.Config.
+type Concurrency struct {
+	Algorithm        string   `json:"algorithm"`
+	InitialLimit     int      `json:"initialLimit"`
+	MinLimit         int      `json:"minLimit"`
+	MaxLimit         int      `json:"maxLimit"`
+	LatencyThreshold Duration `json:"latencyThreshold"`
+	BackoffRatio     float64  `json:"backoffRatio"`
+	Tolerance        float64  `json:"tolerance"`
+	Smoothing        float64  `json:"smoothing"`
+}
+
+type Affinity struct {
+	Mode         string   `json:"mode"`
+	CookieName   string   `json:"cookieName"`
+	CookieMaxAge Duration `json:"cookieMaxAge"`
+	Header       string   `json:"header"`
+}
+
+// Timeouts bound the calls to the backends, "0s" disables one.
+type Timeouts struct {
+	Connect        Duration `json:"connect"`
+	ResponseHeader Duration `json:"responseHeader"`
+	Total          Duration `json:"total"`
+}
+
+// Transport tunes the connections to the backends, the dial timeout is timeouts.connect.
+type Transport struct {
+	MaxIdleConnsPerHost int      `json:"maxIdleConnsPerHost"`
+	MaxConnsPerHost     int      `json:"maxConnsPerHost"`
+	IdleConnTimeout     Duration `json:"idleConnTimeout"`
+	KeepAlive           Duration `json:"keepAlive"`
+	HTTP2               bool     `json:"http2"`
+}
+
+type RateLimiter struct {
+	SlowThreshold Duration `json:"slowThreshold"`
+}
+
+// Retry is off by default, maxRetries turns it on.
+type Retry struct {
+	MaxRetries         int     `json:"maxRetries"`
+	MaxBodySize        int64   `json:"maxBodySize"`
+	Statuses           []int   `json:"statuses"`
+	BudgetRatio        float64 `json:"budgetRatio"`
+	BudgetMinPerSecond float64 `json:"budgetMinPerSecond"`
+}
+
+// Hedge applies to the methods that have hedged set, see handler.HedgeConfig.
+type Hedge struct {
+	Percentile float64  `json:"percentile"`
+	MinDelay   Duration `json:"minDelay"`
+}
+
+// IngressLimit is a handler.IngressLimitConfig.
+type IngressLimit struct {
+	Rate        float64 `json:"rate"`
+	Burst       int     `json:"burst"`
+	Key         string  `json:"key"`
+	Header      string  `json:"header"`
+	GlobalRate  float64 `json:"globalRate"`
+	GlobalBurst int     `json:"globalBurst"`
+}
+
+// Route sends the requests matching all of its set conditions to Pool, see handler.Route.
+type Route struct {
+	Pool       string            `json:"pool"`
+	Host       string            `json:"host"`
+	PathPrefix string            `json:"pathPrefix"`
+	Method     string            `json:"method"`
+	Headers    map[string]string `json:"headers"`
+	// IngressLimit replaces the top level one, the env vars don't apply.
+	IngressLimit *IngressLimit `json:"ingressLimit"`
+}
+
+// MethodPolicy is a handler.MethodPolicy.
+type MethodPolicy struct {
+	Retryable     bool `json:"retryable"`
+	DialRetryOnly bool `json:"dialRetryOnly"`
+	Hedged        bool `json:"hedged"`
+}
+
+// Duration is a time.Duration that reads and writes as a string like "1.5s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1.5s\": %w", err)
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dur)
+	return nil
+}
+
+// FromEnv returns the config set by the env vars, with defaults.
+func FromEnv() (*Config, error) {
+	staticBackends, err := pool.ParseStaticClients(strings.NewReader(env.MustGetStringOrDefault("STATIC_BACKENDS", "")))
+	if err != nil {
+		return nil, fmt.Errorf("while reading STATIC_BACKENDS: %w", err)
+	}
+	if file := env.MustGetStringOrDefault("STATIC_BACKENDS_FILE", ""); file != "" {
+		fromFile, err := readStaticClients(file)
+		if err != nil {
+			return nil, fmt.Errorf("while reading STATIC_BACKENDS_FILE: %w", err)
+		}
+		staticBackends = append(staticBackends, fromFile...)
+	}
+
+	httpTLS, err := tlsFromEnv("HTTP_TLS")
+	if err != nil {
+		return nil, err
+	}
+	registryTLS, err := tlsFromEnv("REGISTRY_TLS")
+	if err != nil {
+		return nil, err
+	}
+	backendTLS, err := tlsFromEnv("BACKEND_TLS")
+	if err != nil {
+		return nil, err
+	}
+
+	transport := pool.DefaultTransportConfig()
+	return &Config{
+		Listeners: Listeners{
+			HTTP:         env.MustGetStringOrDefault("HTTP_ADDR", ":8081"),
+			Registry:     env.MustGetStringOrDefault("REGISTRY_ADDR", ":8081"),
+			Admin:        env.MustGetStringOrDefault("ADMIN_ADDR", "127.0.0.1:8082"),
+			HTTPTLS:      httpTLS,
+			RegistryTLS:  registryTLS,
+			HTTPRedirect: env.MustGetStringOrDefault("HTTP_REDIRECT_ADDR", ""),
+		},
+		Registry: Registry{
+			AllowedBackends: env.MustGetStringListOrDefault("REGISTRY_ALLOWED_BACKENDS", nil),
+			Secret:          env.MustGetStringOrDefault("REGISTRY_SECRET", ""),
+			MaxClockSkew:    Duration(env.MustGetDurationOrDefault("REGISTRY_MAX_CLOCK_SKEW", registration.DefaultMaxSkew)),
+		},
+		Pool: Pool{
+			MaxClientNoNotif: Duration(env.MustGetDurationOrDefault("MAX_CLIENT_NO_NOTIF", time.Second*2)),
+			Balancer:         env.MustGetStringOrDefault("BALANCER", pool.BalancerWeightedRoundRobin),
+			HashKey:          env.MustGetStringOrDefault("HASH_KEY", ""),
+			HashHeader:       env.MustGetStringOrDefault("HASH_HEADER", ""),
+			HashBodyField:    env.MustGetStringOrDefault("HASH_BODY_FIELD", ""),
+			HealthCheck: HealthCheck{
+				Path:               env.MustGetStringOrDefault("HEALTH_CHECK_PATH", ""),
+				Interval:           Duration(env.MustGetDurationOrDefault("HEALTH_CHECK_INTERVAL", time.Second*5)),
+				Timeout:            Duration(env.MustGetDurationOrDefault("HEALTH_CHECK_TIMEOUT", time.Second)),
+				UnhealthyThreshold: int(env.MustGetIntOrDefault("HEALTH_CHECK_UNHEALTHY_THRESHOLD", 3)),
+				HealthyThreshold:   int(env.MustGetIntOrDefault("HEALTH_CHECK_HEALTHY_THRESHOLD", 2)),
+			},
+			Breaker: Breaker{
+				ConsecutiveFailures: int(env.MustGetIntOrDefault("BREAKER_CONSECUTIVE_FAILURES", 0)),
+				ErrorRate:           env.MustGetFloatOrDefault("BREAKER_ERROR_RATE", 0),
+				MinRequests:         int(env.MustGetIntOrDefault("BREAKER_MIN_REQUESTS", 20)),
+				OpenDuration:        Duration(env.MustGetDurationOrDefault("BREAKER_OPEN_DURATION", time.Second*10)),
+				HalfOpenProbes:      int(env.MustGetIntOrDefault("BREAKER_HALF_OPEN_PROBES", 3)),
+			},
+			Concurrency: Concurrency{
+				Algorithm:        env.MustGetStringOrDefault("CONCURRENCY_ALGORITHM", ""),
+				InitialLimit:     int(env.MustGetIntOrDefault("CONCURRENCY_INITIAL_LIMIT", 20)),
+				MinLimit:         int(env.MustGetIntOrDefault("CONCURRENCY_MIN_LIMIT", 1)),
+				MaxLimit:         int(env.MustGetIntOrDefault("CONCURRENCY_MAX_LIMIT", 1000)),
+				LatencyThreshold: Duration(env.MustGetDurationOrDefault("CONCURRENCY_LATENCY_THRESHOLD", time.Second)),
+				BackoffRatio:     env.MustGetFloatOrDefault("CONCURRENCY_BACKOFF_RATIO", 0.9),
+				Tolerance:        env.MustGetFloatOrDefault("CONCURRENCY_TOLERANCE", 1.5),
+				Smoothing:        env.MustGetFloatOrDefault("CONCURRENCY_SMOOTHING", 0.2),
+			},
+			Affinity: Affinity{
+				Mode:         env.MustGetStringOrDefault("AFFINITY", pool.AffinityNone),
+				CookieName:   env.MustGetStringOrDefault("AFFINITY_COOKIE", ""),
+				CookieMaxAge: Duration(env.MustGetDurationOrDefault("AFFINITY_COOKIE_MAX_AGE", 0)),
+				Header:       env.MustGetStringOrDefault("AFFINITY_HEADER", "X-User-Id"),
+			},
+			Timeouts: Timeouts{
+				Connect:        Duration(env.MustGetDurationOrDefault("CONNECT_TIMEOUT", time.Second*5)),
+				ResponseHeader: Duration(env.MustGetDurationOrDefault("RESPONSE_HEADER_TIMEOUT", time.Second*30)),
+				Total:          Duration(env.MustGetDurationOrDefault("REQUEST_TIMEOUT", 0)),
+			},
+			Transport: Transport{
+				MaxIdleConnsPerHost: int(env.MustGetIntOrDefault("TRANSPORT_MAX_IDLE_CONNS_PER_HOST", int64(transport.MaxIdleConnsPerHost))),
+				MaxConnsPerHost:     int(env.MustGetIntOrDefault("TRANSPORT_MAX_CONNS_PER_HOST", int64(transport.MaxConnsPerHost))),
+				IdleConnTimeout:     Duration(env.MustGetDurationOrDefault("TRANSPORT_IDLE_CONN_TIMEOUT", transport.IdleConnTimeout)),
+				KeepAlive:           Duration(env.MustGetDurationOrDefault("TRANSPORT_KEEP_ALIVE", transport.KeepAlive)),
+				HTTP2:               env.MustGetBoolOrDefault("TRANSPORT_HTTP2", transport.HTTP2),
+			},
+			TLS: backendTLS,
+		},
+		RateLimiter: RateLimiter{
+			SlowThreshold: Duration(env.MustGetDurationOrDefault("SLOW_THRESHOLD", time.Millisecond*200)),
+		},
+		StaticBackends: staticBackends,
+		Retry: Retry{
+			MaxRetries:         int(env.MustGetIntOrDefault("RETRY_MAX_RETRIES", 0)),
+			MaxBodySize:        env.MustGetIntOrDefault("RETRY_MAX_BODY_SIZE", 64*1024),
+			Statuses:           env.MustGetIntListOrDefault("RETRY_STATUSES", []int{http.StatusServiceUnavailable}),
+			BudgetRatio:        env.MustGetFloatOrDefault("RETRY_BUDGET_RATIO", 0.2),
+			BudgetMinPerSecond: env.MustGetFloatOrDefault("RETRY_BUDGET_MIN_PER_SECOND", 10),
+		},
+		Hedge: Hedge{
+			Percentile: env.MustGetFloatOrDefault("HEDGE_PERCENTILE", 0.95),
+			MinDelay:   Duration(env.MustGetDurationOrDefault("HEDGE_MIN_DELAY", time.Millisecond*10)),
+		},
+		IngressLimit: IngressLimit{
+			Rate:        env.MustGetFloatOrDefault("INGRESS_RATE", 0),
+			Burst:       int(env.MustGetIntOrDefault("INGRESS_BURST", 0)),
+			Key:         env.MustGetStringOrDefault("INGRESS_KEY", handler.IngressKeyClientIP),
+			Header:      env.MustGetStringOrDefault("INGRESS_HEADER", ""),
+			GlobalRate:  env.MustGetFloatOrDefault("INGRESS_GLOBAL_RATE", 0),
+			GlobalBurst: int(env.MustGetIntOrDefault("INGRESS_GLOBAL_BURST", 0)),
+		},
+		Methods: methodPolicies(
+			env.MustGetStringListOrDefault("PROXY_METHODS", []string{handler.AnyMethod}),
+			env.MustGetStringListOrDefault("RETRY_METHODS", retryableMethods(handler.DefaultMethodPolicies())),
+			env.MustGetStringListOrDefault("RETRY_DIAL_ONLY_METHODS", dialRetryOnlyMethods(handler.DefaultMethodPolicies())),
+			env.MustGetStringListOrDefault("HEDGE_METHODS", nil),
+		),
+		Log: Log{Levels: env.MustGetStringOrDefault("LOG_LEVEL", "info")},
+		AccessLog: AccessLog{
+			Format:     env.MustGetStringOrDefault("ACCESS_LOG_FORMAT", ""),
+			Path:       env.MustGetStringOrDefault("ACCESS_LOG_PATH", ""),
+			MaxSize:    env.MustGetIntOrDefault("ACCESS_LOG_MAX_SIZE", 100*1024*1024),
+			MaxBackups: int(env.MustGetIntOrDefault("ACCESS_LOG_MAX_BACKUPS", 5)),
+		},
+	}, nil
+}
+
+// tlsFromEnv reads prefix_CERT_FILE, prefix_KEY_FILE, prefix_CA_FILE and prefix_CERTIFICATES (cert.pem:key.pem).
+func tlsFromEnv(prefix string) (TLS, error) {
+	t := TLS{
+		CertFile: env.MustGetStringOrDefault(prefix+"_CERT_FILE", ""),
+		KeyFile:  env.MustGetStringOrDefault(prefix+"_KEY_FILE", ""),
+		CAFile:   env.MustGetStringOrDefault(prefix+"_CA_FILE", ""),
+	}
+	for _, pair := range env.MustGetStringListOrDefault(prefix+"_CERTIFICATES", nil) {
+		certFile, keyFile, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return TLS{}, fmt.Errorf("while reading %s_CERTIFICATES: %q isn't a cert.pem:key.pem", prefix, pair)
+		}
+		t.Certificates = append(t.Certificates, KeyPair{CertFile: certFile, KeyFile: keyFile})
+	}
+	return t, nil
+}
+
+// Load returns the config from the env vars and the file at path, unknown fields are an error.
+func Load(path string) (*Config, error) {
+	cfg, err := FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return cfg, cfg.Validate()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// the static backends and methods in the file replace the env ones
+	envStaticBackends, envMethods := cfg.StaticBackends, cfg.Methods
+	cfg.StaticBackends, cfg.Methods = nil, nil
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("while decoding %s: %w", path, err)
+	}
+	if cfg.StaticBackends == nil {
+		cfg.StaticBackends = envStaticBackends
+	}
+	if cfg.Methods == nil {
+		cfg.Methods = envMethods
+	}
+	for i := range cfg.StaticBackends {
+		if cfg.StaticBackends[i].Weight == 0 {
+			cfg.StaticBackends[i].Weight = 1
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+// methodPolicies builds the policies of the proxied methods out of the lists of the env vars.
+func methodPolicies(proxied, retryable, dialOnly, hedged []string) map[string]MethodPolicy {
+	res := map[string]MethodPolicy{}
+	for _, m := range proxied {
+		res[m] = MethodPolicy{}
+	}
+	_, all := res[handler.AnyMethod]
+	for _, m := range retryable {
+		if _, ok := res[m]; ok || all {
+			res[m] = MethodPolicy{Retryable: true}
+		}
+	}
+	for _, m := range dialOnly {
+		if res[m].Retryable {
+			res[m] = MethodPolicy{Retryable: true, DialRetryOnly: true}
+		}
+	}
+	for _, m := range hedged {
+		if res[m].Retryable && !res[m].DialRetryOnly {
+			res[m] = MethodPolicy{Retryable: true, Hedged: true}
+		}
+	}
+	return res
+}
+
+func retryableMethods(policies map[string]handler.MethodPolicy) []string {
+	var res []string
+	for m, p := range policies {
+		if p.Retryable {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+func dialRetryOnlyMethods(policies map[string]handler.MethodPolicy) []string {
+	var res []string
+	for m, p := range policies {
+		if p.DialRetryOnly {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+func readStaticClients(file string) ([]pool.StaticClient, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return pool.ParseStaticClients(f)
+}
+
+// Validate checks the values that would otherwise only blow up, or silently misbehave, once in use.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Listeners.HTTP == "" || c.Listeners.Registry == "" || c.Listeners.Admin == "" {
+		errs = append(errs, errors.New("listeners: http, registry and admin are required"))
+	}
+	if err := c.Listeners.HTTPTLS.config().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("listeners.httpTLS: %w", err))
+	}
+	if err := c.Listeners.RegistryTLS.config().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("listeners.registryTLS: %w", err))
+	}
+	if c.Listeners.HTTPRedirect != "" && c.Listeners.HTTPTLS.CertFile == "" {
+		errs = append(errs, errors.New("listeners.httpRedirect needs httpTLS"))
+	}
+	if err := c.RegistryConfig().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("registry.allowedBackends: %w", err))
+	}
+	if c.Registry.MaxClockSkew < 0 {
+		errs = append(errs, errors.New("registry.maxClockSkew can't be negative"))
+	}
+	if c.Pool.MaxClientNoNotif <= 0 {
+		errs = append(errs, errors.New("pool.maxClientNoNotif must be positive"))
+	}
+	if err := c.PoolConfig().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("pool: %w", err))
+	}
+	if hc := c.Pool.HealthCheck; hc.Path != "" && (hc.Interval <= 0 || hc.Timeout <= 0) {
+		errs = append(errs, errors.New("pool.healthCheck: interval and timeout must be positive"))
+	}
+	if c.Pool.Breaker.ErrorRate < 0 || c.Pool.Breaker.ErrorRate > 1 {
+		errs = append(errs, errors.New("pool.breaker.errorRate must be between 0 and 1"))
+	}
+	if to := c.Pool.Timeouts; to.Connect < 0 || to.ResponseHeader < 0 || to.Total < 0 {
+		errs = append(errs, errors.New("pool.timeouts can't be negative"))
+	}
+	if c.Pool.Transport.MaxConnsPerHost < 0 || c.Pool.Transport.IdleConnTimeout < 0 {
+		errs = append(errs, errors.New("pool.transport: maxConnsPerHost and idleConnTimeout can't be negative"))
+	}
+	if c.RateLimiter.SlowThreshold <= 0 {
+		errs = append(errs, errors.New("rateLimiter.slowThreshold must be positive"))
+	}
+	for i, s := range c.StaticBackends {
+		if s.Addr == "" || s.Weight <= 0 {
+			errs = append(errs, fmt.Errorf("staticBackends[%d]: addr is required and weight must be positive", i))
+		}
+	}
+	if c.Retry.MaxRetries < 0 || c.Retry.MaxBodySize < 0 {
+		errs = append(errs, errors.New("retry: maxRetries and maxBodySize can't be negative"))
+	}
+	for _, status := range c.Retry.Statuses {
+		if status < 100 || status > 599 {
+			errs = append(errs, fmt.Errorf("retry.statuses: %d is not a status code", status))
+		}
+	}
+	if len(c.Methods) == 0 {
+		errs = append(errs, errors.New("methods: at least one method must be proxied"))
+	}
+	for m, p := range c.Methods {
+		if m != strings.ToUpper(m) || strings.TrimSpace(m) != m || m == "" {
+			errs = append(errs, fmt.Errorf("methods: %q must be upper case, or *", m))
+		}
+		if p.Hedged && !p.Retryable {
+			errs = append(errs, fmt.Errorf("methods: %s can only be hedged when it's retryable", m))
+		}
+		if p.Hedged && p.DialRetryOnly {
+			errs = append(errs, fmt.Errorf("methods: %s can't be hedged when it's only retried on dial errors", m))
+		}
+	}
+	if c.Hedge.Percentile < 0 || c.Hedge.Percentile >= 1 || c.Hedge.MinDelay < 0 {
+		errs = append(errs, errors.New("hedge: percentile must be between 0 and 1, minDelay can't be negative"))
+	}
+	if err := c.IngressLimit.config().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("ingressLimit: %w", err))
+	}
+	for i, r := range c.Routes {
+		if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+			errs = append(errs, fmt.Errorf("routes[%d].pathPrefix must start with /", i))
+		}
+		if r.IngressLimit != nil {
+			if err := r.IngressLimit.config().Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("routes[%d].ingressLimit: %w", i, err))
+			}
+		}
+		if r.Method != "" && r.Method != strings.ToUpper(r.Method) {
+			errs = append(errs, fmt.Errorf("routes[%d].method must be upper case", i))
+		}
+	}
+	if _, err := c.LogLevels(); err != nil {
+		errs = append(errs, fmt.Errorf("log.levels: %w", err))
+	}
+	if err := (handler.AccessLogConfig{Format: c.AccessLog.Format}).Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("accessLog.format: %w", err))
+	}
+	if c.AccessLog.MaxSize < 0 || c.AccessLog.MaxBackups < 0 {
+		errs = append(errs, errors.New("accessLog: maxSize and maxBackups can't be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// LogLevels returns the levels for logging.Setup and logging.SetLevels.
+func (c *Config) LogLevels() (logging.Levels, error) {
+	return logging.ParseLevels(c.Log.Levels)
+}
+
+// OpenAccessLog returns where the access log goes, nil when it's off.
+func (c *Config) OpenAccessLog() (io.WriteCloser, error) {
+	switch {
+	case c.AccessLog.Format == "":
+		return nil, nil
+	case c.AccessLog.Path == "":
+		return nopCloser{os.Stdout}, nil
+	}
+	return logfile.Open(logfile.Config{Path: c.AccessLog.Path, MaxSize: c.AccessLog.MaxSize, MaxBackups: c.AccessLog.MaxBackups})
+}
+
+// nopCloser keeps stdout open when the access log is closed.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// PoolNames returns the pools the routes and static backends use, for pool.Group.SetPools.
+func (c *Config) PoolNames() []string {
+	var res []string
+	for _, r := range c.Routes {
+		res = append(res, r.Pool)
+	}
+	for _, s := range c.StaticBackends {
+		res = append(res, s.Pool)
+	}
+	return res
+}
+
+// RegistryConfig returns the settings for handler.NewRegistryHandler.
+func (c *Config) RegistryConfig() *handler.RegistryHandlerConfig {
+	return &handler.RegistryHandlerConfig{
+		ListenAddr:      c.Listeners.Registry,
+		AllowedBackends: c.Registry.AllowedBackends,
+		Secret:          c.Registry.Secret,
+		MaxClockSkew:    time.Duration(c.Registry.MaxClockSkew),
+		TLS:             c.Listeners.RegistryTLS.config(),
+	}
+}
+
+// PoolConfig returns the settings for pool.NewGroup and Group.Reconfigure.
+func (c *Config) PoolConfig() *pool.PoolConfig {
+	hc, b, cc, a := c.Pool.HealthCheck, c.Pool.Breaker, c.Pool.Concurrency, c.Pool.Affinity
+	to, tr := c.Pool.Timeouts, c.Pool.Transport
+	return &pool.PoolConfig{
+		MaxAgeNoNotif: time.Duration(c.Pool.MaxClientNoNotif),
+		SlowThreshold: time.Duration(c.RateLimiter.SlowThreshold),
+		Balancer: &pool.BalancerConfig{
+			Strategy:      c.Pool.Balancer,
+			HashKey:       c.Pool.HashKey,
+			HashHeader:    c.Pool.HashHeader,
+			HashBodyField: c.Pool.HashBodyField,
+		},
+		HealthCheck: &pool.HealthCheckConfig{
+			Path:               hc.Path,
+			Interval:           time.Duration(hc.Interval),
+			Timeout:            time.Duration(hc.Timeout),
+			UnhealthyThreshold: hc.UnhealthyThreshold,
+			HealthyThreshold:   hc.HealthyThreshold,
+		},
+		Breaker: circuitbreaker.Config{
+			ConsecutiveFailures: b.ConsecutiveFailures,
+			ErrorRate:           b.ErrorRate,
+			MinRequests:         b.MinRequests,
+			OpenDuration:        time.Duration(b.OpenDuration),
+			HalfOpenProbes:      b.HalfOpenProbes,
+		},
+		Concurrency: concurrency.Config{
+			Algorithm:        cc.Algorithm,
+			InitialLimit:     cc.InitialLimit,
+			MinLimit:         cc.MinLimit,
+			MaxLimit:         cc.MaxLimit,
+			LatencyThreshold: time.Duration(cc.LatencyThreshold),
+			BackoffRatio:     cc.BackoffRatio,
+			Tolerance:        cc.Tolerance,
+			Smoothing:        cc.Smoothing,
+		},
+		Affinity: &pool.AffinityConfig{
+			Mode:         a.Mode,
+			CookieName:   a.CookieName,
+			CookieMaxAge: time.Duration(a.CookieMaxAge),
+			Header:       a.Header,
+		},
+		Timeouts: pool.TimeoutConfig{
+			Connect:        time.Duration(to.Connect),
+			ResponseHeader: time.Duration(to.ResponseHeader),
+			Total:          time.Duration(to.Total),
+		},
+		Transport: &pool.TransportConfig{
+			MaxIdleConnsPerHost: tr.MaxIdleConnsPerHost,
+			MaxConnsPerHost:     tr.MaxConnsPerHost,
+			IdleConnTimeout:     time.Duration(tr.IdleConnTimeout),
+			KeepAlive:           time.Duration(tr.KeepAlive),
+			HTTP2:               tr.HTTP2,
+		},
+		TLS: c.Pool.TLS.config(),
+	}
+}
+
+// RouterConfig returns the settings of handler.NewRouter, without the metrics.
+func (c *Config) RouterConfig() *handler.RouterConfig {
+	routes := make([]handler.Route, 0, len(c.Routes))
+	for _, r := range c.Routes {
+		route := handler.Route{
+			Pool:       r.Pool,
+			Host:       r.Host,
+			PathPrefix: r.PathPrefix,
+			Method:     r.Method,
+			Headers:    r.Headers,
+		}
+		if r.IngressLimit != nil {
+			limit := r.IngressLimit.config()
+			route.IngressLimit = &limit
+		}
+		routes = append(routes, route)
+	}
+	methods := make(map[string]handler.MethodPolicy, len(c.Methods))
+	for m, p := range c.Methods {
+		methods[m] = handler.MethodPolicy{Retryable: p.Retryable, DialRetryOnly: p.DialRetryOnly, Hedged: p.Hedged}
+	}
+	return &handler.RouterConfig{
+		Addr:         c.Listeners.HTTP,
+		TLS:          c.Listeners.HTTPTLS.config(),
+		RedirectAddr: c.Listeners.HTTPRedirect,
+		Retry: handler.RetryConfig{
+			MaxRetries:         c.Retry.MaxRetries,
+			MaxBodySize:        c.Retry.MaxBodySize,
+			Statuses:           c.Retry.Statuses,
+			BudgetRatio:        c.Retry.BudgetRatio,
+			BudgetMinPerSecond: c.Retry.BudgetMinPerSecond,
+		},
+		Hedge: handler.HedgeConfig{
+			Percentile: c.Hedge.Percentile,
+			MinDelay:   time.Duration(c.Hedge.MinDelay),
+		},
+		IngressLimit: c.IngressLimit.config(),
+		Routes:       routes,
+		Methods:      methods,
+		AccessLog:    handler.AccessLogConfig{Format: c.AccessLog.Format},
+	}
+}
+
+func (t TLS) config() tlsconfig.Config {
+	cfg := tlsconfig.Config{CertFile: t.CertFile, KeyFile: t.KeyFile, CAFile: t.CAFile}
+	for _, pair := range t.Certificates {
+		cfg.Certificates = append(cfg.Certificates, tlsconfig.KeyPair{CertFile: pair.CertFile, KeyFile: pair.KeyFile})
+	}
+	return cfg
+}
+
+func (l *IngressLimit) config() handler.IngressLimitConfig {
+	return handler.IngressLimitConfig{
+		Rate:        l.Rate,
+		Burst:       l.Burst,
+		Key:         l.Key,
+		Header:      l.Header,
+		GlobalRate:  l.GlobalRate,
+		GlobalBurst: l.GlobalBurst,
+	}
+}
@@ -0,0 +1,413 @@
+package config
+
+import (
+	"log/slog"
+	"mrbarrel/lib/logfile"
+	"mrbarrel/lib/logging"
+	"mrbarrel/lib/tlsconfig"
+	"mrbarrel/router/handler"
+	"mrbarrel/router/pool"
+	"mrbarrel/router/pool/concurrency"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "router.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("while writing config: %v", err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	tests := map[string]struct {
+		content string
+		check   func(t *testing.T, cfg *Config)
+		wantErr string
+	}{
+		"empty object keeps the env defaults": {
+			content: `{}`,
+			check: func(t *testing.T, cfg *Config) {
+				want, _ := FromEnv()
+				if !reflect.DeepEqual(cfg, want) {
+					t.Fatalf("got %+v want %+v", cfg, want)
+				}
+			},
+		},
+		"breaker off by default": {
+			content: `{}`,
+			check: func(t *testing.T, cfg *Config) {
+				if b := cfg.Pool.Breaker; b.ConsecutiveFailures != 0 || b.ErrorRate != 0 {
+					t.Fatalf("got breaker %+v, want no thresholds", b)
+				}
+			},
+		},
+		"no retries by default": {
+			content: `{}`,
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Retry.MaxRetries != 0 {
+					t.Fatalf("got %d retries want 0", cfg.Retry.MaxRetries)
+				}
+			},
+		},
+		"overrides only what is set": {
+			content: `{
+				"pool": {"balancer": "least_outstanding", "breaker": {"openDuration": "30s"}},
+				"rateLimiter": {"slowThreshold": "150ms"},
+				"staticBackends": [{"addr": "legacy:8080", "weight": 3}, {"addr": "older:8080"}],
+				"retry": {"statuses": [502, 503]}
+			}`,
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Pool.Balancer != pool.BalancerLeastOutstanding {
+					t.Errorf("got balancer %s", cfg.Pool.Balancer)
+				}
+				if cfg.Pool.Breaker.OpenDuration != Duration(30*time.Second) || cfg.Pool.Breaker.MinRequests != 20 {
+					t.Errorf("got breaker %+v", cfg.Pool.Breaker)
+				}
+				if cfg.RateLimiter.SlowThreshold != Duration(150*time.Millisecond) {
+					t.Errorf("got slow threshold %v", time.Duration(cfg.RateLimiter.SlowThreshold))
+				}
+				wantStatic := []pool.StaticClient{{Addr: "legacy:8080", Weight: 3}, {Addr: "older:8080", Weight: 1}}
+				if !reflect.DeepEqual(cfg.StaticBackends, wantStatic) {
+					t.Errorf("got static backends %v want %v", cfg.StaticBackends, wantStatic)
+				}
+				if !reflect.DeepEqual(cfg.Retry.Statuses, []int{502, 503}) || cfg.Retry.MaxBodySize != 64*1024 {
+					t.Errorf("got retry %+v", cfg.Retry)
+				}
+			},
+		},
+		"invalid json": {
+			content: `{"pool": `,
+			wantErr: "while decoding",
+		},
+		"unknown field": {
+			content: `{"pool": {"balancr": "round_robin"}}`,
+			wantErr: "unknown field",
+		},
+		"invalid duration": {
+			content: `{"pool": {"maxClientNoNotif": 2}}`,
+			wantErr: "duration",
+		},
+		"unknown balancer": {
+			content: `{"pool": {"balancer": "random"}}`,
+			wantErr: "unknown balancer strategy",
+		},
+		"affinity": {
+			content: `{"pool": {"affinity": {"mode": "cookie", "cookieMaxAge": "1h"}}}`,
+			check: func(t *testing.T, cfg *Config) {
+				affinity := cfg.PoolConfig().Affinity
+				if affinity.Mode != pool.AffinityCookie || affinity.CookieMaxAge != time.Hour || affinity.Header != "X-User-Id" {
+					t.Fatalf("got affinity %+v", affinity)
+				}
+			},
+		},
+		"unknown affinity": {
+			content: `{"pool": {"affinity": {"mode": "ip"}}}`,
+			wantErr: "unknown affinity mode",
+		},
+		"hash key": {
+			content: `{"pool": {"balancer": "consistent_hash", "hashKey": "body_field"}}`,
+			wantErr: "needs a body field",
+		},
+		"timeouts": {
+			content: `{"pool": {"timeouts": {"responseHeader": "10s", "total": "1m"}}}`,
+			check: func(t *testing.T, cfg *Config) {
+				want := pool.TimeoutConfig{Connect: 5 * time.Second, ResponseHeader: 10 * time.Second, Total: time.Minute}
+				if got := cfg.PoolConfig().Timeouts; got != want {
+					t.Fatalf("got timeouts %+v want %+v", got, want)
+				}
+			},
+		},
+		"transport": {
+			content: `{"pool": {"transport": {"maxIdleConnsPerHost": 512, "http2": false}}}`,
+			check: func(t *testing.T, cfg *Config) {
+				want := pool.DefaultTransportConfig()
+				want.MaxIdleConnsPerHost, want.HTTP2 = 512, false
+				if got := *cfg.PoolConfig().Transport; got != want {
+					t.Fatalf("got transport %+v want %+v", got, want)
+				}
+			},
+		},
+		"concurrency": {
+			content: `{"pool": {"concurrency": {"algorithm": "gradient", "maxLimit": 200}}}`,
+			check: func(t *testing.T, cfg *Config) {
+				cc := cfg.PoolConfig().Concurrency
+				if cc.Algorithm != concurrency.Gradient || cc.MaxLimit != 200 || cc.InitialLimit != 20 || cc.Tolerance != 1.5 {
+					t.Fatalf("got concurrency %+v", cc)
+				}
+			},
+		},
+		"unknown concurrency algorithm": {
+			content: `{"pool": {"concurrency": {"algorithm": "vegas"}}}`,
+			wantErr: "unknown concurrency limit algorithm",
+		},
+		"negative timeout": {
+			content: `{"pool": {"timeouts": {"connect": "-1s"}}}`,
+			wantErr: "pool.timeouts",
+		},
+		"routes": {
+			content: `{"routes": [{"pool": "payments", "host": "pay.example.com", "headers": {"X-Tenant": "eu"}}, {"pool": "shop", "pathPrefix": "/shop"}]}`,
+			check: func(t *testing.T, cfg *Config) {
+				routes := cfg.RouterConfig().Routes
+				if len(routes) != 2 || routes[0].Pool != "payments" || routes[0].Headers["X-Tenant"] != "eu" || routes[1].PathPrefix != "/shop" {
+					t.Fatalf("got routes %+v", routes)
+				}
+				if got := cfg.PoolNames(); !slices.Equal(got, []string{"payments", "shop"}) {
+					t.Fatalf("got pools %v", got)
+				}
+			},
+		},
+		"methods replace the env ones": {
+			content: `{"methods": {"GET": {"retryable": true}, "POST": {}}}`,
+			check: func(t *testing.T, cfg *Config) {
+				want := map[string]MethodPolicy{"GET": {Retryable: true}, "POST": {}}
+				if !reflect.DeepEqual(cfg.Methods, want) {
+					t.Fatalf("got methods %v want %v", cfg.Methods, want)
+				}
+			},
+		},
+		"hedge": {
+			content: `{"hedge": {"percentile": 0.99}, "methods": {"GET": {"retryable": true, "hedged": true}}}`,
+			check: func(t *testing.T, cfg *Config) {
+				router := cfg.RouterConfig()
+				if router.Hedge.Percentile != 0.99 || router.Hedge.MinDelay != 10*time.Millisecond || !router.Methods["GET"].Hedged {
+					t.Fatalf("got hedge %+v and methods %+v", router.Hedge, router.Methods)
+				}
+			},
+		},
+		"hedged method that isn't retryable": {
+			content: `{"methods": {"POST": {"hedged": true}}}`,
+			wantErr: "POST can only be hedged",
+		},
+		"ingress limit": {
+			content: `{"ingressLimit": {"rate": 50, "key": "api_key"}, "routes": [{"pool": "payments", "ingressLimit": {"rate": 5}}]}`,
+			check: func(t *testing.T, cfg *Config) {
+				router := cfg.RouterConfig()
+				want := handler.IngressLimitConfig{Rate: 50, Key: handler.IngressKeyAPIKey}
+				if router.IngressLimit != want {
+					t.Errorf("got ingress limit %+v want %+v", router.IngressLimit, want)
+				}
+				if limit := router.Routes[0].IngressLimit; limit == nil || *limit != (handler.IngressLimitConfig{Rate: 5}) {
+					t.Errorf("got route ingress limit %+v", limit)
+				}
+			},
+		},
+		"invalid route ingress limit": {
+			content: `{"routes": [{"pool": "payments", "ingressLimit": {"rate": 5, "key": "header"}}]}`,
+			wantErr: "routes[0].ingressLimit",
+		},
+		"registry": {
+			content: `{"registry": {"allowedBackends": ["10.0.0.0/8", "*.svc.local"], "secret": "s3cret"}}`,
+			check: func(t *testing.T, cfg *Config) {
+				registry := cfg.RegistryConfig()
+				if len(registry.AllowedBackends) != 2 || registry.Secret != "s3cret" || registry.MaxClockSkew != 30*time.Second {
+					t.Fatalf("got registry %+v", registry)
+				}
+			},
+		},
+		"invalid allowed backend": {
+			content: `{"registry": {"allowedBackends": ["10.0.0.0/33"]}}`,
+			wantErr: "registry.allowedBackends",
+		},
+		"https listener": {
+			content: `{"listeners": {"httpRedirect": ":80", "httpTLS": {"certFile": "default.pem", "keyFile": "default-key.pem",
+				"certificates": [{"certFile": "payments.pem", "keyFile": "payments-key.pem"}]}}}`,
+			check: func(t *testing.T, cfg *Config) {
+				router := cfg.RouterConfig()
+				want := []tlsconfig.KeyPair{{CertFile: "payments.pem", KeyFile: "payments-key.pem"}}
+				if router.RedirectAddr != ":80" || router.TLS.CertFile != "default.pem" || !slices.Equal(router.TLS.Certificates, want) {
+					t.Fatalf("got redirect %q and TLS %+v", router.RedirectAddr, router.TLS)
+				}
+			},
+		},
+		"redirect without https": {
+			content: `{"listeners": {"httpRedirect": ":80"}}`,
+			wantErr: "listeners.httpRedirect",
+		},
+		"certificates without default": {
+			content: `{"listeners": {"httpTLS": {"certificates": [{"certFile": "payments.pem", "keyFile": "payments-key.pem"}]}}}`,
+			wantErr: "listeners.httpTLS",
+		},
+		"log levels": {
+			content: `{"log": {"levels": "warn,pool=debug"}}`,
+			check: func(t *testing.T, cfg *Config) {
+				levels, err := cfg.LogLevels()
+				if err != nil || levels.Default != slog.LevelWarn || levels.Components[logging.Pool] != slog.LevelDebug {
+					t.Fatalf("got levels %+v and error %v", levels, err)
+				}
+			},
+		},
+		"invalid log level": {
+			content: `{"log": {"levels": "pool=loud"}}`,
+			wantErr: "log.levels",
+		},
+		"access log to a file": {
+			content: `{"accessLog": {"format": "json", "path": "access.log", "maxSize": 1024, "maxBackups": 2}}`,
+			check: func(t *testing.T, cfg *Config) {
+				cfg.AccessLog.Path = filepath.Join(t.TempDir(), "access.log")
+				w, err := cfg.OpenAccessLog()
+				if err != nil {
+					t.Fatalf("got unexpected error: %v", err)
+				}
+				defer w.Close()
+				if _, ok := w.(*logfile.File); !ok || cfg.RouterConfig().AccessLog.Format != handler.AccessLogJSON {
+					t.Fatalf("got writer %T and router config %+v", w, cfg.RouterConfig().AccessLog)
+				}
+			},
+		},
+		"invalid access log format": {
+			content: `{"accessLog": {"format": "common"}}`,
+			wantErr: "accessLog.format",
+		},
+		"hedged dial retry only method": {
+			content: `{"methods": {"POST": {"retryable": true, "dialRetryOnly": true, "hedged": true}}}`,
+			wantErr: "methods: POST can't be hedged",
+		},
+		"invalid method": {
+			content: `{"methods": {"get": {}}}`,
+			wantErr: "methods",
+		},
+		"invalid route": {
+			content: `{"routes": [{"pool": "shop", "pathPrefix": "shop"}]}`,
+			wantErr: "routes[0].pathPrefix",
+		},
+		"invalid values": {
+			content: `{"rateLimiter": {"slowThreshold": "0s"}, "retry": {"statuses": [42]}}`,
+			wantErr: "rateLimiter.slowThreshold",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := Load(writeConfig(t, t.TempDir(), test.content))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			test.check(t, cfg)
+		})
+	}
+}
+
+func TestWatcherReload(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, dir, `{"rateLimiter": {"slowThreshold": "100ms"}}`)
+	current, err := Load(path)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+
+	var applied []*Config
+	w := NewWatcher(&WatcherConfig{Path: path, Interval: time.Second}, current, func(cfg *Config) error {
+		applied = append(applied, cfg)
+		return nil
+	})
+	if w.changed() {
+		t.Fatalf("file is reported changed before it was touched")
+	}
+
+	// a valid change is applied
+	writeConfig(t, dir, `{"rateLimiter": {"slowThreshold": "300ms"}}`)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if !w.changed() {
+		t.Fatalf("file change not detected")
+	}
+	w.reload("test")
+	if len(applied) != 1 || applied[0].RateLimiter.SlowThreshold != Duration(300*time.Millisecond) {
+		t.Fatalf("got %d applied configs, want the one with the new slow threshold", len(applied))
+	}
+
+	// an invalid one is not, the previous one is kept
+	writeConfig(t, dir, `{"rateLimiter": {"slowThreshold": "fast"}}`)
+	w.reload("test")
+	if len(applied) != 1 || w.current != applied[0] {
+		t.Fatalf("invalid config was applied")
+	}
+}
+
+func TestMethodPolicies(t *testing.T) {
+	tests := map[string]struct {
+		proxied   []string
+		retryable []string
+		dialOnly  []string
+		hedged    []string
+		want      map[string]MethodPolicy
+	}{
+		"all methods": {
+			proxied:   []string{"*"},
+			retryable: []string{"GET", "PUT"},
+			want:      map[string]MethodPolicy{"*": {}, "GET": {Retryable: true}, "PUT": {Retryable: true}},
+		},
+		"some methods": {
+			proxied:   []string{"GET", "POST"},
+			retryable: []string{"GET", "PUT"},
+			want:      map[string]MethodPolicy{"GET": {Retryable: true}, "POST": {}},
+		},
+		"hedged methods": {
+			proxied:   []string{"*"},
+			retryable: []string{"GET", "PUT"},
+			hedged:    []string{"GET", "POST"},
+			want:      map[string]MethodPolicy{"*": {}, "GET": {Retryable: true, Hedged: true}, "PUT": {Retryable: true}},
+		},
+		"dial retry only methods": {
+			proxied:   []string{"*"},
+			retryable: []string{"GET", "POST"},
+			dialOnly:  []string{"POST", "PATCH"},
+			hedged:    []string{"GET", "POST"},
+			want:      map[string]MethodPolicy{"*": {}, "GET": {Retryable: true, Hedged: true}, "POST": {Retryable: true, DialRetryOnly: true}},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := methodPolicies(test.proxied, test.retryable, test.dialOnly, test.hedged); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	tests := map[string]struct {
+		content string
+		want    []string
+	}{
+		"nothing changed":        {content: `{}`},
+		"reloadable change":      {content: `{"rateLimiter": {"slowThreshold": "300ms"}}`},
+		"listeners":              {content: `{"listeners": {"http": ":9090"}}`, want: []string{"listeners"}},
+		"registry secret":        {content: `{"registry": {"secret": "s3cret"}}`, want: []string{"registry"}},
+		"registry backends":      {content: `{"registry": {"allowedBackends": ["10.0.0.0/8"]}}`, want: []string{"registry"}},
+		"access log":             {content: `{"accessLog": {"format": "json"}}`, want: []string{"access log"}},
+		"health check":           {content: `{"pool": {"healthCheck": {"path": "/health"}}}`, want: []string{"health check"}},
+		"listeners and registry": {content: `{"listeners": {"admin": ":9091"}, "registry": {"maxClockSkew": "1m"}}`, want: []string{"listeners", "registry"}},
+	}
+
+	dir := t.TempDir()
+	current, err := Load(writeConfig(t, dir, `{}`))
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := Load(writeConfig(t, t.TempDir(), test.content))
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			if got := restartRequired(current, cfg); !slices.Equal(got, test.want) {
+				t.Fatalf("got %v want %v", got, test.want)
+			}
+		})
+	}
+}
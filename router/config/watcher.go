@@ -0,0 +1,122 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+type WatcherConfig struct {
+	// Path is checked for changes every Interval, without it a SIGHUP is only logged.
+	Path     string
+	Interval time.Duration
+}
+
+// Watcher reloads the config file when it changes or on SIGHUP, an invalid one is logged and ignored.
+type Watcher struct {
+	path     string
+	interval time.Duration
+	current  *Config
+	apply    func(*Config) error
+	modTime  time.Time
+	size     int64
+}
+
+// NewWatcher creates a Watcher that calls apply with every new valid config, current is the one in use.
+func NewWatcher(cfg *WatcherConfig, current *Config, apply func(*Config) error) *Watcher {
+	w := &Watcher{
+		path:     cfg.Path,
+		interval: cfg.Interval,
+		current:  current,
+		apply:    apply,
+	}
+	w.modTime, w.size = w.stat()
+	return w
+}
+
+func (w *Watcher) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if w.path != "" {
+		t := time.NewTicker(w.interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			if w.changed() {
+				w.reload("file changed")
+			}
+		case <-hup:
+			if w.path == "" {
+				logger.Info("SIGHUP received, nothing to reload without a config file")
+				continue
+			}
+			w.changed() // don't reload twice for the same change
+			w.reload("SIGHUP received")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Watcher) changed() bool {
+	modTime, size := w.stat()
+	if modTime.Equal(w.modTime) && size == w.size {
+		return false
+	}
+	w.modTime, w.size = modTime, size
+	return true
+}
+
+func (w *Watcher) stat() (time.Time, int64) {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		// e.g. while the file is being replaced, it's picked up once it's back
+		return time.Time{}, 0
+	}
+	return info.ModTime(), info.Size()
+}
+
+func (w *Watcher) reload(reason string) {
+	cfg, err := Load(w.path)
+	if err != nil {
+		logger.Error("not reloading config, keeping the previous one", "reason", reason, "error", err)
+		return
+	}
+
+	for _, section := range restartRequired(w.current, cfg) {
+		logger.Warn(section+" changed, this only takes effect after a restart", "path", w.path)
+	}
+	if err := w.apply(cfg); err != nil {
+		logger.Error("not reloading config, keeping the previous one", "reason", reason, "error", err)
+		return
+	}
+	w.current = cfg
+	logger.Info("config reloaded", "reason", reason)
+}
+
+// restartRequired lists the sections of cfg that changed but need a restart.
+func restartRequired(current, cfg *Config) []string {
+	var res []string
+	if !cfg.Listeners.equal(current.Listeners) {
+		res = append(res, "listeners")
+	}
+	if !cfg.Registry.equal(current.Registry) {
+		res = append(res, "registry")
+	}
+	if cfg.AccessLog != current.AccessLog {
+		res = append(res, "access log")
+	}
+	if cfg.Pool.HealthCheck != current.Pool.HealthCheck {
+		res = append(res, "health check")
+	}
+	return res
+}
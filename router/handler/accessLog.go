@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mrbarrel/lib/logging"
+	"mrbarrel/router/pool"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The formats of the access log.
+const (
+	// AccessLogCombined is the combined log format, with the bytes in, latencies, backend, retries and request id.
+	AccessLogCombined = "combined"
+	// AccessLogJSON writes a JSON object per line.
+	AccessLogJSON = "json"
+)
+
+// AccessLogConfig sets up a line per request, it can't change while running.
+type AccessLogConfig struct {
+	// Format is AccessLogCombined or AccessLogJSON, nothing is logged when it's empty.
+	Format string
+	// Output gets the lines, a single Write each.
+	Output io.Writer
+}
+
+func (cfg AccessLogConfig) Validate() error {
+	switch cfg.Format {
+	case "", AccessLogCombined, AccessLogJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown format %q, use %s or %s", cfg.Format, AccessLogCombined, AccessLogJSON)
+}
+
+// accessEntry is what forward found out about a request, for the access log.
+type accessEntry struct {
+	// backend is the Host of the Forwarder that answered, or that was tried last.
+	backend string
+	// upstream is the time spent in calls to the backends, over all attempts.
+	upstream time.Duration
+	retries  int
+}
+
+type accessEntryKey struct{}
+
+func withAccessEntry(req *http.Request, entry *accessEntry) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), accessEntryKey{}, entry))
+}
+
+// accessEntryFrom returns the entry of req, a throwaway one when there's none.
+func accessEntryFrom(req *http.Request) *accessEntry {
+	if entry, ok := req.Context().Value(accessEntryKey{}).(*accessEntry); ok {
+		return entry
+	}
+	return &accessEntry{}
+}
+
+// accessLogger writes the access log, a nil one writes nothing.
+type accessLogger struct {
+	format string
+	lock   sync.Mutex
+	out    io.Writer
+}
+
+func newAccessLogger(cfg AccessLogConfig) *accessLogger {
+	if cfg.Format == "" || cfg.Output == nil {
+		return nil
+	}
+	return &accessLogger{format: cfg.Format, out: cfg.Output}
+}
+
+// accessLine is a request as written in the JSON format.
+type accessLine struct {
+	Time            string  `json:"time"`
+	RemoteAddr      string  `json:"remote_addr"`
+	Method          string  `json:"method"`
+	Path            string  `json:"path"`
+	Status          int     `json:"status"`
+	BytesIn         int64   `json:"bytes_in"`
+	BytesOut        int64   `json:"bytes_out"`
+	LatencyMS       float64 `json:"latency_ms"`
+	UpstreamLatency float64 `json:"upstream_latency_ms"`
+	Backend         string  `json:"backend"`
+	Retries         int     `json:"retries"`
+	RequestID       string  `json:"request_id"`
+	Referer         string  `json:"referer,omitempty"`
+	UserAgent       string  `json:"user_agent,omitempty"`
+}
+
+func (l *accessLogger) log(req *http.Request, start time.Time, rec *pool.ResponseRecorder, bytesIn int64, entry *accessEntry) {
+	if l == nil {
+		return
+	}
+	remote := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	backend := entry.backend
+	if backend == "" {
+		backend = "-"
+	}
+	id := req.Header.Get(logging.RequestIDHeader)
+
+	var line []byte
+	switch l.format {
+	case AccessLogJSON:
+		line, _ = json.Marshal(accessLine{
+			Time:            start.Format(time.RFC3339Nano),
+			RemoteAddr:      remote,
+			Method:          req.Method,
+			Path:            req.URL.Path,
+			Status:          rec.Status(),
+			BytesIn:         bytesIn,
+			BytesOut:        rec.Written(),
+			LatencyMS:       milliseconds(time.Since(start)),
+			UpstreamLatency: milliseconds(entry.upstream),
+			Backend:         backend,
+			Retries:         entry.retries,
+			RequestID:       id,
+			Referer:         req.Referer(),
+			UserAgent:       req.UserAgent(),
+		})
+		line = append(line, '\n')
+	default:
+		line = fmt.Appendf(nil, "%s - - [%s] %s %d %d %s %s %d %.3f %.3f %s %d %s\n",
+			remote, start.Format("02/Jan/2006:15:04:05 -0700"),
+			quote(req.Method+" "+req.URL.RequestURI()+" "+req.Proto), rec.Status(), rec.Written(),
+			quote(req.Referer()), quote(req.UserAgent()), bytesIn, time.Since(start).Seconds(),
+			entry.upstream.Seconds(), quote(backend), entry.retries, quote(id))
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := l.out.Write(line); err != nil {
+		routerLog.Warn("while writing access log", "error", err)
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// quote quotes s for a log line, "-" when empty.
+func quote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// countingBody counts the bytes read from the request body.
+type countingBody struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"mrbarrel/lib/logging"
+	"mrbarrel/router/pool"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	retry := RetryConfig{MaxRetries: 1, MaxBodySize: 1024, Statuses: []int{http.StatusServiceUnavailable}, BudgetMinPerSecond: 10}
+
+	tests := map[string]struct {
+		backends    []int // status per backend, see backendAddr
+		wantStatus  int
+		wantBackend int // index in backends, -1 for none
+		wantRetries int
+	}{
+		"answered":   {backends: []int{http.StatusOK}, wantStatus: http.StatusOK},
+		"retried":    {backends: []int{http.StatusServiceUnavailable, http.StatusCreated}, wantStatus: http.StatusCreated, wantBackend: 1, wantRetries: 1},
+		"no backend": {wantStatus: http.StatusBadGateway, wantBackend: -1},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pools := newTestGroup(t)
+			_, registrar := pools.Pool(pool.DefaultPool)
+			var addrs []string
+			for _, status := range test.backends {
+				addrs = append(addrs, backendAddr(t, status))
+				registrar.RegisterClient(addrs[len(addrs)-1], 1)
+			}
+			var out bytes.Buffer
+			router := NewRouter(&RouterConfig{Retry: retry, AccessLog: AccessLogConfig{Format: AccessLogJSON, Output: &out}}, pools)
+
+			req := httptest.NewRequest(http.MethodPut, "/json?q=1", strings.NewReader(`{"foo":123}`))
+			req.Header.Set(logging.RequestIDHeader, "abc-123")
+			router.mux.ServeHTTP(httptest.NewRecorder(), req)
+
+			var got accessLine
+			if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+				t.Fatalf("got unexpected error: %v in %q", err, out.String())
+			}
+			wantBackend, wantOut := "-", int64(0)
+			if test.wantBackend >= 0 {
+				wantBackend, wantOut = addrs[test.wantBackend], 11
+			}
+			if got.Method != http.MethodPut || got.Path != "/json" || got.Status != test.wantStatus || got.RequestID != "abc-123" {
+				t.Fatalf("got %+v want PUT /json with status %d", got, test.wantStatus)
+			}
+			if got.Backend != wantBackend || got.Retries != test.wantRetries {
+				t.Fatalf("got backend %s after %d retries want %s after %d", got.Backend, got.Retries, wantBackend, test.wantRetries)
+			}
+			if got.BytesIn != 11 || got.BytesOut != wantOut {
+				t.Fatalf("got %d bytes in and %d out want 11 and %d", got.BytesIn, got.BytesOut, wantOut)
+			}
+			if got.LatencyMS < got.UpstreamLatency {
+				t.Fatalf("got latency %fms under the upstream latency %fms", got.LatencyMS, got.UpstreamLatency)
+			}
+		})
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	pools := newTestGroup(t)
+	_, registrar := pools.Pool(pool.DefaultPool)
+	addr := backendAddr(t, http.StatusOK)
+	registrar.RegisterClient(addr, 1)
+	var out bytes.Buffer
+	router := NewRouter(&RouterConfig{AccessLog: AccessLogConfig{Format: AccessLogCombined, Output: &out}}, pools)
+
+	req := httptest.NewRequest(http.MethodPut, "/items/1", strings.NewReader("hello"))
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("User-Agent", "test \"agent\"")
+	req.Header.Set(logging.RequestIDHeader, "abc-123")
+	router.mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := out.String()
+	for _, want := range []string{
+		`10.0.0.1 - - [`,
+		`] "PUT /items/1 HTTP/1.1" 200 5 "-" "test \"agent\"" 5 `,
+		` "` + addr + `" 0 "abc-123"` + "\n",
+	} {
+		if !strings.Contains(line, want) {
+			t.Fatalf("got %q, want it to contain %q", line, want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mrbarrel/lib/logging"
+	"mrbarrel/lib/metrics"
+	"mrbarrel/router/pool"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+var adminLog = logging.Logger(logging.Admin)
+
+type AdminHandlerConfig struct {
+	ListenAddr string
+}
+
+// AdminHandler serves the operational endpoints, keep it on an internal address: they aren't authenticated.
+type AdminHandler struct {
+	listenAddr string
+	mux        *http.ServeMux
+	pools      *pool.Group
+}
+
+// backendView is how a pool entry is shown by the admin API.
+type backendView struct {
+	Pool             string         `json:"pool"`
+	Addr             string         `json:"addr"`
+	State            string         `json:"state"`
+	Drained          bool           `json:"drained"`
+	Weight           int            `json:"weight"`
+	LastNotif        time.Time      `json:"lastNotif"`
+	Static           bool           `json:"static"`
+	Healthy          bool           `json:"healthy"`
+	Stage            string         `json:"stage"`
+	Score            float64        `json:"score"`
+	WaitTime         string         `json:"waitTime"`
+	Breaker          string         `json:"breaker"`
+	InFlight         int64          `json:"inFlight"`
+	ConcurrencyLimit int            `json:"concurrencyLimit"`
+	StatusCodes      map[int]uint64 `json:"statusCodes"`
+	ConnsNew         uint64         `json:"connsNew"`
+	ConnsReused      uint64         `json:"connsReused"`
+}
+
+// NewAdminHandler creates the admin API, changes apply to every pool unless the 'pool' query param names one.
+func NewAdminHandler(cfg *AdminHandlerConfig, registry *metrics.Registry, pools *pool.Group) *AdminHandler {
+	ah := &AdminHandler{
+		listenAddr: cfg.ListenAddr,
+		mux:        http.NewServeMux(),
+		pools:      pools,
+	}
+
+	ah.mux.Handle(fmt.Sprintf("%s /metrics", http.MethodGet), registry)
+	ah.mux.HandleFunc(fmt.Sprintf("%s /backends", http.MethodGet), ah.listBackends)
+	ah.mux.HandleFunc(fmt.Sprintf("%s /backends/{addr}/drain", http.MethodPost), ah.changeBackend(pool.ClientRegistrar.DrainClient))
+	ah.mux.HandleFunc(fmt.Sprintf("%s /backends/{addr}/disable", http.MethodPost), ah.changeBackend(pool.ClientRegistrar.DisableClient))
+	ah.mux.HandleFunc(fmt.Sprintf("%s /backends/{addr}/enable", http.MethodPost), ah.changeBackend(pool.ClientRegistrar.EnableClient))
+	ah.mux.HandleFunc(fmt.Sprintf("%s /backends/{addr}", http.MethodDelete), ah.changeBackend(removeClient))
+	return ah
+}
+
+func (ah *AdminHandler) ListenAndServe(ctx context.Context) error {
+	server := &http.Server{Addr: ah.listenAddr, Handler: ah.mux}
+
+	// listen for context to stop server gracefully
+	go func() {
+		<-ctx.Done()
+		adminLog.Info("gracefully shutting down admin listener")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			adminLog.Error("admin listener shutdown failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	return server.ListenAndServe()
+}
+
+func (ah *AdminHandler) listBackends(w http.ResponseWriter, _ *http.Request) {
+	statuses := poolStatuses(ah.pools)
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return statuses[i].pool < statuses[j].pool || statuses[i].pool == statuses[j].pool && statuses[i].Addr < statuses[j].Addr
+	})
+
+	views := make([]backendView, 0, len(statuses))
+	for _, s := range statuses {
+		views = append(views, backendView{
+			Pool:             s.pool,
+			Addr:             s.Addr,
+			State:            s.State.String(),
+			Drained:          s.State == pool.StateDraining && s.InFlight == 0,
+			Weight:           s.Weight,
+			LastNotif:        s.LastNotif,
+			Static:           s.Static,
+			Healthy:          s.Healthy,
+			Stage:            s.Stage,
+			Score:            s.Score,
+			WaitTime:         s.WaitTime.String(),
+			Breaker:          s.Breaker,
+			InFlight:         s.InFlight,
+			ConcurrencyLimit: s.ConcurrencyLimit,
+			StatusCodes:      s.StatusCodes,
+			ConnsNew:         s.ConnsNew,
+			ConnsReused:      s.ConnsReused,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(views); err != nil {
+		adminLog.Error("while writing backends", "error", err)
+	}
+}
+
+func (ah *AdminHandler) changeBackend(change func(cr pool.ClientRegistrar, addr string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		addr := req.PathValue("addr")
+		found := false
+		for _, cr := range ah.registrars(req) {
+			err := change(cr, addr)
+			if errors.Is(err, pool.ErrUnknownClient) {
+				continue
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			found = true
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// registrars returns the pool named in the 'pool' query param, or all pools when there's none.
+func (ah *AdminHandler) registrars(req *http.Request) []pool.ClientRegistrar {
+	if name := req.URL.Query().Get("pool"); name != "" {
+		if _, cr, ok := ah.pools.Lookup(name); ok {
+			return []pool.ClientRegistrar{cr}
+		}
+		return nil
+	}
+
+	var res []pool.ClientRegistrar
+	for _, name := range ah.pools.Names() {
+		if _, cr, ok := ah.pools.Lookup(name); ok {
+			res = append(res, cr)
+		}
+	}
+	return res
+}
+
+// removeClient drops a backend until its next heartbeat, disable it to keep it out.
+func removeClient(cr pool.ClientRegistrar, addr string) error {
+	if _, err := cr.ClientStatus(addr); err != nil {
+		return err
+	}
+	adminLog.Info("force removing backend", logging.BackendKey, addr)
+	cr.DeRegisterClient(addr)
+	return nil
+}
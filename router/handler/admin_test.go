@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"encoding/json"
+	"mrbarrel/lib/metrics"
+	"mrbarrel/router/pool"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminBackends(t *testing.T) {
+	tests := map[string]struct {
+		method     string
+		path       string
+		wantStatus int
+		wantStates map[string]string
+	}{
+		"list": {
+			method:     http.MethodGet,
+			path:       "/backends",
+			wantStatus: http.StatusOK,
+			wantStates: map[string]string{"purple:80": "ACTIVE", "green:80": "ACTIVE", "yellow:80": "ACTIVE"},
+		},
+		"drain": {
+			method:     http.MethodPost,
+			path:       "/backends/purple:80/drain",
+			wantStatus: http.StatusNoContent,
+			wantStates: map[string]string{"purple:80": "DRAINING", "green:80": "ACTIVE", "yellow:80": "ACTIVE"},
+		},
+		"disable": {
+			method:     http.MethodPost,
+			path:       "/backends/green:80/disable",
+			wantStatus: http.StatusNoContent,
+			wantStates: map[string]string{"purple:80": "ACTIVE", "green:80": "DISABLED", "yellow:80": "ACTIVE"},
+		},
+		"enable": {
+			method:     http.MethodPost,
+			path:       "/backends/green:80/enable",
+			wantStatus: http.StatusNoContent,
+			wantStates: map[string]string{"purple:80": "ACTIVE", "green:80": "ACTIVE", "yellow:80": "ACTIVE"},
+		},
+		"drain unknown": {
+			method:     http.MethodPost,
+			path:       "/backends/blue:80/drain",
+			wantStatus: http.StatusNotFound,
+			wantStates: map[string]string{"purple:80": "ACTIVE", "green:80": "ACTIVE", "yellow:80": "ACTIVE"},
+		},
+		"remove": {
+			method:     http.MethodDelete,
+			path:       "/backends/purple:80",
+			wantStatus: http.StatusNoContent,
+			wantStates: map[string]string{"green:80": "ACTIVE", "yellow:80": "ACTIVE"},
+		},
+		"drain in pool": {
+			method:     http.MethodPost,
+			path:       "/backends/yellow:80/drain?pool=payments",
+			wantStatus: http.StatusNoContent,
+			wantStates: map[string]string{"purple:80": "ACTIVE", "green:80": "ACTIVE", "yellow:80": "DRAINING"},
+		},
+		"drain in wrong pool": {
+			method:     http.MethodPost,
+			path:       "/backends/yellow:80/drain?pool=default",
+			wantStatus: http.StatusNotFound,
+			wantStates: map[string]string{"purple:80": "ACTIVE", "green:80": "ACTIVE", "yellow:80": "ACTIVE"},
+		},
+		"remove unknown": {
+			method:     http.MethodDelete,
+			path:       "/backends/blue:80",
+			wantStatus: http.StatusNotFound,
+			wantStates: map[string]string{"purple:80": "ACTIVE", "green:80": "ACTIVE", "yellow:80": "ACTIVE"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pools := newTestGroup(t)
+			_, registrar := pools.Pool(pool.DefaultPool)
+			registrar.RegisterClient("purple:80", 1)
+			registrar.RegisterClient("green:80", 1)
+			_, registrar = pools.Pool("payments")
+			registrar.RegisterClient("yellow:80", 1)
+			admin := NewAdminHandler(&AdminHandlerConfig{}, metrics.NewRegistry(), pools)
+
+			res := httptest.NewRecorder()
+			admin.mux.ServeHTTP(res, httptest.NewRequest(test.method, test.path, nil))
+			if res.Code != test.wantStatus {
+				t.Fatalf("got status %d want %d", res.Code, test.wantStatus)
+			}
+
+			res = httptest.NewRecorder()
+			admin.mux.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/backends", nil))
+			var views []backendView
+			if err := json.NewDecoder(res.Body).Decode(&views); err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			gotStates := map[string]string{}
+			for _, v := range views {
+				gotStates[v.Addr] = v.State
+				if v.LastNotif.IsZero() {
+					t.Errorf("missing last notif time for %s", v.Addr)
+				}
+			}
+			if len(gotStates) != len(test.wantStates) {
+				t.Fatalf("got states %v want %v", gotStates, test.wantStates)
+			}
+			for addr, state := range test.wantStates {
+				if gotStates[addr] != state {
+					t.Fatalf("got states %v want %v", gotStates, test.wantStates)
+				}
+			}
+		})
+	}
+}
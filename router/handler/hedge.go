@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"context"
+	"mrbarrel/router/pool"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+type HedgeConfig struct {
+	// Percentile (0-1) of the recent calls a hedged call waits before a copy goes out, 0 disables hedging.
+	Percentile float64
+	// MinDelay is the least time before a copy is sent, so a fast pool doesn't get every call twice.
+	MinDelay time.Duration
+}
+
+const (
+	hedgeWinnerFirst = "first"
+	hedgeWinnerHedge = "hedge"
+	hedgeWinnerNone  = "none"
+)
+
+// delay returns how long the first call gets, false when the pool didn't see enough calls to tell.
+func (cfg HedgeConfig) delay(clients pool.ForwarderProvider) (time.Duration, bool) {
+	if cfg.Percentile <= 0 {
+		return 0, false
+	}
+	d, ok := clients.LatencyPercentile(cfg.Percentile)
+	return max(d, cfg.MinDelay), ok
+}
+
+// hedge forwards req to first, and a copy to another Forwarder after delay. The first answer wins.
+func (r *Router) hedge(w http.ResponseWriter, req *http.Request, body []byte, first pool.Forwarder, delay time.Duration,
+	clients pool.ForwarderProvider, tried map[string]bool, settings *routerSettings) error {
+	race := &hedgeRace{w: w}
+	done := make(chan hedgeResult, 2)
+	send := func(f pool.Forwarder) {
+		callReq := pool.WithRetry(withBody(req, body), settings.retry.Statuses)
+		ctx, cancel := context.WithCancel(callReq.Context())
+		hw := race.add(cancel)
+		go func() {
+			defer cancel()
+			defer func() {
+				// the server only recovers panics on the handler's goroutine, outcome raises them again there
+				if p := recover(); p != nil {
+					done <- hedgeResult{writer: hw, panicked: p, stack: debug.Stack()}
+				}
+			}()
+			done <- hedgeResult{writer: hw, err: f.Forward(hw, callReq.WithContext(ctx))}
+		}()
+	}
+
+	send(first)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		// answered, or failed, before it was time to hedge
+		return race.outcome([]hedgeResult{res})
+	case <-timer.C:
+	}
+
+	calls := 1
+	second, err := next(clients, req, tried)
+	if err == nil && settings.budget.withdraw() {
+		tried[second.Host()] = true
+		send(second)
+		calls++
+	}
+
+	var results []hedgeResult
+	for len(results) < calls {
+		results = append(results, <-done)
+	}
+	if calls > 1 {
+		r.metrics.hedges.Inc(race.winnerName())
+		if race.winner != nil && race.winner.idx == 1 {
+			accessEntryFrom(req).backend = second.Host()
+		}
+	}
+	return race.outcome(results)
+}
+
+// hedgeResult is how a single call in a race ended.
+type hedgeResult struct {
+	writer *hedgeWriter
+	err    error
+	// panicked is what the call panicked with, and stack where.
+	panicked any
+	stack    []byte
+}
+
+// hedgeRace hands the ResponseWriter to the call that answers first.
+type hedgeRace struct {
+	w       http.ResponseWriter
+	lock    sync.Mutex
+	cancels []context.CancelFunc
+	winner  *hedgeWriter
+}
+
+func (hr *hedgeRace) add(cancel context.CancelFunc) *hedgeWriter {
+	hr.lock.Lock()
+	defer hr.lock.Unlock()
+	hw := &hedgeWriter{race: hr, idx: len(hr.cancels), header: http.Header{}}
+	hr.cancels = append(hr.cancels, cancel)
+	return hw
+}
+
+// claim makes hw the winner when there's none yet, and cancels the other calls.
+func (hr *hedgeRace) claim(hw *hedgeWriter) bool {
+	hr.lock.Lock()
+	defer hr.lock.Unlock()
+	if hr.winner != nil {
+		return false
+	}
+	hr.winner = hw
+	for i, cancel := range hr.cancels {
+		if i != hw.idx {
+			cancel()
+		}
+	}
+	return true
+}
+
+// outcome is the result of the race once all calls are done, it raises their panics again.
+func (hr *hedgeRace) outcome(results []hedgeResult) error {
+	for _, res := range results {
+		if res.panicked != nil && res.panicked != http.ErrAbortHandler {
+			routerLog.Error("hedged call panicked", "panic", res.panicked, "stack", string(res.stack))
+			panic(res.panicked)
+		}
+	}
+	var err error
+	for _, res := range results {
+		if res.writer == hr.winner && res.panicked != nil {
+			panic(res.panicked)
+		}
+		if res.err != nil {
+			err = res.err
+		}
+	}
+	if hr.winner != nil {
+		return nil
+	}
+	return err
+}
+
+func (hr *hedgeRace) winnerName() string {
+	switch {
+	case hr.winner == nil:
+		return hedgeWinnerNone
+	case hr.winner.idx == 0:
+		return hedgeWinnerFirst
+	}
+	return hedgeWinnerHedge
+}
+
+// hedgeWriter is the ResponseWriter of a single call in a race.
+type hedgeWriter struct {
+	race   *hedgeRace
+	idx    int
+	header http.Header
+	won    bool
+}
+
+func (hw *hedgeWriter) Header() http.Header {
+	if hw.won {
+		return hw.race.w.Header()
+	}
+	return hw.header
+}
+
+func (hw *hedgeWriter) WriteHeader(code int) {
+	if hw.won {
+		hw.race.w.WriteHeader(code)
+		return
+	}
+	// informational responses don't decide the race
+	if code < http.StatusOK || !hw.race.claim(hw) {
+		return
+	}
+	hw.won = true
+	for k, v := range hw.header {
+		hw.race.w.Header()[k] = v
+	}
+	hw.race.w.WriteHeader(code)
+}
+
+func (hw *hedgeWriter) Write(b []byte) (int, error) {
+	if !hw.won {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if !hw.won {
+		return len(b), nil
+	}
+	return hw.race.w.Write(b)
+}
+
+// FlushError lets the ReverseProxy flush the winner.
+func (hw *hedgeWriter) FlushError() error {
+	if !hw.won {
+		return nil
+	}
+	return http.NewResponseController(hw.race.w).Flush()
+}
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"io"
+	"mrbarrel/lib/metrics"
+	"mrbarrel/router/pool"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouterHedging(t *testing.T) {
+	const slowDelay = 500 * time.Millisecond
+
+	tests := map[string]struct {
+		methods     map[string]MethodPolicy
+		hedge       HedgeConfig
+		slowStatus  int
+		fastStatus  int
+		wantStatus  int
+		wantBody    string
+		wantHedged  bool
+		wantMinTime time.Duration
+	}{
+		"slow backend hedged": {
+			methods:    map[string]MethodPolicy{http.MethodGet: {Retryable: true, Hedged: true}},
+			hedge:      HedgeConfig{Percentile: 0.95, MinDelay: 10 * time.Millisecond},
+			slowStatus: http.StatusOK,
+			fastStatus: http.StatusOK,
+			wantStatus: http.StatusOK,
+			wantBody:   "fast",
+			wantHedged: true,
+		},
+		"method not hedged": {
+			methods:     map[string]MethodPolicy{http.MethodGet: {Retryable: true}},
+			hedge:       HedgeConfig{Percentile: 0.95, MinDelay: 10 * time.Millisecond},
+			slowStatus:  http.StatusOK,
+			fastStatus:  http.StatusOK,
+			wantStatus:  http.StatusOK,
+			wantBody:    "slow",
+			wantMinTime: slowDelay,
+		},
+		"hedging disabled": {
+			methods:     map[string]MethodPolicy{http.MethodGet: {Retryable: true, Hedged: true}},
+			slowStatus:  http.StatusOK,
+			fastStatus:  http.StatusOK,
+			wantStatus:  http.StatusOK,
+			wantBody:    "slow",
+			wantMinTime: slowDelay,
+		},
+		"hedge fails, slow backend answers": {
+			methods:     map[string]MethodPolicy{http.MethodGet: {Retryable: true, Hedged: true}},
+			hedge:       HedgeConfig{Percentile: 0.95, MinDelay: 10 * time.Millisecond},
+			slowStatus:  http.StatusOK,
+			fastStatus:  http.StatusServiceUnavailable,
+			wantStatus:  http.StatusOK,
+			wantBody:    "slow",
+			wantHedged:  true,
+			wantMinTime: slowDelay,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pools := newTestGroup(t)
+			clients, registrar := pools.Pool(pool.DefaultPool)
+			registry := metrics.NewRegistry()
+			router := NewRouter(&RouterConfig{
+				Retry:   RetryConfig{MaxBodySize: 1024, Statuses: []int{http.StatusServiceUnavailable}, BudgetMinPerSecond: 10},
+				Hedge:   test.hedge,
+				Methods: test.methods,
+				Metrics: registry,
+			}, pools)
+
+			// the pool learns how fast its calls usually are
+			registrar.RegisterClient(namedBackendAddr(t, "warmup", http.StatusOK, 0), 1)
+			for i := 0; i < 25; i++ {
+				router.handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			}
+			registrar.DeRegisterClient(clients.Statuses()[0].Addr)
+			registrar.RegisterClient(namedBackendAddr(t, "slow", test.slowStatus, slowDelay), 1)
+			registrar.RegisterClient(namedBackendAddr(t, "fast", test.fastStatus, 0), 1)
+
+			res := httptest.NewRecorder()
+			start := time.Now()
+			router.handle(res, httptest.NewRequest(http.MethodGet, "/", nil))
+			took := time.Since(start)
+
+			if res.Code != test.wantStatus {
+				t.Fatalf("got status %d want %d", res.Code, test.wantStatus)
+			}
+			if body, _ := io.ReadAll(res.Body); string(body) != test.wantBody {
+				t.Fatalf("got body %q want %q", body, test.wantBody)
+			}
+			if took < test.wantMinTime || test.wantMinTime == 0 && took >= slowDelay {
+				t.Fatalf("took %v", took)
+			}
+
+			scrape := httptest.NewRecorder()
+			registry.ServeHTTP(scrape, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			if hedged := strings.Contains(scrape.Body.String(), "router_hedged_requests_total{"); hedged != test.wantHedged {
+				t.Fatalf("got hedged %v want %v", hedged, test.wantHedged)
+			}
+		})
+	}
+}
+
+// namedBackendAddr starts a backend answering with its name and the given status after delay, or when the call is
+// cancelled.
+func namedBackendAddr(t *testing.T, name string, status int, delay time.Duration) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(name))
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestHedgeRace(t *testing.T) {
+	rec := httptest.NewRecorder()
+	race := &hedgeRace{w: rec}
+	var cancelled []int
+	first := race.add(func() { cancelled = append(cancelled, 0) })
+	second := race.add(func() { cancelled = append(cancelled, 1) })
+
+	// informational responses don't win
+	first.Header().Set("X-Call", "first")
+	first.WriteHeader(http.StatusContinue)
+	second.Header().Set("X-Call", "second")
+	second.WriteHeader(http.StatusOK)
+	first.WriteHeader(http.StatusOK)
+	_, _ = first.Write([]byte("first"))
+	_, _ = second.Write([]byte("second"))
+
+	if race.winnerName() != hedgeWinnerHedge {
+		t.Fatalf("got winner %s want %s", race.winnerName(), hedgeWinnerHedge)
+	}
+	if len(cancelled) != 1 || cancelled[0] != 0 {
+		t.Fatalf("got cancelled calls %v, want the first one", cancelled)
+	}
+	if got := rec.Header().Get("X-Call"); got != "second" {
+		t.Fatalf("got header %q from the call that lost", got)
+	}
+	if got := rec.Body.String(); got != "second" {
+		t.Fatalf("got body %q want second", got)
+	}
+}
+
+// panicForwarder panics on every call, like a Forwarder with a bug.
+type panicForwarder struct {
+	pool.Forwarder
+}
+
+func (panicForwarder) Forward(http.ResponseWriter, *http.Request) error {
+	panic("boom")
+}
+
+func (panicForwarder) Host() string {
+	return "panic:8080"
+}
+
+func TestHedgePanic(t *testing.T) {
+	pools := newTestGroup(t)
+	clients, _ := pools.Pool(pool.DefaultPool)
+	router := NewRouter(&RouterConfig{Metrics: metrics.NewRegistry()}, pools)
+
+	defer func() {
+		// raised again on the handler's goroutine, where the server recovers it
+		if p := recover(); p != "boom" {
+			t.Fatalf("got panic %v want boom", p)
+		}
+	}()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	router.hedge(httptest.NewRecorder(), req, nil, panicForwarder{}, time.Hour, clients, map[string]bool{}, router.settings.Load())
+	t.Fatalf("expected a panic")
+}
@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	IngressKeyClientIP = "client_ip"
+	IngressKeyAPIKey   = "api_key"
+	IngressKeyHeader   = "header"
+)
+
+// DefaultAPIKeyHeader is where the API key is read from when IngressLimitConfig.Header isn't set.
+const DefaultAPIKeyHeader = "X-API-Key"
+
+// full buckets are dropped this often.
+const ingressSweepInterval = time.Minute
+
+// maxIngressClients caps the buckets, the clients past it share one.
+const (
+	maxIngressClients  = 100_000
+	ingressOverflowKey = "overflow"
+)
+
+// IngressLimitConfig caps the incoming requests with token buckets, per client and for all of them.
+type IngressLimitConfig struct {
+	// Rate is the number of requests per second each client gets, 0 disables the per client limit.
+	Rate float64
+	// Burst is the number of requests a client can send at once, defaults to Rate rounded up.
+	Burst int
+	// Key tells clients apart, the IP is limited too when it's a header.
+	Key string
+	// Header holds the key, DefaultAPIKeyHeader for IngressKeyAPIKey.
+	Header string
+	// GlobalRate and GlobalBurst cap all clients together, 0 disables it.
+	GlobalRate  float64
+	GlobalBurst int
+}
+
+func (cfg IngressLimitConfig) Validate() error {
+	if cfg.Rate < 0 || cfg.Burst < 0 || cfg.GlobalRate < 0 || cfg.GlobalBurst < 0 {
+		return fmt.Errorf("rates and bursts can't be negative")
+	}
+	switch cfg.Key {
+	case "", IngressKeyClientIP, IngressKeyAPIKey:
+	case IngressKeyHeader:
+		if cfg.Header == "" {
+			return fmt.Errorf("key %q needs a header", cfg.Key)
+		}
+	default:
+		return fmt.Errorf("unknown key %q", cfg.Key)
+	}
+	return nil
+}
+
+type ingressLimiter struct {
+	cfg        IngressLimitConfig
+	lock       sync.Mutex
+	clients    map[string]*tokenBucket
+	maxClients int
+	global     *tokenBucket
+	lastSweep  time.Time
+	now        func() time.Time
+}
+
+// newIngressLimiter returns nil when cfg doesn't limit anything.
+func newIngressLimiter(cfg *IngressLimitConfig) *ingressLimiter {
+	if cfg == nil || cfg.Rate <= 0 && cfg.GlobalRate <= 0 {
+		return nil
+	}
+	l := &ingressLimiter{cfg: *cfg, clients: map[string]*tokenBucket{}, maxClients: maxIngressClients, now: time.Now}
+	if l.cfg.Burst <= 0 {
+		l.cfg.Burst = int(math.Ceil(l.cfg.Rate))
+	}
+	if l.cfg.GlobalBurst <= 0 {
+		l.cfg.GlobalBurst = int(math.Ceil(l.cfg.GlobalRate))
+	}
+	if l.cfg.Key == IngressKeyAPIKey && l.cfg.Header == "" {
+		l.cfg.Header = DefaultAPIKeyHeader
+	}
+	l.lastSweep = l.now()
+	if l.cfg.GlobalRate > 0 {
+		l.global = &tokenBucket{tokens: float64(l.cfg.GlobalBurst), last: l.lastSweep}
+	}
+	return l
+}
+
+// allow takes a token for req, or answers with a 429 and returns false.
+func (l *ingressLimiter) allow(w http.ResponseWriter, req *http.Request) bool {
+	if l == nil {
+		return true
+	}
+	l.lock.Lock()
+	now := l.now()
+	l.sweep(now)
+
+	var clients []*tokenBucket
+	if l.cfg.Rate > 0 {
+		for _, key := range l.keys(req) {
+			client := l.bucket(key, now)
+			client.refill(now, l.cfg.Rate, l.cfg.Burst)
+			clients = append(clients, client)
+		}
+	}
+	if l.global != nil {
+		l.global.refill(now, l.cfg.GlobalRate, l.cfg.GlobalBurst)
+	}
+
+	var wait time.Duration
+	for _, client := range clients {
+		if client.tokens < 1 {
+			wait = max(wait, client.wait(l.cfg.Rate))
+		}
+	}
+	if wait == 0 && l.global != nil && l.global.tokens < 1 {
+		wait = l.global.wait(l.cfg.GlobalRate)
+	}
+	if wait == 0 {
+		for _, client := range clients {
+			client.tokens--
+		}
+		if l.global != nil {
+			l.global.tokens--
+		}
+	}
+	if len(clients) > 0 {
+		// the headers are those of the bucket with the fewest tokens
+		client := clients[0]
+		for _, other := range clients[1:] {
+			if other.tokens < client.tokens {
+				client = other
+			}
+		}
+		h := w.Header()
+		h.Set("X-RateLimit-Limit", strconv.Itoa(l.cfg.Burst))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(int(client.tokens)))
+		h.Set("X-RateLimit-Reset", strconv.Itoa(seconds(client.untilFull(l.cfg.Rate, l.cfg.Burst))))
+	}
+	l.lock.Unlock()
+
+	if wait == 0 {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds(wait), 1)))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	return false
+}
+
+// keys returns the buckets of req, its key and IP.
+func (l *ingressLimiter) keys(req *http.Request) []string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if l.cfg.Key == IngressKeyAPIKey || l.cfg.Key == IngressKeyHeader {
+		if key := req.Header.Get(l.cfg.Header); key != "" {
+			// a client can't take the bucket of an IP by sending it as its key
+			return []string{l.cfg.Key + ":" + key, ip}
+		}
+	}
+	return []string{ip}
+}
+
+func (l *ingressLimiter) bucket(key string, now time.Time) *tokenBucket {
+	b := l.clients[key]
+	if b == nil && len(l.clients) >= l.maxClients {
+		key = ingressOverflowKey
+		b = l.clients[key]
+	}
+	if b == nil {
+		b = &tokenBucket{tokens: float64(l.cfg.Burst), last: now}
+		l.clients[key] = b
+	}
+	return b
+}
+
+func (l *ingressLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < ingressSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.clients {
+		if b.untilFull(l.cfg.Rate, l.cfg.Burst) <= now.Sub(b.last) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.tokens+elapsed.Seconds()*rate, float64(burst))
+		b.last = now
+	}
+}
+
+// wait returns how long until the bucket has a token again.
+func (b *tokenBucket) wait(rate float64) time.Duration {
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+func (b *tokenBucket) untilFull(rate float64, burst int) time.Duration {
+	return time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second))
+}
+
+// seconds rounds d up to whole seconds, the unit of the Retry-After and X-RateLimit-Reset headers.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
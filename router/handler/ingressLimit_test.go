@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIngressLimiter(t *testing.T) {
+	type call struct {
+		remoteAddr string
+		key        string
+		after      time.Duration
+		wantStatus int
+	}
+	tests := map[string]struct {
+		cfg   IngressLimitConfig
+		calls []call
+	}{
+		"per client ip": {
+			cfg: IngressLimitConfig{Rate: 1, Burst: 2},
+			calls: []call{
+				{remoteAddr: "10.0.0.1:1000", wantStatus: http.StatusOK},
+				{remoteAddr: "10.0.0.1:1001", wantStatus: http.StatusOK},
+				{remoteAddr: "10.0.0.1:1002", wantStatus: http.StatusTooManyRequests},
+				{remoteAddr: "10.0.0.2:1000", wantStatus: http.StatusOK},
+				{remoteAddr: "10.0.0.1:1003", after: time.Second, wantStatus: http.StatusOK},
+				{remoteAddr: "10.0.0.1:1004", wantStatus: http.StatusTooManyRequests},
+			},
+		},
+		"per api key": {
+			cfg: IngressLimitConfig{Rate: 1, Key: IngressKeyAPIKey},
+			calls: []call{
+				{remoteAddr: "10.0.0.1:1000", key: "alice", wantStatus: http.StatusOK},
+				{remoteAddr: "10.0.0.2:1000", key: "bob", wantStatus: http.StatusOK},
+				{remoteAddr: "10.0.0.3:1000", key: "alice", wantStatus: http.StatusTooManyRequests},
+				// no key, the IP has a bucket of its own
+				{remoteAddr: "10.0.0.3:1000", wantStatus: http.StatusOK},
+			},
+		},
+		"api key and ip both limited": {
+			cfg: IngressLimitConfig{Rate: 1, Key: IngressKeyAPIKey},
+			calls: []call{
+				{remoteAddr: "10.0.0.1:1000", key: "alice", wantStatus: http.StatusOK},
+				// another key every time doesn't get around the limit of the IP
+				{remoteAddr: "10.0.0.1:1000", key: "bob", wantStatus: http.StatusTooManyRequests},
+				{remoteAddr: "10.0.0.1:1000", wantStatus: http.StatusTooManyRequests},
+				{remoteAddr: "10.0.0.1:1000", key: "carol", after: time.Second, wantStatus: http.StatusOK},
+			},
+		},
+		"global": {
+			cfg: IngressLimitConfig{Rate: 10, GlobalRate: 2},
+			calls: []call{
+				{remoteAddr: "10.0.0.1:1000", wantStatus: http.StatusOK},
+				{remoteAddr: "10.0.0.2:1000", wantStatus: http.StatusOK},
+				{remoteAddr: "10.0.0.3:1000", wantStatus: http.StatusTooManyRequests},
+				{remoteAddr: "10.0.0.3:1000", after: 500 * time.Millisecond, wantStatus: http.StatusOK},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			l := newIngressLimiter(&test.cfg)
+			now := time.Now()
+			l.now = func() time.Time { return now }
+			for i, c := range test.calls {
+				now = now.Add(c.after)
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = c.remoteAddr
+				if c.key != "" {
+					req.Header.Set(DefaultAPIKeyHeader, c.key)
+				}
+				res := httptest.NewRecorder()
+				if l.allow(res, req) {
+					res.WriteHeader(http.StatusOK)
+				}
+				if res.Code != c.wantStatus {
+					t.Fatalf("call %d: got status %d want %d", i, res.Code, c.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestIngressLimiterMaxClients(t *testing.T) {
+	l := newIngressLimiter(&IngressLimitConfig{Rate: 1})
+	l.maxClients = 2
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	tests := []struct {
+		remoteAddr string
+		after      time.Duration
+		wantStatus int
+	}{
+		{remoteAddr: "10.0.0.1:1000", wantStatus: http.StatusOK},
+		{remoteAddr: "10.0.0.2:1000", wantStatus: http.StatusOK},
+		// the clients past the cap share a bucket
+		{remoteAddr: "10.0.0.3:1000", wantStatus: http.StatusOK},
+		{remoteAddr: "10.0.0.4:1000", wantStatus: http.StatusTooManyRequests},
+		// the sweep makes room again
+		{remoteAddr: "10.0.0.4:1000", after: ingressSweepInterval, wantStatus: http.StatusOK},
+		{remoteAddr: "10.0.0.3:1000", wantStatus: http.StatusOK},
+	}
+	for i, test := range tests {
+		now = now.Add(test.after)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		res := httptest.NewRecorder()
+		if l.allow(res, req) {
+			res.WriteHeader(http.StatusOK)
+		}
+		if res.Code != test.wantStatus {
+			t.Fatalf("call %d: got status %d want %d", i, res.Code, test.wantStatus)
+		}
+		if len(l.clients) > l.maxClients+1 {
+			t.Fatalf("call %d: got %d buckets", i, len(l.clients))
+		}
+	}
+}
+
+func TestIngressLimitHeaders(t *testing.T) {
+	l := newIngressLimiter(&IngressLimitConfig{Rate: 0.5, Burst: 2})
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	tests := []struct {
+		wantStatus     int
+		wantRemaining  string
+		wantReset      string
+		wantRetryAfter string
+	}{
+		{wantStatus: http.StatusOK, wantRemaining: "1", wantReset: "2"},
+		{wantStatus: http.StatusOK, wantRemaining: "0", wantReset: "4"},
+		{wantStatus: http.StatusTooManyRequests, wantRemaining: "0", wantReset: "4", wantRetryAfter: "2"},
+	}
+	for i, test := range tests {
+		res := httptest.NewRecorder()
+		if l.allow(res, httptest.NewRequest(http.MethodGet, "/", nil)) {
+			res.WriteHeader(http.StatusOK)
+		}
+		h := res.Header()
+		if res.Code != test.wantStatus || h.Get("X-RateLimit-Limit") != "2" || h.Get("X-RateLimit-Remaining") != test.wantRemaining ||
+			h.Get("X-RateLimit-Reset") != test.wantReset || h.Get("Retry-After") != test.wantRetryAfter {
+			t.Fatalf("call %d: got status %d and headers %v", i, res.Code, h)
+		}
+	}
+}
+
+func TestRouterIngressLimit(t *testing.T) {
+	pools := newTestGroup(t)
+	for _, name := range []string{"", "payments"} {
+		_, registrar := pools.Pool(name)
+		registrar.RegisterClient(backendAddr(t, http.StatusOK), 1)
+	}
+	router := NewRouter(&RouterConfig{
+		IngressLimit: IngressLimitConfig{Rate: 1},
+		Routes: []Route{
+			{Pool: "payments", PathPrefix: "/pay", IngressLimit: &IngressLimitConfig{Rate: 100, Burst: 3}},
+			{Pool: "payments", PathPrefix: "/refund"},
+		},
+	}, pools)
+
+	// in order, the requests of one case count against the buckets of the next
+	tests := []struct {
+		name      string
+		target    string
+		wantCodes []int
+	}{
+		{name: "router limit", target: "/json", wantCodes: []int{http.StatusOK, http.StatusTooManyRequests}},
+		{name: "route limit", target: "/pay/card", wantCodes: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests}},
+		{name: "route sharing the router limit", target: "/refund", wantCodes: []int{http.StatusTooManyRequests}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i, want := range test.wantCodes {
+				res := httptest.NewRecorder()
+				router.handle(res, httptest.NewRequest(http.MethodGet, test.target, nil))
+				if res.Code != want {
+					t.Fatalf("call %d: got status %d want %d", i, res.Code, want)
+				}
+			}
+		})
+	}
+}
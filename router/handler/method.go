@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// AnyMethod is the policy of the methods without one.
+const AnyMethod = "*"
+
+// MethodPolicy is how the router treats the requests of one HTTP method.
+type MethodPolicy struct {
+	// Retryable requests can be sent to another backend, see RetryConfig.
+	Retryable bool
+	// DialRetryOnly only retries when no backend was reached, for methods that aren't idempotent.
+	DialRetryOnly bool
+	// Hedged requests get a copy sent to another backend, see HedgeConfig.
+	Hedged bool
+}
+
+// DefaultMethodPolicies proxies all methods, and retries the idempotent ones. POST only on dial errors.
+func DefaultMethodPolicies() map[string]MethodPolicy {
+	return map[string]MethodPolicy{
+		AnyMethod:          {},
+		http.MethodGet:     {Retryable: true},
+		http.MethodHead:    {Retryable: true},
+		http.MethodOptions: {Retryable: true},
+		http.MethodPut:     {Retryable: true},
+		http.MethodDelete:  {Retryable: true},
+		http.MethodPost:    {Retryable: true, DialRetryOnly: true},
+	}
+}
+
+// methodPolicy returns the policy for method, false when the method isn't proxied.
+func methodPolicy(policies map[string]MethodPolicy, method string) (MethodPolicy, bool) {
+	if policy, ok := policies[method]; ok {
+		return policy, true
+	}
+	policy, ok := policies[AnyMethod]
+	return policy, ok
+}
+
+// allowedMethods lists the proxied methods for the Allow header.
+func allowedMethods(policies map[string]MethodPolicy) string {
+	var res []string
+	for method := range policies {
+		if method != AnyMethod {
+			res = append(res, method)
+		}
+	}
+	slices.Sort(res)
+	return strings.Join(res, ", ")
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouterMethods(t *testing.T) {
+	retry := RetryConfig{MaxRetries: 1, MaxBodySize: 1024, Statuses: []int{http.StatusServiceUnavailable}, BudgetMinPerSecond: 10}
+
+	tests := map[string]struct {
+		methods    map[string]MethodPolicy
+		method     string
+		wantStatus int
+		wantAllow  string
+	}{
+		"get proxied by default": {
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+		},
+		"unknown method proxied by default, not retried": {
+			method:     "PROPFIND",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		"patch not retried by default": {
+			method:     http.MethodPatch,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		"post not retried on status by default": {
+			method:     http.MethodPost,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		"post retried on status when configured": {
+			methods:    map[string]MethodPolicy{http.MethodPost: {Retryable: true}},
+			method:     http.MethodPost,
+			wantStatus: http.StatusOK,
+		},
+		"method not proxied": {
+			methods:    map[string]MethodPolicy{http.MethodGet: {Retryable: true}, http.MethodHead: {}},
+			method:     http.MethodPost,
+			wantStatus: http.StatusMethodNotAllowed,
+			wantAllow:  "GET, HEAD",
+		},
+		"method not retryable": {
+			methods:    map[string]MethodPolicy{http.MethodPost: {}},
+			method:     http.MethodPost,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		"any method retryable": {
+			methods:    map[string]MethodPolicy{AnyMethod: {Retryable: true}},
+			method:     http.MethodPatch,
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pools := newTestGroup(t)
+			_, registrar := pools.Pool("")
+			registrar.RegisterClient(backendAddr(t, http.StatusServiceUnavailable), 1)
+			registrar.RegisterClient(backendAddr(t, http.StatusOK), 1)
+			router := NewRouter(&RouterConfig{Retry: retry, Methods: test.methods}, pools)
+
+			res := httptest.NewRecorder()
+			router.mux.ServeHTTP(res, httptest.NewRequest(test.method, "/items/1", nil))
+			if res.Code != test.wantStatus {
+				t.Fatalf("got status %d want %d", res.Code, test.wantStatus)
+			}
+			if got := res.Header().Get("Allow"); got != test.wantAllow {
+				t.Fatalf("got Allow %q want %q", got, test.wantAllow)
+			}
+		})
+	}
+}
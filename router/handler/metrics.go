@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"mrbarrel/lib/metrics"
+	"mrbarrel/router/pool"
+	"net/http"
+	"strconv"
+)
+
+var (
+	stages        = []string{"OK", "SLOW", "DEAD"}
+	breakerStates = []string{"CLOSED", "OPEN", "HALF_OPEN"}
+)
+
+// otherMethod is the label of the methods that aren't standard.
+const otherMethod = "OTHER"
+
+type routerMetrics struct {
+	requests       *metrics.CounterVec
+	latency        *metrics.HistogramVec
+	hedges         *metrics.CounterVec
+	ingressLimited *metrics.CounterVec
+}
+
+func newRouterMetrics(reg *metrics.Registry) *routerMetrics {
+	return &routerMetrics{
+		requests:       reg.NewCounterVec("router_requests_total", "Number of requests handled by the router.", "method", "code"),
+		latency:        reg.NewHistogramVec("router_request_duration_seconds", "Time spent handling requests, including retries.", metrics.DefaultBuckets, "method"),
+		hedges:         reg.NewCounterVec("router_hedged_requests_total", "Number of requests sent twice, by the call that answered first.", "winner"),
+		ingressLimited: reg.NewCounterVec("router_ingress_limited_requests_total", "Number of requests answered with a 429 by the ingress limit.", "pool"),
+	}
+}
+
+// methodLabel is the method as label of the request metrics.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+		http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return otherMethod
+}
+
+// namedStatus is the status of a Forwarder along with the name of its pool.
+type namedStatus struct {
+	pool string
+	pool.ForwarderStatus
+}
+
+func poolStatuses(pools *pool.Group) []namedStatus {
+	var res []namedStatus
+	for _, name := range pools.Names() {
+		clients, _, ok := pools.Lookup(name)
+		if !ok {
+			continue
+		}
+		for _, s := range clients.Statuses() {
+			res = append(res, namedStatus{pool: name, ForwarderStatus: s})
+		}
+	}
+	return res
+}
+
+// registerPoolMetrics exposes the state of the pools, read every time the metrics are scraped.
+func registerPoolMetrics(reg *metrics.Registry, pools *pool.Group) {
+	reg.NewCollector("router_pool_size", "Number of backends per pool.", metrics.Gauge, func() []metrics.Sample {
+		var res []metrics.Sample
+		for _, name := range pools.Names() {
+			if clients, _, ok := pools.Lookup(name); ok {
+				res = append(res, metrics.Sample{LabelValues: []string{name}, Value: float64(len(clients.Statuses()))})
+			}
+		}
+		return res
+	}, "pool")
+	reg.NewCollector("router_backend_responses_total", "Number of responses per backend and status code, 502 includes calls without response.", metrics.Counter, func() []metrics.Sample {
+		var res []metrics.Sample
+		for _, s := range poolStatuses(pools) {
+			for code, count := range s.StatusCodes {
+				res = append(res, metrics.Sample{LabelValues: []string{s.pool, s.Addr, strconv.Itoa(code)}, Value: float64(count)})
+			}
+		}
+		return res
+	}, "pool", "backend", "code")
+	reg.NewCollector("router_backend_stage", "Rate limiter stage per backend, 1 for the current stage.", metrics.Gauge, func() []metrics.Sample {
+		var res []metrics.Sample
+		for _, s := range poolStatuses(pools) {
+			for _, stage := range stages {
+				res = append(res, metrics.Sample{LabelValues: []string{s.pool, s.Addr, stage}, Value: boolValue(s.Stage == stage)})
+			}
+		}
+		return res
+	}, "pool", "backend", "stage")
+	reg.NewCollector("router_backend_wait_seconds", "Rate limiter wait time between calls per backend.", metrics.Gauge, func() []metrics.Sample {
+		var res []metrics.Sample
+		for _, s := range poolStatuses(pools) {
+			res = append(res, metrics.Sample{LabelValues: []string{s.pool, s.Addr}, Value: s.WaitTime.Seconds()})
+		}
+		return res
+	}, "pool", "backend")
+	reg.NewCollector("router_backend_score", "Rate limiter score per backend, the share of fast calls (0-1).", metrics.Gauge, func() []metrics.Sample {
+		var res []metrics.Sample
+		for _, s := range poolStatuses(pools) {
+			res = append(res, metrics.Sample{LabelValues: []string{s.pool, s.Addr}, Value: s.Score})
+		}
+		return res
+	}, "pool", "backend")
+	reg.NewCollector("router_backend_in_flight", "Requests currently in flight per backend.", metrics.Gauge, func() []metrics.Sample {
+		var res []metrics.Sample
+		for _, s := range poolStatuses(pools) {
+			res = append(res, metrics.Sample{LabelValues: []string{s.pool, s.Addr}, Value: float64(s.InFlight)})
+		}
+		return res
+	}, "pool", "backend")
+	reg.NewCollector("router_backend_concurrency_limit", "Adaptive limit of the requests in flight per backend, 0 when not limited.", metrics.Gauge, func() []metrics.Sample {
+		var res []metrics.Sample
+		for _, s := range poolStatuses(pools) {
+			res = append(res, metrics.Sample{LabelValues: []string{s.pool, s.Addr}, Value: float64(s.ConcurrencyLimit)})
+		}
+		return res
+	}, "pool", "backend")
+	reg.NewCollector("router_backend_healthy", "Outcome of the active health checks per backend.", metrics.Gauge, func() []metrics.Sample {
+		var res []metrics.Sample
+		for _, s := range poolStatuses(pools) {
+			res = append(res, metrics.Sample{LabelValues: []string{s.pool, s.Addr}, Value: boolValue(s.Healthy)})
+		}
+		return res
+	}, "pool", "backend")
+	reg.NewCollector("router_backend_breaker_state", "Circuit breaker state per backend, 1 for the current state.", metrics.Gauge, func() []metrics.Sample {
+		var res []metrics.Sample
+		for _, s := range poolStatuses(pools) {
+			for _, state := range breakerStates {
+				res = append(res, metrics.Sample{LabelValues: []string{s.pool, s.Addr, state}, Value: boolValue(s.Breaker == state)})
+			}
+		}
+		return res
+	}, "pool", "backend", "state")
+	reg.NewCollector("router_backend_connections_total", "Number of calls per backend that opened a new connection or reused an idle one.", metrics.Counter, func() []metrics.Sample {
+		var res []metrics.Sample
+		for _, s := range poolStatuses(pools) {
+			res = append(res,
+				metrics.Sample{LabelValues: []string{s.pool, s.Addr, "false"}, Value: float64(s.ConnsNew)},
+				metrics.Sample{LabelValues: []string{s.pool, s.Addr, "true"}, Value: float64(s.ConnsReused)},
+			)
+		}
+		return res
+	}, "pool", "backend", "reused")
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"mrbarrel/lib/metrics"
+	"mrbarrel/router/pool"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouterMetrics(t *testing.T) {
+	pools := newTestGroup(t)
+	_, registrar := pools.Pool(pool.DefaultPool)
+	okAddr := backendAddr(t, http.StatusOK)
+	failAddr := backendAddr(t, http.StatusInternalServerError)
+	registrar.RegisterClient(okAddr, 1)
+	registrar.RegisterClient(failAddr, 1)
+
+	registry := metrics.NewRegistry()
+	router := NewRouter(&RouterConfig{Metrics: registry}, pools)
+	for i := 0; i < 4; i++ {
+		router.handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/json", strings.NewReader(`{"foo":123}`)))
+	}
+
+	admin := NewAdminHandler(&AdminHandlerConfig{}, registry, pools)
+	res := httptest.NewRecorder()
+	admin.mux.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d want %d", res.Code, http.StatusOK)
+	}
+
+	body := res.Body.String()
+	wantLines := []string{
+		`router_requests_total{method="POST",code="200"} 2`,
+		`router_requests_total{method="POST",code="500"} 2`,
+		`router_request_duration_seconds_count{method="POST"} 4`,
+		`router_pool_size{pool="default"} 2`,
+		`router_backend_responses_total{pool="default",backend="` + okAddr + `",code="200"} 2`,
+		`router_backend_responses_total{pool="default",backend="` + failAddr + `",code="500"} 2`,
+		`router_backend_stage{pool="default",backend="` + okAddr + `",stage="OK"} 1`,
+		`router_backend_stage{pool="default",backend="` + okAddr + `",stage="DEAD"} 0`,
+		`router_backend_wait_seconds{pool="default",backend="` + okAddr + `"} 0`,
+		`router_backend_breaker_state{pool="default",backend="` + okAddr + `",state="CLOSED"} 1`,
+		`router_backend_connections_total{pool="default",backend="` + okAddr + `",reused="false"} 1`,
+		`router_backend_connections_total{pool="default",backend="` + okAddr + `",reused="true"} 1`,
+	}
+	for _, line := range wantLines {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestMethodLabel(t *testing.T) {
+	tests := map[string]struct {
+		method string
+		want   string
+	}{
+		"standard":  {method: http.MethodDelete, want: http.MethodDelete},
+		"unknown":   {method: "PURGE", want: otherMethod},
+		"lowercase": {method: "get", want: otherMethod},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := methodLabel(test.method); got != test.want {
+				t.Fatalf("got label %q want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// httpsRedirect redirects to the same URL over HTTPS, on the port of httpsAddr.
+func httpsRedirect(httpsAddr string) http.HandlerFunc {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			// an IPv6 address without a port still needs its brackets
+			host = "[" + host + "]"
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: req.URL.RawQuery}
+		http.Redirect(w, req, target.String(), http.StatusPermanentRedirect)
+	}
+}
@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := map[string]struct {
+		httpsAddr string
+		url       string
+		want      string
+	}{
+		"default port":      {httpsAddr: ":443", url: "http://shop.example.com/cart?id=1", want: "https://shop.example.com/cart?id=1"},
+		"other port":        {httpsAddr: ":8443", url: "http://shop.example.com:8080/cart", want: "https://shop.example.com:8443/cart"},
+		"no port in addr":   {httpsAddr: "", url: "http://shop.example.com:8080/", want: "https://shop.example.com/"},
+		"ipv6":              {httpsAddr: ":443", url: "http://[::1]:8080/", want: "https://[::1]/"},
+		"ipv6 other port":   {httpsAddr: ":8443", url: "http://[::1]/", want: "https://[::1]:8443/"},
+		"escaped path kept": {httpsAddr: ":443", url: "http://shop.example.com/a%2Fb", want: "https://shop.example.com/a%2Fb"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			httpsRedirect(test.httpsAddr)(rec, httptest.NewRequest(http.MethodPost, test.url, nil))
+			if rec.Code != http.StatusPermanentRedirect {
+				t.Fatalf("got status %d, want %d", rec.Code, http.StatusPermanentRedirect)
+			}
+			if got := rec.Header().Get("Location"); got != test.want {
+				t.Fatalf("got location %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -1,74 +1,229 @@
 package handler
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"mrbarrel/lib/logging"
+	"mrbarrel/lib/registration"
+	"mrbarrel/lib/tlsconfig"
 	"mrbarrel/router/pool"
 	"net/http"
+	"os"
 	"time"
 )
 
+// registrations are a few fields of JSON, anything much larger isn't one.
+const maxRegistrationSize = 64 << 10
+
+var errBackendNotAllowed = errors.New("not an allowed backend")
+
+var registryLog = logging.Logger(logging.Registry)
+
 type RegistryHandlerConfig struct {
 	ListenAddr string
+	// AllowedBackends are CIDRs and domains clients can register, any when empty.
+	AllowedBackends []string
+	// Secret signs the requests when set, see registration.Sign.
+	Secret string
+	// MaxClockSkew is how old a signed request may be, defaults to registration.DefaultMaxSkew.
+	MaxClockSkew time.Duration
+	// TLS serves the registry over HTTPS, mutual TLS when it has CAs.
+	TLS tlsconfig.Config
+}
+
+// Validate checks the allowed backends, so a config fails before the handler is created.
+func (cfg *RegistryHandlerConfig) Validate() error {
+	_, err := parseAllowList(cfg.AllowedBackends)
+	return err
 }
 
 type RegistryHandler struct {
 	registerListenAddr string
+	tls                tlsconfig.Config
 	mux                *http.ServeMux
-	clientRegistrar    pool.ClientRegistrar
+	pools              *pool.Group
+	allowed            *allowList
+	// verifier is nil when requests don't need to be signed.
+	verifier *registration.Verifier
 }
 
-func NewRegistryHandler(cfg *RegistryHandlerConfig, cp pool.ClientRegistrar) *RegistryHandler {
+func NewRegistryHandler(cfg *RegistryHandlerConfig, pools *pool.Group) (*RegistryHandler, error) {
+	allowed, err := parseAllowList(cfg.AllowedBackends)
+	if err != nil {
+		return nil, err
+	}
 	ph := &RegistryHandler{
 		registerListenAddr: cfg.ListenAddr,
+		tls:                cfg.TLS,
 		mux:                http.NewServeMux(),
-		clientRegistrar:    cp,
+		pools:              pools,
+		allowed:            allowed,
+	}
+	if cfg.Secret != "" {
+		ph.verifier = registration.NewVerifier([]byte(cfg.Secret), cfg.MaxClockSkew)
 	}
 
 	ph.mux.HandleFunc(fmt.Sprintf("%s /", http.MethodPost), ph.registerClient)
 	ph.mux.HandleFunc(fmt.Sprintf("%s /", http.MethodDelete), ph.deRegisterClient)
-	return ph
+	ph.mux.HandleFunc(fmt.Sprintf("%s /drain", http.MethodPost), ph.drainClient)
+	ph.mux.HandleFunc(fmt.Sprintf("%s /drain", http.MethodGet), ph.drainStatus)
+	return ph, nil
 }
 
 func (ph *RegistryHandler) ListenForClients(ctx context.Context) error {
-	server := &http.Server{Addr: ph.registerListenAddr, Handler: ph.mux}
+	server := &http.Server{Addr: ph.registerListenAddr, Handler: http.HandlerFunc(ph.authenticate)}
 
 	// listen for context to stop server gracefully
 	go func() {
 		<-ctx.Done()
-		log.Printf("Gracefully sutting down client listener...")
+		registryLog.Info("gracefully shutting down client listener")
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		if err := server.Shutdown(ctx); err != nil {
-			log.Fatalf("Clietn listener shutdown Failed: %v", err)
+			registryLog.Error("client listener shutdown failed", "error", err)
+			os.Exit(1)
 		}
 	}()
 
-	return server.ListenAndServe()
+	return serve(server, ph.tls)
 }
 
 func (ph *RegistryHandler) registerClient(w http.ResponseWriter, req *http.Request) {
-	bytes, err := io.ReadAll(req.Body)
+	reg, ok := ph.readRegistration(w, req)
+	if !ok {
+		return
+	}
+	clientRegistrar, ok := ph.pools.Registrar(reg.Pool)
+	if !ok {
+		registryLog.Warn("refused registration to a pool that isn't configured", "remote_addr", req.RemoteAddr,
+			logging.BackendKey, reg.Addr, "pool", reg.Pool)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	clientRegistrar.RegisterClient(reg.Addr, reg.Weight)
+	if reg.Draining {
+		_ = clientRegistrar.DrainClient(reg.Addr)
+	}
+}
+
+func (ph *RegistryHandler) deRegisterClient(w http.ResponseWriter, req *http.Request) {
+	reg, ok := ph.readRegistration(w, req)
+	if !ok {
+		return
+	}
+	if _, clientRegistrar, ok := ph.pools.Lookup(reg.Pool); ok {
+		clientRegistrar.DeRegisterClient(reg.Addr)
+	}
+}
+
+// drainClient stops new traffic going to the client, drainStatus tells when it's done.
+func (ph *RegistryHandler) drainClient(w http.ResponseWriter, req *http.Request) {
+	reg, ok := ph.readRegistration(w, req)
+	if !ok {
+		return
+	}
+
+	_, clientRegistrar, ok := ph.pools.Lookup(reg.Pool)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	err := clientRegistrar.DrainClient(reg.Addr)
+	if errors.Is(err, pool.ErrUnknownClient) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	// TODO: internal call, but what about validation? Just host/port valdiation? Full URI validation?
-
-	addr := string(bytes)
-	ph.clientRegistrar.RegisterClient(addr)
+	w.WriteHeader(http.StatusAccepted)
 }
 
-func (ph *RegistryHandler) deRegisterClient(w http.ResponseWriter, req *http.Request) {
-	bytes, err := io.ReadAll(req.Body)
+func (ph *RegistryHandler) drainStatus(w http.ResponseWriter, req *http.Request) {
+	addr := req.URL.Query().Get("addr")
+	_, clientRegistrar, ok := ph.pools.Lookup(req.URL.Query().Get("pool"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	status, err := clientRegistrar.ClientStatus(addr)
+	if errors.Is(err, pool.ErrUnknownClient) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	// TODO: internal call, but what about validation? Just host/port valdiation? Full URI validation?
 
-	addr := string(bytes)
-	ph.clientRegistrar.DeRegisterClient(addr)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&registration.DrainStatus{
+		Addr:     addr,
+		Drained:  status.State == pool.StateDraining && status.InFlight == 0,
+		InFlight: status.InFlight,
+	})
+	if err != nil {
+		registryLog.Error("while writing drain status", "error", err)
+	}
+}
+
+// authenticate lets only the requests signed with the secret through, when there is one.
+func (ph *RegistryHandler) authenticate(w http.ResponseWriter, req *http.Request) {
+	if ph.verifier == nil {
+		ph.mux.ServeHTTP(w, req)
+		return
+	}
+	body, ok := readBody(w, req)
+	if !ok {
+		return
+	}
+	if err := ph.verifier.Verify(req, body); err != nil {
+		registryLog.Warn("refused registry call", "remote_addr", req.RemoteAddr, "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	ph.mux.ServeHTTP(w, req)
+}
+
+// readRegistration parses the request body, the response is written when it returns false.
+func (ph *RegistryHandler) readRegistration(w http.ResponseWriter, req *http.Request) (*registration.Registration, bool) {
+	body, ok := readBody(w, req)
+	if !ok {
+		return nil, false
+	}
+
+	reg, err := registration.Parse(body)
+	if err == nil {
+		reg.Addr, err = checkBackendAddr(reg.Addr, ph.allowed)
+	}
+	if err != nil {
+		registryLog.Warn("invalid registration", "remote_addr", req.RemoteAddr, "error", err)
+		if errors.Is(err, errBackendNotAllowed) {
+			w.WriteHeader(http.StatusForbidden)
+			return nil, false
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	return reg, true
+}
+
+func readBody(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxRegistrationSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	return body, true
 }
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// allowList holds the networks and domains backends can register, domains aren't resolved.
+type allowList struct {
+	networks []*net.IPNet
+	domains  []string
+}
+
+// parseAllowList reads CIDRs and domains like route hosts, nil for an empty list.
+func parseAllowList(entries []string) (*allowList, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	al := &allowList{}
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if strings.Contains(e, "/") {
+			_, network, err := net.ParseCIDR(e)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q: %w", e, err)
+			}
+			al.networks = append(al.networks, network)
+			continue
+		}
+		if e == "" || strings.ContainsAny(e, ": ") {
+			return nil, fmt.Errorf("invalid domain %q", e)
+		}
+		al.domains = append(al.domains, e)
+	}
+	return al, nil
+}
+
+func (al *allowList) allows(host string) bool {
+	if al == nil {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range al.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, domain := range al.domains {
+		if matchHost(domain, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBackendAddr checks addr is a host:port with an optional scheme, only https:// is kept.
+func checkBackendAddr(addr string, allowed *allowList) (string, error) {
+	prefix := ""
+	if scheme, rest, ok := strings.Cut(addr, "://"); ok {
+		switch scheme {
+		case "http":
+		case "https":
+			prefix = "https://"
+		default:
+			return "", fmt.Errorf("scheme %q isn't supported", scheme)
+		}
+		addr = rest
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	if host == "" {
+		return "", fmt.Errorf("%q has no host", addr)
+	}
+	// anything that doesn't survive being the host of a URL, like paths, user info or spaces
+	if u, err := url.Parse("http://" + addr); err != nil || u.Host != addr || u.Path != "" || u.RawQuery != "" {
+		return "", fmt.Errorf("%q is not a host:port", addr)
+	}
+	if !allowed.allows(host) {
+		return "", fmt.Errorf("%s: %w", host, errBackendNotAllowed)
+	}
+	return prefix + addr, nil
+}
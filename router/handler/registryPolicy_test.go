@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"bytes"
+	"mrbarrel/lib/registration"
+	"mrbarrel/router/pool"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckBackendAddr(t *testing.T) {
+	allowed, err := parseAllowList([]string{"10.0.0.0/8", "fd00::/8", "*.svc.local", "legacy.example.com"})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+
+	tests := map[string]struct {
+		addr       string
+		allowed    *allowList
+		want       string
+		wantErr    bool
+		notAllowed bool
+	}{
+		"host and port":           {addr: "purple:8080", want: "purple:8080"},
+		"http scheme":             {addr: "http://purple:8080", want: "purple:8080"},
+		"https scheme":            {addr: "https://purple:8443", want: "https://purple:8443"},
+		"https other network":     {addr: "https://192.168.1.1:443", allowed: allowed, wantErr: true, notAllowed: true},
+		"other scheme":            {addr: "ftp://purple:21", wantErr: true},
+		"no port":                 {addr: "purple", wantErr: true},
+		"port out of range":       {addr: "purple:70000", wantErr: true},
+		"no host":                 {addr: ":8080", wantErr: true},
+		"path":                    {addr: "http://purple:8080/admin", wantErr: true},
+		"user info":               {addr: "me@purple:8080", wantErr: true},
+		"allowed network":         {addr: "10.1.2.3:80", allowed: allowed, want: "10.1.2.3:80"},
+		"allowed ipv6 network":    {addr: "[fd00::1]:80", allowed: allowed, want: "[fd00::1]:80"},
+		"other network":           {addr: "192.168.1.1:80", allowed: allowed, wantErr: true, notAllowed: true},
+		"allowed wildcard domain": {addr: "api.svc.local:80", allowed: allowed, want: "api.svc.local:80"},
+		"allowed exact domain":    {addr: "legacy.example.com:80", allowed: allowed, want: "legacy.example.com:80"},
+		"other domain":            {addr: "evil.example.com:80", allowed: allowed, wantErr: true, notAllowed: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := checkBackendAddr(test.addr, test.allowed)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error but got %s", got)
+				}
+				if notAllowed := strings.Contains(err.Error(), errBackendNotAllowed.Error()); notAllowed != test.notAllowed {
+					t.Fatalf("got error %v, want not allowed %v", err, test.notAllowed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			if got != test.want {
+				t.Fatalf("got %s want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseAllowList(t *testing.T) {
+	for _, entries := range [][]string{{"10.0.0.0/33"}, {"purple:80"}, {""}} {
+		if _, err := parseAllowList(entries); err == nil {
+			t.Fatalf("expected error for %v", entries)
+		}
+	}
+}
+
+func TestRegistryAuth(t *testing.T) {
+	pools, err := pool.NewGroup(&pool.PoolConfig{MaxAgeNoNotif: time.Hour, SlowThreshold: time.Second})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	ph, err := NewRegistryHandler(&RegistryHandlerConfig{Secret: "s3cret", AllowedBackends: []string{"*.svc.local"}}, pools)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+
+	signed := func(body string, secret string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(body)))
+		registration.Sign(req, []byte(body), []byte(secret))
+		return req
+	}
+	replayed := signed(`{"addr":"green.svc.local:80"}`, "s3cret")
+	ph.authenticate(httptest.NewRecorder(), replayed)
+	replayed.Body = http.NoBody
+
+	tests := map[string]struct {
+		req        *http.Request
+		wantStatus int
+	}{
+		"signed":       {req: signed(`{"addr":"purple.svc.local:80"}`, "s3cret"), wantStatus: http.StatusOK},
+		"unsigned":     {req: httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"addr":"yellow.svc.local:80"}`)), wantStatus: http.StatusUnauthorized},
+		"wrong secret": {req: signed(`{"addr":"yellow.svc.local:80"}`, "guess"), wantStatus: http.StatusUnauthorized},
+		"replayed":     {req: replayed, wantStatus: http.StatusUnauthorized},
+		"not allowed":  {req: signed(`{"addr":"evil.example.com:80"}`, "s3cret"), wantStatus: http.StatusForbidden},
+		"invalid":      {req: signed(`{"addr":"yellow.svc.local"}`, "s3cret"), wantStatus: http.StatusBadRequest},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			res := httptest.NewRecorder()
+			ph.authenticate(res, test.req)
+			if res.Code != test.wantStatus {
+				t.Fatalf("got status %d want %d", res.Code, test.wantStatus)
+			}
+		})
+	}
+
+	clients, _ := pools.Pool("")
+	var got []string
+	for _, s := range clients.Statuses() {
+		got = append(got, s.Addr)
+	}
+	if len(got) != 2 || got[0] != "green.svc.local:80" || got[1] != "purple.svc.local:80" {
+		t.Fatalf("got clients %v, want only the signed ones", got)
+	}
+}
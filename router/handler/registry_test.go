@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"encoding/json"
+	"mrbarrel/lib/registration"
+	"mrbarrel/router/pool"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryDrain(t *testing.T) {
+	pools, err := pool.NewGroup(&pool.PoolConfig{MaxAgeNoNotif: time.Hour, SlowThreshold: time.Second})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	pools.SetPools([]string{"payments"})
+	ph, err := NewRegistryHandler(&RegistryHandlerConfig{}, pools)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+
+	for _, body := range []string{`{"addr":"purple:80","weight":2}`, `{"addr":"yellow:80","pool":"payments"}`} {
+		res := httptest.NewRecorder()
+		ph.mux.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		if res.Code != http.StatusOK {
+			t.Fatalf("got status %d want %d", res.Code, http.StatusOK)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		body        string
+		wantStatus  int
+		wantDrained bool
+	}{
+		{name: "status before drain", method: http.MethodGet, path: "/drain?addr=purple:80", wantStatus: http.StatusOK},
+		{name: "drain unknown", method: http.MethodPost, path: "/drain", body: `{"addr":"green:80"}`, wantStatus: http.StatusNotFound},
+		{name: "status unknown", method: http.MethodGet, path: "/drain?addr=green:80", wantStatus: http.StatusNotFound},
+		{name: "drain", method: http.MethodPost, path: "/drain", body: `{"addr":"purple:80"}`, wantStatus: http.StatusAccepted},
+		{name: "status after drain", method: http.MethodGet, path: "/drain?addr=purple:80", wantStatus: http.StatusOK, wantDrained: true},
+		{name: "draining heartbeat", method: http.MethodPost, path: "/", body: `{"addr":"purple:80","draining":true}`, wantStatus: http.StatusOK},
+		{name: "status after draining heartbeat", method: http.MethodGet, path: "/drain?addr=purple:80", wantStatus: http.StatusOK, wantDrained: true},
+		{name: "draining heartbeat of expired", method: http.MethodPost, path: "/", body: `{"addr":"green:80","draining":true}`, wantStatus: http.StatusOK},
+		{name: "status of expired after draining heartbeat", method: http.MethodGet, path: "/drain?addr=green:80", wantStatus: http.StatusOK, wantDrained: true},
+		{name: "invalid payload", method: http.MethodPost, path: "/drain", body: `{"weight":2}`, wantStatus: http.StatusBadRequest},
+		{name: "status in other pool", method: http.MethodGet, path: "/drain?addr=yellow:80&pool=payments", wantStatus: http.StatusOK},
+		{name: "status in wrong pool", method: http.MethodGet, path: "/drain?addr=yellow:80", wantStatus: http.StatusNotFound},
+		{name: "register to unknown pool", method: http.MethodPost, path: "/", body: `{"addr":"green:80","pool":"shop"}`, wantStatus: http.StatusNotFound},
+		{name: "drain in unknown pool", method: http.MethodPost, path: "/drain", body: `{"addr":"yellow:80","pool":"shop"}`, wantStatus: http.StatusNotFound},
+		{name: "drain in other pool", method: http.MethodPost, path: "/drain", body: `{"addr":"yellow:80","pool":"payments"}`, wantStatus: http.StatusAccepted},
+	}
+
+	// steps depend on each other, so no map here
+	for _, test := range tests {
+		res := httptest.NewRecorder()
+		ph.mux.ServeHTTP(res, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+		if res.Code != test.wantStatus {
+			t.Fatalf("%s: got status %d want %d", test.name, res.Code, test.wantStatus)
+		}
+		if test.method != http.MethodGet || res.Code != http.StatusOK {
+			continue
+		}
+		status := &registration.DrainStatus{}
+		if err := json.NewDecoder(res.Body).Decode(status); err != nil {
+			t.Fatalf("%s: got unexpected error: %v", test.name, err)
+		}
+		if status.Drained != test.wantDrained {
+			t.Fatalf("%s: got drained %v want %v", test.name, status.Drained, test.wantDrained)
+		}
+	}
+
+	// a drained client doesn't get any traffic anymore
+	for _, name := range []string{pool.DefaultPool, "payments"} {
+		clients, _ := pools.Pool(name)
+		if f, err := clients.Next(nil); err == nil {
+			t.Fatalf("expected error but got %s", f.Host())
+		}
+	}
+}
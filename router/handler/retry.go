@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the budget remembers roughly this many requests worth of deposits.
+const budgetRequestWindow = 100
+
+type RetryConfig struct {
+	// MaxRetries is the number of times a failed request is sent to another backend.
+	MaxRetries int
+	// MaxBodySize is the largest body buffered for retries.
+	MaxBodySize int64
+	// Statuses are the backend status codes that are retried, on top of dial errors.
+	Statuses []int
+	// BudgetRatio is the share of requests that may be retried.
+	BudgetRatio float64
+	// BudgetMinPerSecond allows this many retries per second anyway.
+	BudgetMinPerSecond float64
+}
+
+// retryBudget keeps retries from amplifying an outage.
+type retryBudget struct {
+	lock         sync.Mutex
+	ratio        float64
+	minPerSecond float64
+	maxTokens    float64
+	tokens       float64
+	lastRefill   time.Time
+	now          func() time.Time
+}
+
+func newRetryBudget(ratio, minPerSecond float64) *retryBudget {
+	maxTokens := minPerSecond + ratio*budgetRequestWindow
+	return &retryBudget{
+		ratio:        ratio,
+		minPerSecond: minPerSecond,
+		maxTokens:    maxTokens,
+		tokens:       minPerSecond,
+		lastRefill:   time.Now(),
+		now:          time.Now,
+	}
+}
+
+func (b *retryBudget) deposit() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	b.tokens = min(b.tokens+b.ratio, b.maxTokens)
+}
+
+// canWithdraw tells whether there's budget left for a retry, without taking it.
+func (b *retryBudget) canWithdraw() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	return b.tokens >= 1
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *retryBudget) refill() {
+	now := b.now()
+	elapsed := now.Sub(b.lastRefill)
+	b.lastRefill = now
+	b.tokens = min(b.tokens+elapsed.Seconds()*b.minPerSecond, b.maxTokens)
+}
+
+// bufferBody reads the request body to replay it, false when it's larger than maxSize.
+func bufferBody(req *http.Request, maxSize int64) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if req.ContentLength > maxSize {
+		return nil, false, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(req.Body, maxSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(buf)) > maxSize {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return nil, false, nil
+	}
+	_ = req.Body.Close()
+	return buf, true, nil
+}
+
+// withBody returns a copy of req reading from body, leaving req itself usable for the next attempt.
+func withBody(req *http.Request, body []byte) *http.Request {
+	attempt := req.Clone(req.Context())
+	if body == nil {
+		attempt.Body = http.NoBody
+		return attempt
+	}
+	attempt.Body = io.NopCloser(bytes.NewReader(body))
+	attempt.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return attempt
+}
@@ -0,0 +1,222 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"mrbarrel/router/pool"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Now()
+	b := newRetryBudget(0.5, 1)
+	b.now = func() time.Time { return now }
+	b.lastRefill = now
+
+	// starts out with the min per second
+	if !b.withdraw() {
+		t.Fatalf("expected initial token")
+	}
+	if b.withdraw() {
+		t.Fatalf("expected budget to be empty")
+	}
+
+	// 2 requests at 0.5 buy a retry
+	b.deposit()
+	if b.canWithdraw() {
+		t.Fatalf("expected budget to be empty after 1 deposit")
+	}
+	b.deposit()
+	if !b.withdraw() {
+		t.Fatalf("expected token after 2 deposits")
+	}
+
+	// time refills at min per second
+	now = now.Add(time.Second)
+	if !b.withdraw() {
+		t.Fatalf("expected token after a second")
+	}
+
+	// never more than the max
+	now = now.Add(time.Hour)
+	count := 0
+	for b.withdraw() {
+		count++
+	}
+	if count != 51 {
+		t.Fatalf("got %d tokens want 51", count)
+	}
+}
+
+func TestRouterRetries(t *testing.T) {
+	tests := map[string]struct {
+		backends   []int // status per backend, 0 for one that refuses connections
+		retry      RetryConfig
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		"no retries configured": {
+			backends:   []int{0, http.StatusOK},
+			retry:      RetryConfig{BudgetMinPerSecond: 10},
+			body:       `{"foo":123}`,
+			wantStatus: http.StatusBadGateway,
+		},
+		"dial error retried": {
+			backends:   []int{0, http.StatusOK},
+			retry:      RetryConfig{MaxRetries: 1, MaxBodySize: 1024, BudgetMinPerSecond: 10},
+			body:       `{"foo":123}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `{"foo":123}`,
+		},
+		"retryable status retried": {
+			backends:   []int{http.StatusServiceUnavailable, http.StatusOK},
+			retry:      RetryConfig{MaxRetries: 1, MaxBodySize: 1024, Statuses: []int{http.StatusServiceUnavailable}, BudgetMinPerSecond: 10},
+			body:       `{"foo":123}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `{"foo":123}`,
+		},
+		"non retryable status": {
+			backends:   []int{http.StatusInternalServerError, http.StatusOK},
+			retry:      RetryConfig{MaxRetries: 1, MaxBodySize: 1024, Statuses: []int{http.StatusServiceUnavailable}, BudgetMinPerSecond: 10},
+			body:       `{"foo":123}`,
+			wantStatus: http.StatusInternalServerError,
+		},
+		"retryable status on all backends": {
+			backends:   []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			retry:      RetryConfig{MaxRetries: 3, MaxBodySize: 1024, Statuses: []int{http.StatusServiceUnavailable}, BudgetMinPerSecond: 10},
+			body:       `{"foo":123}`,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		"body too large to retry": {
+			backends:   []int{0, http.StatusOK},
+			retry:      RetryConfig{MaxRetries: 1, MaxBodySize: 4, BudgetMinPerSecond: 10},
+			body:       `{"foo":123}`,
+			wantStatus: http.StatusBadGateway,
+		},
+		"no budget": {
+			backends:   []int{0, http.StatusOK},
+			retry:      RetryConfig{MaxRetries: 1, MaxBodySize: 1024},
+			body:       `{"foo":123}`,
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pools := newTestGroup(t)
+			_, registrar := pools.Pool(pool.DefaultPool)
+			for _, status := range test.backends {
+				registrar.RegisterClient(backendAddr(t, status), 1)
+			}
+			// retried on statuses as well, unlike the default for POST
+			methods := map[string]MethodPolicy{http.MethodPost: {Retryable: true}}
+			router := NewRouter(&RouterConfig{Retry: test.retry, Methods: methods}, pools)
+
+			req := httptest.NewRequest(http.MethodPost, "/json", strings.NewReader(test.body))
+			res := httptest.NewRecorder()
+			router.handle(res, req)
+
+			if res.Code != test.wantStatus {
+				t.Fatalf("got status %d want %d", res.Code, test.wantStatus)
+			}
+			if test.wantBody == "" {
+				return
+			}
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != test.wantBody {
+				t.Fatalf("got body %q want %q", string(body), test.wantBody)
+			}
+		})
+	}
+}
+
+// newTestGroup returns pools that never expire their clients and balance round robin.
+func newTestGroup(t *testing.T) *pool.Group {
+	pools, err := pool.NewGroup(&pool.PoolConfig{
+		MaxAgeNoNotif: time.Hour,
+		SlowThreshold: time.Second,
+		Balancer:      &pool.BalancerConfig{Strategy: pool.BalancerRoundRobin},
+	})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	return pools
+}
+
+// backendAddr starts a backend echoing the request body with the given status, or one refusing connections for 0.
+func backendAddr(t *testing.T, status int) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		w.WriteHeader(status)
+		_, _ = w.Write(body)
+	}))
+	addr := strings.TrimPrefix(server.URL, "http://")
+	if status == 0 {
+		server.Close()
+	} else {
+		t.Cleanup(server.Close)
+	}
+	return addr
+}
+
+func TestRouterRetriesHashByBody(t *testing.T) {
+	pools, err := pool.NewGroup(&pool.PoolConfig{
+		MaxAgeNoNotif: time.Hour,
+		SlowThreshold: time.Second,
+		Balancer:      &pool.BalancerConfig{Strategy: pool.BalancerConsistentHash, HashKey: pool.HashKeyBodyField, HashBodyField: "tenant"},
+	})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	_, registrar := pools.Pool(pool.DefaultPool)
+	for i := 0; i < 5; i++ {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = io.WriteString(w, strconv.Itoa(i))
+		}))
+		t.Cleanup(server.Close)
+		registrar.RegisterClient(strings.TrimPrefix(server.URL, "http://"), 1)
+	}
+	retry := RetryConfig{MaxRetries: 1, MaxBodySize: 1024, BudgetMinPerSecond: 10}
+	router := NewRouter(&RouterConfig{Retry: retry}, pools)
+
+	backends := map[string]bool{}
+	for tenant := 0; tenant < 20; tenant++ {
+		body := fmt.Sprintf(`{"tenant":"tenant-%d"}`, tenant)
+		var first string
+		// the same tenant always lands on the same backend
+		for i := 0; i < 3; i++ {
+			req := httptest.NewRequest(http.MethodPost, "/json", strings.NewReader(body))
+			res := httptest.NewRecorder()
+			router.handle(res, req)
+			if i == 0 {
+				first = res.Body.String()
+			} else if res.Body.String() != first {
+				t.Fatalf("got backend %s for tenant %d, before it was %s", res.Body.String(), tenant, first)
+			}
+		}
+		backends[first] = true
+	}
+	if len(backends) < 2 {
+		t.Fatalf("got all tenants on backends %v, want them spread", backends)
+	}
+}
+
+func TestRouterRetriesPostOnDialError(t *testing.T) {
+	pools := newTestGroup(t)
+	_, registrar := pools.Pool(pool.DefaultPool)
+	registrar.RegisterClient(backendAddr(t, 0), 1)
+	registrar.RegisterClient(backendAddr(t, http.StatusOK), 1)
+	router := NewRouter(&RouterConfig{Retry: RetryConfig{MaxRetries: 1, MaxBodySize: 1024, BudgetMinPerSecond: 10}}, pools)
+
+	res := httptest.NewRecorder()
+	router.handle(res, httptest.NewRequest(http.MethodPost, "/json", strings.NewReader(`{"foo":123}`)))
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d want %d, the first backend was never reached", res.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Route sends the requests matching all its set conditions to Pool.
+type Route struct {
+	Pool string
+	// Host is exact or a wildcard like *.example.com.
+	Host       string
+	PathPrefix string
+	Method     string
+	// Headers must all be present with exactly these values.
+	Headers map[string]string
+	// IngressLimit replaces the limit of the router for the requests of this route when set.
+	IngressLimit *IngressLimitConfig
+}
+
+func (rt *Route) matches(req *http.Request) bool {
+	if rt.Host != "" && !matchHost(rt.Host, req.Host) {
+		return false
+	}
+	if rt.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, rt.PathPrefix) {
+		return false
+	}
+	if rt.Method != "" && rt.Method != req.Method {
+		return false
+	}
+	for name, value := range rt.Headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	pattern = strings.ToLower(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == pattern
+}
+
+// route returns the pool of the first route matching req, the default pool when none does.
+func route(routes []Route, req *http.Request) string {
+	if i := matchRoute(routes, req); i >= 0 {
+		return routes[i].Pool
+	}
+	return ""
+}
+
+// matchRoute returns the index of the first route that matches req, -1 when there's none.
+func matchRoute(routes []Route, req *http.Request) int {
+	for i := range routes {
+		if routes[i].matches(req) {
+			return i
+		}
+	}
+	return -1
+}
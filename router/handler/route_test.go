@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	routes := []Route{
+		{Pool: "payments", Host: "pay.example.com"},
+		{Pool: "shop", Host: "*.shop.example.com", PathPrefix: "/api/"},
+		{Pool: "admin", Method: http.MethodDelete, Headers: map[string]string{"X-Admin": "yes"}},
+		{Pool: "orders", PathPrefix: "/orders"},
+	}
+
+	tests := map[string]struct {
+		method   string
+		target   string
+		host     string
+		headers  map[string]string
+		wantPool string
+	}{
+		"exact host":               {target: "/", host: "pay.example.com", wantPool: "payments"},
+		"exact host with port":     {target: "/", host: "PAY.example.com:8080", wantPool: "payments"},
+		"wildcard host and prefix": {target: "/api/cart", host: "eu.shop.example.com", wantPool: "shop"},
+		"wildcard host, no prefix": {target: "/cart", host: "eu.shop.example.com", wantPool: ""},
+		"wildcard needs subdomain": {target: "/api/cart", host: "shop.example.com", wantPool: ""},
+		"method and header":        {method: http.MethodDelete, target: "/x", headers: map[string]string{"X-Admin": "yes"}, wantPool: "admin"},
+		"method, wrong header":     {method: http.MethodDelete, target: "/x", headers: map[string]string{"X-Admin": "no"}, wantPool: ""},
+		"header, wrong method":     {target: "/x", headers: map[string]string{"X-Admin": "yes"}, wantPool: ""},
+		"path prefix":              {target: "/orders/12", wantPool: "orders"},
+		"first match wins":         {target: "/orders/12", host: "pay.example.com", wantPool: "payments"},
+		"no match is default pool": {target: "/json", wantPool: ""},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, test.target, nil)
+			if test.host != "" {
+				req.Host = test.host
+			}
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+			if got := route(routes, req); got != test.wantPool {
+				t.Fatalf("got pool %q want %q", got, test.wantPool)
+			}
+		})
+	}
+}
+
+func TestRouterRoutes(t *testing.T) {
+	pools := newTestGroup(t)
+	_, registrar := pools.Pool("")
+	registrar.RegisterClient(backendAddr(t, http.StatusOK), 1)
+	_, registrar = pools.Pool("payments")
+	registrar.RegisterClient(backendAddr(t, http.StatusAccepted), 1)
+
+	router := NewRouter(&RouterConfig{Routes: []Route{{Pool: "payments", PathPrefix: "/pay"}}}, pools)
+
+	tests := map[string]struct {
+		target     string
+		wantStatus int
+	}{
+		"routed to payments": {target: "/pay/card", wantStatus: http.StatusAccepted},
+		"routed to default":  {target: "/json", wantStatus: http.StatusOK},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			res := httptest.NewRecorder()
+			router.handle(res, httptest.NewRequest(http.MethodPost, test.target, nil))
+			if res.Code != test.wantStatus {
+				t.Fatalf("got status %d want %d", res.Code, test.wantStatus)
+			}
+		})
+	}
+
+	// a route to a pool nobody registered in yet has nothing to forward to
+	router.Reconfigure(&RouterConfig{Routes: []Route{{Pool: "shop", PathPrefix: "/"}}})
+	res := httptest.NewRecorder()
+	router.handle(res, httptest.NewRequest(http.MethodPost, "/json", nil))
+	if res.Code != http.StatusBadGateway {
+		t.Fatalf("got status %d want %d", res.Code, http.StatusBadGateway)
+	}
+}
@@ -2,58 +2,323 @@ package handler
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"mrbarrel/lib/deadline"
+	"mrbarrel/lib/logging"
+	"mrbarrel/lib/metrics"
+	"mrbarrel/lib/tlsconfig"
 	"mrbarrel/router/pool"
 	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
+var errNoUntriedClient = errors.New("no client left that wasn't tried already")
+
+var routerLog = logging.Logger(logging.Router)
+
+// an incoming request id longer than this isn't trusted, the router makes its own.
+const maxRequestIDLength = 128
+
 type RouterConfig struct {
 	Addr string
+	// TLS serves the router over HTTPS, mutual TLS when it has CAs.
+	TLS tlsconfig.Config
+	// RedirectAddr redirects plain HTTP to HTTPS, when the router has TLS.
+	RedirectAddr string
+	Retry        RetryConfig
+	Hedge        HedgeConfig
+	// IngressLimit applies to the routes without one.
+	IngressLimit IngressLimitConfig
+	// Routes pick the pool of each request, the first match wins.
+	Routes []Route
+	// Methods are the proxied methods, DefaultMethodPolicies when nil.
+	Methods map[string]MethodPolicy
+	// Metrics is where the router registers its metrics, they're not exposed when nil.
+	Metrics *metrics.Registry
+	// AccessLog isn't reconfigured.
+	AccessLog AccessLogConfig
 }
 
 type Router struct {
-	addr    string
-	clients pool.ForwarderProvider
-	mux     *http.ServeMux
+	addr      string
+	tls       tlsconfig.Config
+	redirect  string
+	pools     *pool.Group
+	mux       *http.ServeMux
+	settings  atomic.Pointer[routerSettings]
+	metrics   *routerMetrics
+	accessLog *accessLogger
+}
+
+// routerSettings are the parts of the config that can change while running.
+type routerSettings struct {
+	retry   RetryConfig
+	budget  *retryBudget
+	hedge   HedgeConfig
+	routes  []Route
+	methods map[string]MethodPolicy
+	// limiter applies to the routes without one in routeLimiters.
+	limiter       *ingressLimiter
+	routeLimiters []*ingressLimiter
 }
 
-func NewRouter(cfg *RouterConfig, clientPool pool.ForwarderProvider) *Router {
+func NewRouter(cfg *RouterConfig, pools *pool.Group) *Router {
 	r := &Router{
-		addr:    cfg.Addr,
-		clients: clientPool,
-		mux:     http.NewServeMux(),
+		addr:      cfg.Addr,
+		tls:       cfg.TLS,
+		redirect:  cfg.RedirectAddr,
+		pools:     pools,
+		mux:       http.NewServeMux(),
+		accessLog: newAccessLogger(cfg.AccessLog),
+	}
+	r.Reconfigure(cfg)
+
+	registry := cfg.Metrics
+	if registry == nil {
+		registry = metrics.NewRegistry()
 	}
+	r.metrics = newRouterMetrics(registry)
+	registerPoolMetrics(registry, pools)
 
-	r.mux.HandleFunc(fmt.Sprintf("%s /", http.MethodPost), r.handle)
+	r.mux.HandleFunc("/", r.handle)
 
 	return r
 }
 
+// Reconfigure applies cfg to the next requests, the listener and access log settings are ignored.
+func (r *Router) Reconfigure(cfg *RouterConfig) {
+	methods := cfg.Methods
+	if methods == nil {
+		methods = DefaultMethodPolicies()
+	}
+	routeLimiters := make([]*ingressLimiter, len(cfg.Routes))
+	for i, rt := range cfg.Routes {
+		routeLimiters[i] = newIngressLimiter(rt.IngressLimit)
+	}
+	r.settings.Store(&routerSettings{
+		retry:         cfg.Retry,
+		budget:        newRetryBudget(cfg.Retry.BudgetRatio, cfg.Retry.BudgetMinPerSecond),
+		hedge:         cfg.Hedge,
+		routes:        cfg.Routes,
+		methods:       methods,
+		limiter:       newIngressLimiter(&cfg.IngressLimit),
+		routeLimiters: routeLimiters,
+	})
+}
+
 func (r *Router) ListenAndServe(ctx context.Context) error {
 	server := &http.Server{Addr: r.addr, Handler: r.mux}
+	var redirect *http.Server
+	if r.redirect != "" && r.tls.Enabled() {
+		redirect = &http.Server{Addr: r.redirect, Handler: httpsRedirect(r.addr)}
+	}
 
 	// listen for context to stop server gracefully
 	go func() {
 		<-ctx.Done()
-		log.Printf("INFO: Gracefully sutting down router...")
+		routerLog.Info("gracefully shutting down router")
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
+		if redirect != nil {
+			redirect.Shutdown(ctx)
+		}
 		if err := server.Shutdown(ctx); err != nil {
-			log.Fatalf("Router shutdown failed: %v", err)
+			routerLog.Error("router shutdown failed", "error", err)
+			os.Exit(1)
 		}
 	}()
 
-	return server.ListenAndServe()
+	if redirect == nil {
+		return serve(server, r.tls)
+	}
+	// whichever stops first, the caller shuts the other one down through ctx
+	errs := make(chan error, 2)
+	go func() { errs <- redirect.ListenAndServe() }()
+	go func() { errs <- serve(server, r.tls) }()
+	return <-errs
 }
 
-func (r *Router) handle(w http.ResponseWriter, req *http.Request) {
-	forwarder, err := r.clients.Next()
+// serve runs server, over TLS when cfg has a certificate.
+func serve(server *http.Server, cfg tlsconfig.Config) error {
+	if !cfg.Enabled() {
+		return server.ListenAndServe()
+	}
+	files, err := tlsconfig.Load(cfg)
 	if err != nil {
-		log.Printf("could not get client: %v", err)
-		w.WriteHeader(http.StatusBadGateway)
+		return err
+	}
+	server.TLSConfig = files.ServerConfig()
+	return server.ListenAndServeTLS("", "")
+}
+
+func (r *Router) handle(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	setRequestID(w, req)
+	rec := &pool.ResponseRecorder{ResponseWriter: w}
+	entry, body := &accessEntry{}, (*countingBody)(nil)
+	defer func() {
+		method := methodLabel(req.Method)
+		r.metrics.requests.Inc(method, strconv.Itoa(rec.Status()))
+		r.metrics.latency.Observe(time.Since(start).Seconds(), method)
+		bytesIn := int64(0)
+		if body != nil {
+			bytesIn = body.n.Load()
+		}
+		r.accessLog.log(req, start, rec, bytesIn, entry)
+	}()
+
+	settings := r.settings.Load()
+	policy, ok := methodPolicy(settings.methods, req.Method)
+	if !ok {
+		rec.Header().Set("Allow", allowedMethods(settings.methods))
+		rec.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	poolName, limiter := "", settings.limiter
+	if i := matchRoute(settings.routes, req); i >= 0 {
+		poolName = settings.routes[i].Pool
+		if settings.routes[i].IngressLimit != nil {
+			limiter = settings.routeLimiters[i]
+		}
+	}
+	if !limiter.allow(rec, req) {
+		limitedPool := poolName
+		if limitedPool == "" {
+			limitedPool = pool.DefaultPool
+		}
+		r.metrics.ingressLimited.Inc(limitedPool)
 		return
 	}
-	forwarder.Forward(w, req)
+
+	// a caller in front of us may be running out of time itself
+	ctx, cancel := deadline.FromRequest(req)
+	defer cancel()
+	fwdReq := withAccessEntry(req.WithContext(ctx), entry)
+	if fwdReq.Body != nil && fwdReq.Body != http.NoBody {
+		body = &countingBody{ReadCloser: fwdReq.Body}
+		fwdReq.Body = body
+	}
+	r.forward(rec, fwdReq, poolName, settings, policy)
+}
+
+func (r *Router) forward(w http.ResponseWriter, req *http.Request, poolName string, settings *routerSettings, policy MethodPolicy) {
+	retry, budget := settings.retry, settings.budget
+	budget.deposit()
+	statuses := retry.Statuses
+	if policy.DialRetryOnly {
+		statuses = nil
+	}
+
+	clients, _ := r.pools.Pool(poolName)
+	hedgeDelay, hedge := time.Duration(0), false
+	if policy.Hedged && !policy.DialRetryOnly {
+		hedgeDelay, hedge = settings.hedge.delay(clients)
+	}
+
+	body, canRetry := []byte(nil), false
+	if (retry.MaxRetries > 0 && policy.Retryable) || hedge {
+		var err error
+		body, canRetry, err = bufferBody(req, retry.MaxBodySize)
+		if err != nil {
+			requestLog(req).Warn("while reading request body", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if canRetry {
+			// the body was read, put it back for the balancers that pick a backend by it
+			req = withBody(req, body)
+		}
+	}
+
+	entry := accessEntryFrom(req)
+	tried := map[string]bool{}
+	status := http.StatusBadGateway
+	for attempt := 0; ; attempt++ {
+		forwarder, err := next(clients, req, tried)
+		if err != nil {
+			requestLog(req).Error("could not get a backend", "pool", poolName, "error", err)
+			w.WriteHeader(status)
+			return
+		}
+		tried[forwarder.Host()] = true
+		entry.backend, entry.retries = forwarder.Host(), attempt
+
+		start := time.Now()
+		if !canRetry {
+			_ = forwarder.Forward(w, req)
+			entry.upstream += time.Since(start)
+			return
+		}
+
+		retrying := attempt < retry.MaxRetries && budget.canWithdraw()
+		if attempt == 0 && hedge {
+			err = r.hedge(w, req, body, forwarder, hedgeDelay, clients, tried, settings)
+		} else {
+			attemptReq := withBody(req, body)
+			if retrying {
+				attemptReq = pool.WithRetry(attemptReq, statuses)
+			}
+			err = forwarder.Forward(w, attemptReq)
+		}
+		entry.upstream += time.Since(start)
+
+		var retryErr *pool.RetryableError
+		if !errors.As(err, &retryErr) {
+			return
+		}
+		if retryErr.Status != 0 {
+			status = retryErr.Status
+		}
+		if !retrying {
+			// only a hedged call comes back without an answer when it wasn't marked for retry
+			w.WriteHeader(status)
+			return
+		}
+		if !budget.withdraw() {
+			requestLog(req).Warn("retry budget exhausted, not retrying", logging.BackendKey, forwarder.Host())
+			w.WriteHeader(status)
+			return
+		}
+	}
+}
+
+// setRequestID sets the id of req, and sends it back to the client.
+func setRequestID(w http.ResponseWriter, req *http.Request) {
+	id := req.Header.Get(logging.RequestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		b := make([]byte, 16)
+		_, _ = rand.Read(b)
+		id = hex.EncodeToString(b)
+		req.Header.Set(logging.RequestIDHeader, id)
+	}
+	w.Header().Set(logging.RequestIDHeader, id)
+}
+
+func requestLog(req *http.Request) *slog.Logger {
+	return routerLog.With(logging.RequestIDKey, req.Header.Get(logging.RequestIDHeader))
+}
+
+// next returns a Forwarder that hasn't been tried yet for req.
+func next(clients pool.ForwarderProvider, req *http.Request, tried map[string]bool) (pool.Forwarder, error) {
+	if len(tried) > 0 {
+		// don't let session affinity send us back to where we came from
+		req = pool.WithExcluded(req, tried)
+	}
+	for i := 0; i <= len(tried); i++ {
+		forwarder, err := clients.Next(req)
+		if err != nil {
+			return nil, err
+		}
+		if !tried[forwarder.Host()] {
+			return forwarder, nil
+		}
+	}
+	return nil, errNoUntriedClient
 }
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"io"
+	"mrbarrel/lib/logging"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouterRequestID(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, req.Header.Get(logging.RequestIDHeader))
+	}))
+	defer backend.Close()
+
+	tests := map[string]struct {
+		id      string
+		wantNew bool
+	}{
+		"kept":     {id: "abc-123"},
+		"missing":  {wantNew: true},
+		"too long": {id: strings.Repeat("a", maxRequestIDLength+1), wantNew: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pools := newTestGroup(t)
+			_, registrar := pools.Pool("")
+			registrar.RegisterClient(strings.TrimPrefix(backend.URL, "http://"), 1)
+			router := NewRouter(&RouterConfig{}, pools)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.id != "" {
+				req.Header.Set(logging.RequestIDHeader, test.id)
+			}
+			res := httptest.NewRecorder()
+			router.mux.ServeHTTP(res, req)
+
+			got := res.Header().Get(logging.RequestIDHeader)
+			if got != res.Body.String() {
+				t.Fatalf("got id %q, the backend got %q", got, res.Body.String())
+			}
+			if test.wantNew && (got == test.id || len(got) != 32) {
+				t.Fatalf("got id %q, want a new one", got)
+			}
+			if !test.wantNew && got != test.id {
+				t.Fatalf("got id %q want %q", got, test.id)
+			}
+		})
+	}
+}
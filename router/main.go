@@ -2,38 +2,85 @@ package main
 
 import (
 	"context"
-	"log"
 	"mrbarrel/lib/env"
+	"mrbarrel/lib/logging"
+	"mrbarrel/lib/metrics"
 	"mrbarrel/lib/shutdown"
+	"mrbarrel/router/config"
 	"mrbarrel/router/handler"
 	"mrbarrel/router/pool"
+	"os"
 	"sync"
 	"time"
 )
 
+var logger = logging.Logger(logging.Main)
+
 func main() {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 
 	// configuration phase
-	poolConfig := &pool.PoolConfig{
-		MaxAgeNoNotif: env.MustGetDurationOrDefault("MAX_CLIENT_NO_NOTIF", time.Second*2),
-		SlowThreshold: env.MustGetDurationOrDefault("SLOW_THRESHOLD", time.Millisecond*200),
+	configFile := env.MustGetStringOrDefault("CONFIG_FILE", "")
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		fatal("while loading config", err)
+	}
+	levels, err := cfg.LogLevels()
+	if err != nil {
+		fatal("while reading log levels", err)
+	}
+	logging.Setup(levels)
+	adminConfig := &handler.AdminHandlerConfig{
+		ListenAddr: cfg.Listeners.Admin,
 	}
-	poolHandlerConfig := &handler.RegistryHandlerConfig{
-		ListenAddr: env.MustGetStringOrDefault("REGISTRY_ADDR", ":8081"),
+	poolHandlerConfig := cfg.RegistryConfig()
+	registry := metrics.NewRegistry()
+	routerConfig := cfg.RouterConfig()
+	routerConfig.Metrics = registry
+	accessLog, err := cfg.OpenAccessLog()
+	if err != nil {
+		fatal("while opening access log", err)
 	}
-	routerConfig := &handler.RouterConfig{
-		Addr: env.MustGetStringOrDefault("HTTP_ADDR", ":8081"),
+	if accessLog != nil {
+		defer accessLog.Close()
+		routerConfig.AccessLog.Output = accessLog
+	}
+	watcherConfig := &config.WatcherConfig{
+		Path:     configFile,
+		Interval: env.MustGetDurationOrDefault("CONFIG_POLL_INTERVAL", time.Second*2),
 	}
 
 	// wiring phase
-	clientPool, clientRegistrar := pool.NewPool(poolConfig)
-	poolHandler := handler.NewRegistryHandler(poolHandlerConfig, clientRegistrar)
-	router := handler.NewRouter(routerConfig, clientPool)
+	pools, err := pool.NewGroup(cfg.PoolConfig())
+	if err != nil {
+		fatal("while creating pools", err)
+	}
+	pools.SetPools(cfg.PoolNames())
+	pools.SetStaticClients(cfg.StaticBackends)
+	poolHandler, err := handler.NewRegistryHandler(poolHandlerConfig, pools)
+	if err != nil {
+		fatal("while creating registry", err)
+	}
+	router := handler.NewRouter(routerConfig, pools)
+	adminHandler := handler.NewAdminHandler(adminConfig, registry, pools)
+	watcher := config.NewWatcher(watcherConfig, cfg, func(cfg *config.Config) error {
+		levels, err := cfg.LogLevels()
+		if err != nil {
+			return err
+		}
+		if err := pools.Reconfigure(cfg.PoolConfig()); err != nil {
+			return err
+		}
+		logging.SetLevels(levels)
+		pools.SetPools(cfg.PoolNames())
+		pools.SetStaticClients(cfg.StaticBackends)
+		router.Reconfigure(cfg.RouterConfig())
+		return nil
+	})
 
 	// run phase
 	var wg sync.WaitGroup
-	wg.Add(4)
+	wg.Add(6)
 
 	go func() {
 		defer wg.Done()
@@ -42,14 +89,19 @@ func main() {
 
 	go func() {
 		defer wg.Done()
-		clientPool.Run(ctx)
+		pools.Run(ctx)
+	}()
+
+	go func() {
+		defer wg.Done()
+		watcher.Run(ctx)
 	}()
 
 	go func() {
 		defer wg.Done()
 		err := poolHandler.ListenForClients(ctx)
 		if err != nil {
-			log.Printf("ERROR in clientPool: %v", err)
+			logger.Error("registry stopped", "error", err)
 		}
 		cancelFunc()
 	}()
@@ -58,13 +110,26 @@ func main() {
 		defer wg.Done()
 		err := router.ListenAndServe(ctx)
 		if err != nil {
-			log.Printf("ERROR in handler: %v", err)
+			logger.Error("router stopped", "error", err)
 		}
 		cancelFunc()
+	}()
 
+	go func() {
+		defer wg.Done()
+		err := adminHandler.ListenAndServe(ctx)
+		if err != nil {
+			logger.Error("admin handler stopped", "error", err)
+		}
+		cancelFunc()
 	}()
 
-	log.Print("Router service up and running.")
+	logger.Info("router service up and running")
 	wg.Wait()
-	log.Print("Router service shutdown complete, exiting. May I rise again.")
+	logger.Info("router service shutdown complete, exiting. May I rise again.")
+}
+
+func fatal(msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
 }
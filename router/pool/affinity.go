@@ -0,0 +1,153 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AffinityNone = ""
+	// AffinityCookie binds a client to the backend named in a cookie the router hands out.
+	AffinityCookie = "cookie"
+	// AffinityHeader binds every value of a request header to a backend, by hashing it.
+	AffinityHeader = "header"
+)
+
+const defaultAffinityCookie = "mrbarrel_backend"
+
+type AffinityConfig struct {
+	// Mode is AffinityCookie, AffinityHeader or AffinityNone.
+	Mode string
+	// CookieName is the name of the cookie in cookie mode.
+	CookieName string
+	// CookieMaxAge is how long the browser keeps the cookie, it's a session cookie when 0.
+	CookieMaxAge time.Duration
+	// Header is hashed in header mode, requests without it are balanced as usual.
+	Header string
+}
+
+// affinity keeps a client on the same backend while it can forward, then binds it to the next one.
+type affinity struct {
+	cfg AffinityConfig
+}
+
+// newAffinity returns nil when affinity is disabled.
+func newAffinity(cfg *AffinityConfig) (*affinity, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	switch cfg.Mode {
+	case AffinityNone:
+		return nil, nil
+	case AffinityCookie:
+		a := &affinity{cfg: *cfg}
+		if a.cfg.CookieName == "" {
+			a.cfg.CookieName = defaultAffinityCookie
+		}
+		return a, nil
+	case AffinityHeader:
+		if cfg.Header == "" {
+			return nil, fmt.Errorf("affinity mode %q needs a header", cfg.Mode)
+		}
+		return &affinity{cfg: *cfg}, nil
+	}
+	return nil, fmt.Errorf("unknown affinity mode %q", cfg.Mode)
+}
+
+// pick returns the Forwarder req is bound to, nil when there's none that can take it.
+func (a *affinity) pick(entries []Forwarder, req *http.Request) Forwarder {
+	if req == nil {
+		return nil
+	}
+	excluded := excludedFrom(req.Context())
+
+	switch a.cfg.Mode {
+	case AffinityCookie:
+		cookie, err := req.Cookie(a.cfg.CookieName)
+		if err != nil {
+			return nil
+		}
+		for _, e := range entries {
+			if backendID(e.Host()) == cookie.Value && !excluded[e.Host()] && e.CanForward() {
+				return e
+			}
+		}
+	case AffinityHeader:
+		key := req.Header.Get(a.cfg.Header)
+		if key == "" {
+			return nil
+		}
+		// rendezvous hashing, only the keys of an entry that goes move
+		var best Forwarder
+		var bestScore uint64
+		for _, e := range entries {
+			if excluded[e.Host()] || !e.CanForward() {
+				continue
+			}
+			if score := hashKey(key + "#" + e.Host()); best == nil || score > bestScore {
+				best, bestScore = e, score
+			}
+		}
+		return best
+	}
+	return nil
+}
+
+// bind makes the response bind the client to f. Only the cookie needs that, a header binds itself.
+func (a *affinity) bind(f Forwarder, req *http.Request) Forwarder {
+	if a.cfg.Mode != AffinityCookie {
+		return f
+	}
+	if cookie, err := req.Cookie(a.cfg.CookieName); err == nil && cookie.Value == backendID(f.Host()) {
+		return f
+	}
+	return &cookieForwarder{Forwarder: f, cookie: &http.Cookie{
+		Name:     a.cfg.CookieName,
+		Value:    backendID(f.Host()),
+		Path:     "/",
+		MaxAge:   int(a.cfg.CookieMaxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}}
+}
+
+// backendID names a backend in the cookie, without handing out its address.
+func backendID(addr string) string {
+	return strconv.FormatUint(hashKey(addr), 36)
+}
+
+// cookieForwarder sets the affinity cookie on the response of the Forwarder it wraps.
+type cookieForwarder struct {
+	Forwarder
+	cookie *http.Cookie
+}
+
+func (f *cookieForwarder) Forward(w http.ResponseWriter, req *http.Request) error {
+	// a retry lands here again with another backend, only the last cookie must remain
+	prefix := f.cookie.Name + "="
+	cookies := w.Header().Values("Set-Cookie")
+	w.Header().Del("Set-Cookie")
+	for _, c := range cookies {
+		if !strings.HasPrefix(c, prefix) {
+			w.Header().Add("Set-Cookie", c)
+		}
+	}
+	http.SetCookie(w, f.cookie)
+	return f.Forwarder.Forward(w, req)
+}
+
+type excludedKey struct{}
+
+// WithExcluded marks hosts affinity must not pick for req, like the ones a retry already tried.
+func WithExcluded(req *http.Request, hosts map[string]bool) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), excludedKey{}, hosts))
+}
+
+func excludedFrom(ctx context.Context) map[string]bool {
+	hosts, _ := ctx.Value(excludedKey{}).(map[string]bool)
+	return hosts
+}
@@ -0,0 +1,175 @@
+package pool
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newAffinityPool(t *testing.T, cfg *AffinityConfig, hosts ...string) *ForwarderPool {
+	t.Helper()
+	a, err := newAffinity(cfg)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	entries := newTestForwarders(hosts...)
+	notifTimes := map[string]time.Time{}
+	for _, h := range hosts {
+		notifTimes[h] = time.Now()
+	}
+	return &ForwarderPool{
+		maxAgeNoNotif: time.Hour,
+		balancer:      &roundRobin{},
+		affinity:      a,
+		entries:       entries,
+		notifTimes:    notifTimes,
+	}
+}
+
+func TestNewAffinity(t *testing.T) {
+	tests := map[string]struct {
+		cfg     *AffinityConfig
+		wantNil bool
+		wantErr bool
+	}{
+		"no config":       {cfg: nil, wantNil: true},
+		"disabled":        {cfg: &AffinityConfig{}, wantNil: true},
+		"cookie":          {cfg: &AffinityConfig{Mode: AffinityCookie}},
+		"header":          {cfg: &AffinityConfig{Mode: AffinityHeader, Header: "X-User-Id"}},
+		"header, no name": {cfg: &AffinityConfig{Mode: AffinityHeader}, wantErr: true},
+		"unknown":         {cfg: &AffinityConfig{Mode: "ip"}, wantErr: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			a, err := newAffinity(test.cfg)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error but got %v", a)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			if (a == nil) != test.wantNil {
+				t.Fatalf("got %v, want nil: %v", a, test.wantNil)
+			}
+		})
+	}
+}
+
+func TestCookieAffinity(t *testing.T) {
+	pool := newAffinityPool(t, &AffinityConfig{Mode: AffinityCookie}, "purple", "green", "yellow")
+
+	// no cookie yet: balanced as usual, and the response binds the client
+	f, err := pool.Next(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	res := httptest.NewRecorder()
+	_ = f.Forward(res, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := res.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != defaultAffinityCookie || cookies[0].Value != backendID(f.Host()) {
+		t.Fatalf("got cookies %v, want one naming %s", cookies, f.Host())
+	}
+	bound := f.Host()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	for i := 0; i < 5; i++ {
+		f, err := pool.Next(req)
+		if err != nil {
+			t.Fatalf("got unexpected error: %v", err)
+		}
+		if f.Host() != bound {
+			t.Fatalf("got %s want %s", f.Host(), bound)
+		}
+		if _, wrapped := f.(*cookieForwarder); wrapped {
+			t.Fatalf("cookie is set again while the client already has it")
+		}
+	}
+
+	// a retry doesn't go back to the bound backend
+	f, _ = pool.Next(WithExcluded(req, map[string]bool{bound: true}))
+	if f.Host() == bound {
+		t.Fatalf("got excluded %s", bound)
+	}
+
+	// the bound backend goes away, the client fails over and gets bound to the new one
+	pool.DeRegisterClient(bound)
+	f, err = pool.Next(req)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if f.Host() == bound {
+		t.Fatalf("got removed %s", bound)
+	}
+	res = httptest.NewRecorder()
+	_ = f.Forward(res, req)
+	if cookies := res.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != backendID(f.Host()) {
+		t.Fatalf("got cookies %v, want one naming %s", cookies, f.Host())
+	}
+}
+
+func TestCookieAffinityRetry(t *testing.T) {
+	a, _ := newAffinity(&AffinityConfig{Mode: AffinityCookie})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	res := httptest.NewRecorder()
+	res.Header().Add("Set-Cookie", "other=1")
+
+	// the first attempt fails and is retried elsewhere, only the cookie of the last one must be sent
+	_ = a.bind(&testForwarder{host: "purple"}, req).Forward(res, req)
+	_ = a.bind(&testForwarder{host: "green"}, req).Forward(res, req)
+
+	cookies := res.Result().Cookies()
+	if len(cookies) != 2 || cookies[0].Name != "other" || cookies[1].Value != backendID("green") {
+		t.Fatalf("got cookies %v, want other and the one naming green", cookies)
+	}
+}
+
+func TestHeaderAffinity(t *testing.T) {
+	pool := newAffinityPool(t, &AffinityConfig{Mode: AffinityHeader, Header: "X-User-Id"}, "purple", "green", "yellow", "blue")
+
+	pick := func(user string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-User-Id", user)
+		f, err := pool.Next(req)
+		if err != nil {
+			t.Fatalf("got unexpected error: %v", err)
+		}
+		return f.Host()
+	}
+
+	before := map[string]string{}
+	for i := 0; i < 200; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		before[user] = pick(user)
+		if again := pick(user); again != before[user] {
+			t.Fatalf("%s moved from %s to %s", user, before[user], again)
+		}
+	}
+
+	// an entry that can't forward only hands over its own users
+	pool.entries[0].(*testForwarder).canForward = false
+	for user, host := range before {
+		got := pick(user)
+		if host == "purple" && got == "purple" {
+			t.Fatalf("%s still goes to purple which can't forward", user)
+		}
+		if host != "purple" && got != host {
+			t.Fatalf("%s moved from %s to %s", user, host, got)
+		}
+	}
+
+	// same when it leaves the pool
+	pool.entries[0].(*testForwarder).canForward = true
+	pool.DeRegisterClient("purple")
+	for user, host := range before {
+		if host != "purple" && pick(user) != host {
+			t.Fatalf("%s moved away from %s", user, host)
+		}
+	}
+}
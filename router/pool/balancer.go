@@ -0,0 +1,61 @@
+package pool
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Balancer decides which Forwarder handles the next request, it's called under the pool's lock.
+type Balancer interface {
+	// Pick selects a Forwarder that can forward, errNoClientsAvailable when none can.
+	Pick(entries []Forwarder, req *http.Request) (Forwarder, error)
+	// Update is called whenever the set of entries in the pool changes.
+	Update(entries []Forwarder)
+}
+
+// keyedBalancer picks by a key of the request, read before the pool takes its lock.
+type keyedBalancer interface {
+	withKey(req *http.Request) *http.Request
+}
+
+const (
+	BalancerRoundRobin         = "round_robin"
+	BalancerLeastOutstanding   = "least_outstanding"
+	BalancerWeightedRoundRobin = "weighted_round_robin"
+	BalancerPowerOfTwo         = "power_of_two"
+	BalancerConsistentHash     = "consistent_hash"
+)
+
+// Sources of the key consistent hashing maps onto the ring.
+const (
+	HashKeyClientIP  = "client_ip"
+	HashKeyHeader    = "header"
+	HashKeyPath      = "path"
+	HashKeyBodyField = "body_field"
+)
+
+type BalancerConfig struct {
+	Strategy string
+	// HashKey is where the consistent hashing key comes from, the client IP when the request has none.
+	HashKey string
+	// HashHeader is the request header consistent hashing uses as key.
+	HashHeader string
+	// HashBodyField is a field of a JSON body, like "user.id".
+	HashBodyField string
+}
+
+func NewBalancer(cfg *BalancerConfig) (Balancer, error) {
+	switch cfg.Strategy {
+	case BalancerRoundRobin:
+		return &roundRobin{}, nil
+	case BalancerLeastOutstanding:
+		return &leastOutstanding{}, nil
+	case "", BalancerWeightedRoundRobin:
+		return newWeightedRoundRobin(), nil
+	case BalancerPowerOfTwo:
+		return newPowerOfTwo(), nil
+	case BalancerConsistentHash:
+		return newConsistentHash(cfg)
+	}
+	return nil, fmt.Errorf("unknown balancer strategy %q", cfg.Strategy)
+}
@@ -0,0 +1,353 @@
+package pool
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testForwarder struct {
+	host       string
+	weight     int
+	inFlight   int64
+	canForward bool
+	unhealthy  bool
+	state      AdminState
+}
+
+func (f *testForwarder) Forward(_ http.ResponseWriter, _ *http.Request) error { return nil }
+func (f *testForwarder) Host() string                                         { return f.host }
+func (f *testForwarder) CanForward() bool                                     { return f.canForward }
+func (f *testForwarder) Weight() int                                          { return f.weight }
+func (f *testForwarder) SetWeight(weight int)                                 { f.weight = weight }
+func (f *testForwarder) InFlight() int64                                      { return f.inFlight }
+func (f *testForwarder) Healthy() bool                                        { return !f.unhealthy }
+func (f *testForwarder) Status() ForwarderStatus                              { return ForwarderStatus{Addr: f.host} }
+func (f *testForwarder) AdminState() AdminState                               { return f.state }
+func (f *testForwarder) SetAdminState(state AdminState)                       { f.state = state }
+func (f *testForwarder) SetHealthy(healthy bool)                              { f.unhealthy = !healthy }
+func (f *testForwarder) reconfigure(_ forwarderConfig)                        {}
+func (f *testForwarder) close()                                               {}
+
+func newTestForwarders(hosts ...string) []Forwarder {
+	var res []Forwarder
+	for _, h := range hosts {
+		res = append(res, &testForwarder{host: h, weight: 1, canForward: true})
+	}
+	return res
+}
+
+func pickN(t *testing.T, b Balancer, entries []Forwarder, req *http.Request, n int) []string {
+	t.Helper()
+	var res []string
+	for i := 0; i < n; i++ {
+		f, err := b.Pick(entries, req)
+		if err != nil {
+			t.Fatalf("got unexpected error: %v", err)
+		}
+		res = append(res, f.Host())
+	}
+	return res
+}
+
+func TestNewBalancer(t *testing.T) {
+	tests := map[string]struct {
+		strategy string
+		wantErr  bool
+	}{
+		"default":              {strategy: ""},
+		"round robin":          {strategy: BalancerRoundRobin},
+		"least outstanding":    {strategy: BalancerLeastOutstanding},
+		"weighted round robin": {strategy: BalancerWeightedRoundRobin},
+		"power of two":         {strategy: BalancerPowerOfTwo},
+		"consistent hash":      {strategy: BalancerConsistentHash},
+		"unknown":              {strategy: "random", wantErr: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := NewBalancer(&BalancerConfig{Strategy: test.strategy})
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error but got %v", b)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestBalancersNoneAvailable(t *testing.T) {
+	for _, strategy := range []string{BalancerRoundRobin, BalancerLeastOutstanding, BalancerWeightedRoundRobin, BalancerPowerOfTwo, BalancerConsistentHash} {
+		t.Run(strategy, func(t *testing.T) {
+			b, _ := NewBalancer(&BalancerConfig{Strategy: strategy})
+			entries := []Forwarder{
+				&testForwarder{host: "purple", weight: 1},
+				&testForwarder{host: "green", weight: 1},
+			}
+			b.Update(entries)
+			if f, err := b.Pick(entries, httptest.NewRequest(http.MethodPost, "/", nil)); err == nil {
+				t.Fatalf("expected error but got %v", f.Host())
+			}
+		})
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	tests := map[string]struct {
+		entries []Forwarder
+		want    []string
+	}{
+		"all idle spreads round robin": {
+			entries: newTestForwarders("purple", "green", "yellow"),
+			want:    []string{"purple", "green", "yellow", "purple", "green"},
+		},
+		"lowest in flight wins": {
+			entries: []Forwarder{
+				&testForwarder{host: "purple", inFlight: 5, canForward: true},
+				&testForwarder{host: "green", inFlight: 1, canForward: true},
+				&testForwarder{host: "yellow", inFlight: 3, canForward: true},
+			},
+			want: []string{"green", "green", "green"},
+		},
+		"skips the ones that can't forward": {
+			entries: []Forwarder{
+				&testForwarder{host: "purple", inFlight: 5, canForward: true},
+				&testForwarder{host: "green", inFlight: 1},
+				&testForwarder{host: "yellow", inFlight: 3, canForward: true},
+			},
+			want: []string{"yellow", "yellow", "yellow"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := pickN(t, &leastOutstanding{}, test.entries, nil, len(test.want))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("list differs: got %v want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	tests := map[string]struct {
+		entries []Forwarder
+		want    []string
+	}{
+		"equal weights is plain round robin": {
+			entries: newTestForwarders("purple", "green", "yellow"),
+			want:    []string{"purple", "green", "yellow", "purple", "green", "yellow"},
+		},
+		"smooth 5-1-1": {
+			entries: []Forwarder{
+				&testForwarder{host: "purple", weight: 5, canForward: true},
+				&testForwarder{host: "green", weight: 1, canForward: true},
+				&testForwarder{host: "yellow", weight: 1, canForward: true},
+			},
+			want: []string{"purple", "purple", "green", "purple", "yellow", "purple", "purple"},
+		},
+		"skips the ones that can't forward": {
+			entries: []Forwarder{
+				&testForwarder{host: "purple", weight: 5},
+				&testForwarder{host: "green", weight: 1, canForward: true},
+				&testForwarder{host: "yellow", weight: 2, canForward: true},
+			},
+			want: []string{"yellow", "green", "yellow", "yellow", "green", "yellow"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := pickN(t, newWeightedRoundRobin(), test.entries, nil, len(test.want))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("list differs: got %v want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPowerOfTwo(t *testing.T) {
+	entries := []Forwarder{
+		&testForwarder{host: "purple", inFlight: 5, canForward: true},
+		&testForwarder{host: "green", inFlight: 1, canForward: true},
+		&testForwarder{host: "yellow", inFlight: 3, canForward: true},
+	}
+
+	tests := map[string]struct {
+		randoms []int
+		want    string
+	}{
+		"purple vs green":  {randoms: []int{0, 0}, want: "green"},
+		"green vs purple":  {randoms: []int{1, 0}, want: "green"},
+		"purple vs yellow": {randoms: []int{0, 1}, want: "yellow"},
+		"yellow vs green":  {randoms: []int{2, 1}, want: "green"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			b := &powerOfTwo{intN: func(_ int) int {
+				r := test.randoms[calls]
+				calls++
+				return r
+			}}
+			got, err := b.Pick(entries, nil)
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			if got.Host() != test.want {
+				t.Fatalf("got %s want %s", got.Host(), test.want)
+			}
+		})
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	entries := newTestForwarders("purple", "green", "yellow", "blue")
+	b, _ := newConsistentHash(&BalancerConfig{HashHeader: "X-User-Id"})
+	b.Update(entries)
+
+	// the same key keeps going to the same entry
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set("X-User-Id", fmt.Sprintf("user-%d", i))
+		got := pickN(t, b, entries, req, 5)
+		for _, host := range got {
+			if host != got[0] {
+				t.Fatalf("key user-%d moved between entries: %v", i, got)
+			}
+		}
+	}
+
+	// keys are spread over all entries
+	hits := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set("X-User-Id", fmt.Sprintf("user-%d", i))
+		f, err := b.Pick(entries, req)
+		if err != nil {
+			t.Fatalf("got unexpected error: %v", err)
+		}
+		hits[f.Host()]++
+	}
+	for _, e := range entries {
+		if hits[e.Host()] < 100 {
+			t.Errorf("entry %s only got %d out of 1000 keys", e.Host(), hits[e.Host()])
+		}
+	}
+
+	// an entry that can't forward hands its keys to the next one on the ring
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("X-User-Id", "user-1")
+	first, _ := b.Pick(entries, req)
+	first.(*testForwarder).canForward = false
+	second, err := b.Pick(entries, req)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if second.Host() == first.Host() {
+		t.Fatalf("got %s which can't forward", second.Host())
+	}
+}
+
+func TestConsistentHashKey(t *testing.T) {
+	tests := map[string]struct {
+		cfg     BalancerConfig
+		header  string
+		path    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		"client ip by default": {
+			want: "192.0.2.1",
+		},
+		"header": {
+			cfg:    BalancerConfig{HashHeader: "X-User-Id"},
+			header: "user-1",
+			want:   "user-1",
+		},
+		"missing header falls back to the client ip": {
+			cfg:  BalancerConfig{HashKey: HashKeyHeader, HashHeader: "X-User-Id"},
+			want: "192.0.2.1",
+		},
+		"path": {
+			cfg:  BalancerConfig{HashKey: HashKeyPath, HashHeader: "X-User-Id"},
+			path: "/images/cat.png",
+			want: "/images/cat.png",
+		},
+		"body field": {
+			cfg:  BalancerConfig{HashKey: HashKeyBodyField, HashBodyField: "tenant"},
+			body: `{"tenant": "acme", "amount": 3}`,
+			want: "acme",
+		},
+		"nested number body field": {
+			cfg:  BalancerConfig{HashKey: HashKeyBodyField, HashBodyField: "order.customer.id"},
+			body: `{"order": {"customer": {"id": 12345678901234567890}}}`,
+			want: "12345678901234567890",
+		},
+		"body without the field": {
+			cfg:  BalancerConfig{HashKey: HashKeyBodyField, HashBodyField: "tenant"},
+			body: `{"order": {"tenant": "acme"}}`,
+			want: "192.0.2.1",
+		},
+		"body that isn't json": {
+			cfg:  BalancerConfig{HashKey: HashKeyBodyField, HashBodyField: "tenant"},
+			body: `tenant=acme`,
+			want: "192.0.2.1",
+		},
+		"header key without header": {
+			cfg:     BalancerConfig{HashKey: HashKeyHeader},
+			wantErr: true,
+		},
+		"body key without field": {
+			cfg:     BalancerConfig{HashKey: HashKeyBodyField},
+			wantErr: true,
+		},
+		"unknown key": {
+			cfg:     BalancerConfig{HashKey: "cookie"},
+			wantErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test.cfg.Strategy = BalancerConsistentHash
+			b, err := NewBalancer(&test.cfg)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error but got %v", b)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+
+			path := test.path
+			if path == "" {
+				path = "/"
+			}
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(test.body))
+			req.Header.Set("X-User-Id", test.header)
+			req = b.(keyedBalancer).withKey(req)
+			if got := b.(*consistentHash).key(req); got != test.want {
+				t.Fatalf("got key %q want %q", got, test.want)
+			}
+
+			// the Forwarder still gets the whole body
+			body, _ := io.ReadAll(req.Body)
+			if string(body) != test.body {
+				t.Fatalf("got body %q want %q", body, test.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package circuitbreaker
+
+import (
+	"sync"
+	"time"
+)
+
+const windowSize = 100
+
+type State int
+
+const (
+	// Closed lets all calls through, while keeping track of failures.
+	Closed State = iota
+	// Open refuses all calls until OpenDuration has passed.
+	Open
+	// HalfOpen lets a limited number of probe calls through to see whether the backend recovered.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "CLOSED"
+	case Open:
+		return "OPEN"
+	case HalfOpen:
+		return "HALF_OPEN"
+	}
+	return "UNKNOWN"
+}
+
+// Config holds the trip conditions of a CircuitBreaker, a zero threshold is disabled.
+type Config struct {
+	// ConsecutiveFailures trips the breaker after this many failures in a row.
+	ConsecutiveFailures int
+	// ErrorRate trips the breaker when the share of failures over the last calls reaches it (0-1).
+	ErrorRate float64
+	// MinRequests is the number of calls needed in the window before ErrorRate is considered.
+	MinRequests int
+	// OpenDuration is how long the breaker stays open before letting probe calls through.
+	OpenDuration time.Duration
+	// HalfOpenProbes is the number of probe calls when half open, and of successes to close again.
+	HalfOpenProbes int
+}
+
+// CircuitBreaker tracks the outcome of the last N calls to a backend, like the RateLimiter does their speed.
+type CircuitBreaker struct {
+	lock                sync.Mutex
+	cfg                 Config
+	state               State
+	window              []bool
+	position            int
+	count               int
+	failures            int
+	consecutiveFailures int
+	openedAt            time.Time
+	probesInFlight      int
+	probeSuccesses      int
+	now                 func() time.Time
+}
+
+func New(cfg Config) *CircuitBreaker {
+	return &CircuitBreaker{
+		cfg:    withDefaults(cfg),
+		state:  Closed,
+		window: make([]bool, windowSize),
+		now:    time.Now,
+	}
+}
+
+// SetConfig changes the trip conditions, the current state and the calls tracked so far are kept.
+func (cb *CircuitBreaker) SetConfig(cfg Config) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.cfg = withDefaults(cfg)
+}
+
+func withDefaults(cfg Config) Config {
+	if cfg.HalfOpenProbes <= 0 {
+		cfg.HalfOpenProbes = 1
+	}
+	return cfg
+}
+
+// Allow tells whether a call could go through, without changing any state.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch cb.state {
+	case Open:
+		return cb.openExpired()
+	case HalfOpen:
+		return cb.probesInFlight < cb.cfg.HalfOpenProbes
+	}
+	return true
+}
+
+// OnRequest must be called when a call actually goes through, followed by OnResult once it's done.
+func (cb *CircuitBreaker) OnRequest() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if cb.state == Open && cb.openExpired() {
+		cb.state = HalfOpen
+		cb.probesInFlight = 0
+		cb.probeSuccesses = 0
+	}
+	if cb.state == HalfOpen {
+		cb.probesInFlight++
+	}
+}
+
+// OnResult tracks the outcome of a call and moves the breaker to its next state when needed.
+func (cb *CircuitBreaker) OnResult(success bool) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch cb.state {
+	case Open:
+		// stragglers that started before we opened, nothing to learn from them
+		return
+	case HalfOpen:
+		if cb.probesInFlight > 0 {
+			cb.probesInFlight--
+		}
+		if !success {
+			cb.trip()
+			return
+		}
+		cb.probeSuccesses++
+		if cb.probeSuccesses >= cb.cfg.HalfOpenProbes {
+			cb.reset()
+		}
+		return
+	}
+
+	cb.track(success)
+	if cb.shouldTrip() {
+		cb.trip()
+	}
+}
+
+// Release is OnResult for calls that say nothing about the backend.
+func (cb *CircuitBreaker) Release() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if cb.state == HalfOpen && cb.probesInFlight > 0 {
+		cb.probesInFlight--
+	}
+}
+
+func (cb *CircuitBreaker) State() State {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.state
+}
+
+// ErrorRate returns the share of failures over the last calls.
+func (cb *CircuitBreaker) ErrorRate() float64 {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.errorRate()
+}
+
+func (cb *CircuitBreaker) track(success bool) {
+	failed := !success
+	if cb.count == windowSize {
+		// window is full, the oldest value drops out
+		if cb.window[cb.position] {
+			cb.failures--
+		}
+	} else {
+		cb.count++
+	}
+	cb.window[cb.position] = failed
+	cb.position = (cb.position + 1) % windowSize
+
+	if failed {
+		cb.failures++
+		cb.consecutiveFailures++
+	} else {
+		cb.consecutiveFailures = 0
+	}
+}
+
+func (cb *CircuitBreaker) shouldTrip() bool {
+	if cb.cfg.ConsecutiveFailures > 0 && cb.consecutiveFailures >= cb.cfg.ConsecutiveFailures {
+		return true
+	}
+	if cb.cfg.ErrorRate > 0 && cb.count >= cb.cfg.MinRequests && cb.errorRate() >= cb.cfg.ErrorRate {
+		return true
+	}
+	return false
+}
+
+func (cb *CircuitBreaker) errorRate() float64 {
+	if cb.count == 0 {
+		return 0
+	}
+	return float64(cb.failures) / float64(cb.count)
+}
+
+func (cb *CircuitBreaker) openExpired() bool {
+	return !cb.now().Before(cb.openedAt.Add(cb.cfg.OpenDuration))
+}
+
+func (cb *CircuitBreaker) trip() {
+	cb.state = Open
+	cb.openedAt = cb.now()
+	cb.probesInFlight = 0
+	cb.probeSuccesses = 0
+}
+
+// reset closes the breaker with a clean slate, the failures from before it opened are history.
+func (cb *CircuitBreaker) reset() {
+	cb.state = Closed
+	cb.window = make([]bool, windowSize)
+	cb.position = 0
+	cb.count = 0
+	cb.failures = 0
+	cb.consecutiveFailures = 0
+}
@@ -0,0 +1,153 @@
+package circuitbreaker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrip(t *testing.T) {
+	tests := map[string]struct {
+		cfg       Config
+		results   []bool
+		wantState State
+	}{
+		"zero config never trips": {
+			results:   repeat(false, windowSize*2),
+			wantState: Closed,
+		},
+		"all successes": {
+			cfg:       Config{ConsecutiveFailures: 3, ErrorRate: 0.5, MinRequests: 10, OpenDuration: time.Hour},
+			results:   repeat(true, windowSize*2),
+			wantState: Closed,
+		},
+		"consecutive failures below threshold": {
+			cfg:       Config{ConsecutiveFailures: 3, OpenDuration: time.Hour},
+			results:   []bool{false, false, true, false, false, true},
+			wantState: Closed,
+		},
+		"consecutive failures reach threshold": {
+			cfg:       Config{ConsecutiveFailures: 3, OpenDuration: time.Hour},
+			results:   []bool{true, false, false, false},
+			wantState: Open,
+		},
+		"error rate below min requests": {
+			cfg:       Config{ErrorRate: 0.5, MinRequests: 10, OpenDuration: time.Hour},
+			results:   alternate(false, true, 4),
+			wantState: Closed,
+		},
+		"error rate reached": {
+			cfg:       Config{ErrorRate: 0.5, MinRequests: 10, OpenDuration: time.Hour},
+			results:   alternate(false, true, 5),
+			wantState: Open,
+		},
+		"error rate below threshold": {
+			cfg:       Config{ErrorRate: 0.5, MinRequests: 10, OpenDuration: time.Hour},
+			results:   append(repeat(true, 60), alternate(false, true, 20)...),
+			wantState: Closed,
+		},
+		"old failures drop out of the window": {
+			cfg:       Config{ErrorRate: 0.5, MinRequests: 10, OpenDuration: time.Hour},
+			results:   append(repeat(false, 1), repeat(true, windowSize*2)...),
+			wantState: Closed,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cb := New(test.cfg)
+			for _, r := range test.results {
+				cb.OnRequest()
+				cb.OnResult(r)
+			}
+			if got := cb.State(); got != test.wantState {
+				t.Fatalf("state mismatch. got %s want %s", got, test.wantState)
+			}
+			if got := cb.Allow(); got != (test.wantState == Closed) {
+				t.Fatalf("allow mismatch. got %v in state %s", got, test.wantState)
+			}
+		})
+	}
+}
+
+func TestHalfOpen(t *testing.T) {
+	now := time.Now()
+	cb := New(Config{ConsecutiveFailures: 1, OpenDuration: time.Second, HalfOpenProbes: 2})
+	cb.now = func() time.Time { return now }
+
+	cb.OnRequest()
+	cb.OnResult(false)
+	if cb.State() != Open || cb.Allow() {
+		t.Fatalf("expected open breaker refusing calls, got %s", cb.State())
+	}
+
+	// after the open duration, probes are let through
+	now = now.Add(time.Second)
+	if !cb.Allow() {
+		t.Fatalf("expected probe to be allowed after open duration")
+	}
+	cb.OnRequest()
+	if cb.State() != HalfOpen {
+		t.Fatalf("state mismatch. got %s want %s", cb.State(), HalfOpen)
+	}
+	cb.OnRequest()
+	if cb.Allow() {
+		t.Fatalf("expected no more than 2 probes in flight")
+	}
+
+	// a failing probe opens again
+	cb.OnResult(true)
+	cb.OnResult(false)
+	if cb.State() != Open || cb.Allow() {
+		t.Fatalf("expected open breaker refusing calls, got %s", cb.State())
+	}
+
+	// enough successful probes close it
+	now = now.Add(time.Second)
+	cb.OnRequest()
+	cb.OnResult(true)
+	if cb.State() != HalfOpen {
+		t.Fatalf("state mismatch. got %s want %s", cb.State(), HalfOpen)
+	}
+	cb.OnRequest()
+	cb.OnResult(true)
+	if cb.State() != Closed || !cb.Allow() {
+		t.Fatalf("expected closed breaker allowing calls, got %s", cb.State())
+	}
+	if cb.ErrorRate() != 0 {
+		t.Fatalf("expected clean slate after closing, got error rate %f", cb.ErrorRate())
+	}
+}
+
+func TestRelease(t *testing.T) {
+	now := time.Now()
+	cb := New(Config{ConsecutiveFailures: 1, OpenDuration: time.Second, HalfOpenProbes: 1})
+	cb.now = func() time.Time { return now }
+
+	cb.OnRequest()
+	cb.OnResult(false)
+	now = now.Add(time.Second)
+	cb.OnRequest()
+	if cb.Allow() {
+		t.Fatalf("expected probe slot to be taken")
+	}
+	cb.Release()
+	if !cb.Allow() || cb.State() != HalfOpen {
+		t.Fatalf("expected probe slot to be released, got %s", cb.State())
+	}
+}
+
+func repeat(r bool, count int) []bool {
+	var res []bool
+	for i := 0; i < count; i++ {
+		res = append(res, r)
+	}
+	return res
+}
+
+func alternate(r1, r2 bool, count int) []bool {
+	var res []bool
+	for i := 0; i < count; i++ {
+		res = append(res, r1, r2)
+	}
+	return res
+}
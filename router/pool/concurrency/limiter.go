@@ -0,0 +1,199 @@
+package concurrency
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// AIMD grows the limit by one per fast call, and cuts it by BackoffRatio per slow or failed one.
+	AIMD = "aimd"
+	// Gradient shrinks the limit when calls get slower than usual by more than Tolerance.
+	Gradient = "gradient"
+)
+
+// weight of a new sample in the usual latency of Gradient.
+const longTermWeight = 1.0 / 500
+
+// Config holds how a Limiter adapts its limit. The zero Config doesn't limit anything.
+type Config struct {
+	// Algorithm is AIMD or Gradient, empty disables the limit.
+	Algorithm string
+	// InitialLimit is the limit a new backend starts with, it's kept between MinLimit and MaxLimit.
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	// LatencyThreshold is the duration above which AIMD takes a call as a sign of overload.
+	LatencyThreshold time.Duration
+	// BackoffRatio (0-1) multiplies the limit on overload.
+	BackoffRatio float64
+	// Tolerance is how many times the usual latency a call may take before Gradient shrinks the limit.
+	Tolerance float64
+	// Smoothing (0-1) is how much of a Gradient update applies at once.
+	Smoothing float64
+}
+
+// Validate checks cfg, New fills in the values left at 0.
+func (cfg Config) Validate() error {
+	if cfg.Algorithm != "" && cfg.Algorithm != AIMD && cfg.Algorithm != Gradient {
+		return fmt.Errorf("unknown concurrency limit algorithm %q", cfg.Algorithm)
+	}
+	if cfg.InitialLimit < 0 || cfg.MinLimit < 0 || cfg.MaxLimit < 0 || cfg.LatencyThreshold < 0 {
+		return fmt.Errorf("concurrency limits and latency threshold can't be negative")
+	}
+	if cfg.MaxLimit > 0 && cfg.MinLimit > cfg.MaxLimit {
+		return fmt.Errorf("concurrency min limit %d is above the max limit %d", cfg.MinLimit, cfg.MaxLimit)
+	}
+	if cfg.BackoffRatio < 0 || cfg.BackoffRatio >= 1 || cfg.Smoothing < 0 || cfg.Smoothing > 1 {
+		return fmt.Errorf("concurrency backoff ratio must be between 0 and 1, smoothing between 0 and 1")
+	}
+	if cfg.Tolerance != 0 && cfg.Tolerance < 1 {
+		return fmt.Errorf("concurrency tolerance must be at least 1")
+	}
+	return nil
+}
+
+func withDefaults(cfg Config) Config {
+	if cfg.MinLimit <= 0 {
+		cfg.MinLimit = 1
+	}
+	if cfg.MaxLimit <= 0 {
+		cfg.MaxLimit = 1000
+	}
+	if cfg.InitialLimit <= 0 {
+		cfg.InitialLimit = 20
+	}
+	if cfg.LatencyThreshold <= 0 {
+		cfg.LatencyThreshold = time.Second
+	}
+	if cfg.BackoffRatio <= 0 {
+		cfg.BackoffRatio = 0.9
+	}
+	if cfg.Tolerance <= 0 {
+		cfg.Tolerance = 1.5
+	}
+	if cfg.Smoothing <= 0 {
+		cfg.Smoothing = 0.2
+	}
+	return cfg
+}
+
+// Limiter caps the calls in flight to a backend, to what it handles without slowing down.
+type Limiter struct {
+	lock     sync.Mutex
+	cfg      Config
+	limit    float64
+	inFlight int
+	// longRTT is the usual latency of Gradient, in seconds.
+	longRTT float64
+}
+
+func New(cfg Config) *Limiter {
+	l := &Limiter{}
+	l.SetConfig(cfg)
+	return l
+}
+
+// SetConfig changes how the limit adapts, it starts over when the algorithm changed.
+func (l *Limiter) SetConfig(cfg Config) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	algorithmChanged := cfg.Algorithm != l.cfg.Algorithm
+	l.cfg = withDefaults(cfg)
+	if algorithmChanged {
+		l.limit = float64(l.cfg.InitialLimit)
+		l.longRTT = 0
+	}
+	l.limit = l.clamp(l.limit)
+}
+
+// Allow tells whether a call could go through, without changing any state.
+func (l *Limiter) Allow() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cfg.Algorithm == "" || l.inFlight < int(l.limit)
+}
+
+// Acquire counts a call in, OnResult or Release count it out.
+func (l *Limiter) Acquire() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.inFlight++
+}
+
+// Release ends a call that says nothing about the backend, like one the client cancelled.
+func (l *Limiter) Release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.inFlight--
+}
+
+// OnResult ends a call and adapts the limit, dropped is a failed call.
+func (l *Limiter) OnResult(latency time.Duration, dropped bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// the calls in flight when this one was, it included
+	inFlight := l.inFlight
+	l.inFlight--
+	switch l.cfg.Algorithm {
+	case AIMD:
+		l.aimd(latency, dropped, inFlight)
+	case Gradient:
+		l.gradient(latency, dropped, inFlight)
+	}
+}
+
+func (l *Limiter) aimd(latency time.Duration, dropped bool, inFlight int) {
+	if dropped || latency > l.cfg.LatencyThreshold {
+		l.limit = l.clamp(l.limit * l.cfg.BackoffRatio)
+		return
+	}
+	// a backend that's far from its limit doesn't tell whether it could take more
+	if float64(inFlight)*2 >= l.limit {
+		l.limit = l.clamp(l.limit + 1)
+	}
+}
+
+func (l *Limiter) gradient(latency time.Duration, dropped bool, inFlight int) {
+	if dropped {
+		// the latency of a failed call says little, back off
+		l.limit = l.clamp(l.limit * l.cfg.BackoffRatio)
+		return
+	}
+	rtt := max(latency.Seconds(), 1e-6)
+	if l.longRTT == 0 {
+		l.longRTT = rtt
+	} else {
+		l.longRTT += (rtt - l.longRTT) * longTermWeight
+	}
+	// let the usual latency catch up after a slow down
+	if l.longRTT/rtt > 2 {
+		l.longRTT *= 0.95
+	}
+	if float64(inFlight)*2 < l.limit {
+		return
+	}
+
+	gradient := max(0.5, min(1, l.cfg.Tolerance*l.longRTT/rtt))
+	// the square root gives a queue that lets the limit grow while the latency stays at the usual one
+	next := l.limit*gradient + math.Sqrt(l.limit)
+	l.limit = l.clamp(l.limit*(1-l.cfg.Smoothing) + next*l.cfg.Smoothing)
+}
+
+func (l *Limiter) clamp(limit float64) float64 {
+	return max(float64(l.cfg.MinLimit), min(float64(l.cfg.MaxLimit), limit))
+}
+
+// Limit returns the current limit, 0 when there's none.
+func (l *Limiter) Limit() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.cfg.Algorithm == "" {
+		return 0
+	}
+	return int(l.limit)
+}
@@ -0,0 +1,200 @@
+package concurrency
+
+import (
+	"testing"
+	"time"
+)
+
+// calls sends rounds of calls that all take latency, each round as many at once as the limit, or busy of them.
+func calls(l *Limiter, rounds, busy int, latency time.Duration, dropped bool) {
+	for i := 0; i < rounds; i++ {
+		n := busy
+		if n == 0 {
+			n = l.Limit()
+		}
+		for j := 0; j < n; j++ {
+			l.Acquire()
+		}
+		for j := 0; j < n; j++ {
+			l.OnResult(latency, dropped)
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	tests := map[string]struct {
+		cfg       Config
+		acquired  int
+		wantAllow bool
+	}{
+		"zero config doesn't limit": {
+			acquired:  10000,
+			wantAllow: true,
+		},
+		"below the limit": {
+			cfg:       Config{Algorithm: AIMD, InitialLimit: 3},
+			acquired:  2,
+			wantAllow: true,
+		},
+		"at the limit": {
+			cfg:       Config{Algorithm: Gradient, InitialLimit: 3},
+			acquired:  3,
+			wantAllow: false,
+		},
+		"initial limit kept within bounds": {
+			cfg:       Config{Algorithm: AIMD, InitialLimit: 50, MaxLimit: 5},
+			acquired:  5,
+			wantAllow: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			l := New(test.cfg)
+			for i := 0; i < test.acquired; i++ {
+				l.Acquire()
+			}
+			if got := l.Allow(); got != test.wantAllow {
+				t.Fatalf("got allow %v want %v", got, test.wantAllow)
+			}
+			// a released call makes room again
+			l.Release()
+			if !l.Allow() {
+				t.Fatalf("call not allowed after a release")
+			}
+		})
+	}
+}
+
+func TestAIMD(t *testing.T) {
+	tests := map[string]struct {
+		cfg       Config
+		run       func(l *Limiter)
+		wantLimit int
+	}{
+		"fast calls on a busy backend grow it by one each": {
+			cfg: Config{Algorithm: AIMD, InitialLimit: 10, LatencyThreshold: 100 * time.Millisecond},
+			run: func(l *Limiter) {
+				for i := 0; i < 10; i++ {
+					l.Acquire()
+				}
+				// 5 calls end while 10 are in flight
+				for i := 0; i < 5; i++ {
+					l.OnResult(10*time.Millisecond, false)
+					l.Acquire()
+				}
+			},
+			wantLimit: 15,
+		},
+		"fast calls far from the limit don't grow it": {
+			cfg:       Config{Algorithm: AIMD, InitialLimit: 10, LatencyThreshold: 100 * time.Millisecond},
+			run:       func(l *Limiter) { calls(l, 10, 1, 10*time.Millisecond, false) },
+			wantLimit: 10,
+		},
+		"slow calls cut it": {
+			cfg:       Config{Algorithm: AIMD, InitialLimit: 10, LatencyThreshold: 100 * time.Millisecond, BackoffRatio: 0.5},
+			run:       func(l *Limiter) { calls(l, 1, 1, time.Second, false) },
+			wantLimit: 5,
+		},
+		"failed calls cut it": {
+			cfg:       Config{Algorithm: AIMD, InitialLimit: 10, LatencyThreshold: 100 * time.Millisecond, BackoffRatio: 0.5},
+			run:       func(l *Limiter) { calls(l, 2, 1, time.Millisecond, true) },
+			wantLimit: 2,
+		},
+		"not below the min limit": {
+			cfg:       Config{Algorithm: AIMD, InitialLimit: 10, MinLimit: 4, LatencyThreshold: 100 * time.Millisecond},
+			run:       func(l *Limiter) { calls(l, 100, 1, time.Second, false) },
+			wantLimit: 4,
+		},
+		"not above the max limit": {
+			cfg:       Config{Algorithm: AIMD, InitialLimit: 10, MaxLimit: 30, LatencyThreshold: 100 * time.Millisecond},
+			run:       func(l *Limiter) { calls(l, 20, 0, time.Millisecond, false) },
+			wantLimit: 30,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			l := New(test.cfg)
+			test.run(l)
+			if got := l.Limit(); got != test.wantLimit {
+				t.Fatalf("got limit %d want %d", got, test.wantLimit)
+			}
+		})
+	}
+}
+
+func TestGradient(t *testing.T) {
+	cfg := Config{Algorithm: Gradient, InitialLimit: 20, MaxLimit: 200}
+	l := New(cfg)
+
+	// steady latency, the limit grows
+	calls(l, 20, 0, 10*time.Millisecond, false)
+	grown := l.Limit()
+	if grown <= cfg.InitialLimit {
+		t.Fatalf("got limit %d after steady calls, want more than %d", grown, cfg.InitialLimit)
+	}
+
+	// the backend slows down to 5 times its usual latency, the limit shrinks
+	calls(l, 3, 0, 50*time.Millisecond, false)
+	shrunk := l.Limit()
+	if shrunk >= grown/2 {
+		t.Fatalf("got limit %d after slow calls, want less than half of %d", shrunk, grown)
+	}
+
+	// a latency within the tolerance doesn't shrink it
+	l = New(cfg)
+	calls(l, 5, 0, 10*time.Millisecond, false)
+	before := l.Limit()
+	calls(l, 1, 0, 14*time.Millisecond, false)
+	if got := l.Limit(); got < before {
+		t.Fatalf("got limit %d after calls within the tolerance, want at least %d", got, before)
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	l := New(Config{Algorithm: AIMD, InitialLimit: 10})
+	calls(l, 5, 0, time.Millisecond, false)
+	if got := l.Limit(); got <= 15 {
+		t.Fatalf("got limit %d want more than 15", got)
+	}
+
+	// same algorithm, the limit is kept within the new bounds
+	l.SetConfig(Config{Algorithm: AIMD, InitialLimit: 10, MaxLimit: 15})
+	if got := l.Limit(); got != 15 {
+		t.Fatalf("got limit %d want 15", got)
+	}
+	// another algorithm starts over
+	l.SetConfig(Config{Algorithm: Gradient, InitialLimit: 10})
+	if got := l.Limit(); got != 10 {
+		t.Fatalf("got limit %d want 10", got)
+	}
+	// and none removes the limit
+	l.SetConfig(Config{})
+	if got := l.Limit(); got != 0 || !l.Allow() {
+		t.Fatalf("got limit %d, want none", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string]struct {
+		cfg     Config
+		wantErr bool
+	}{
+		"zero config":       {},
+		"aimd":              {cfg: Config{Algorithm: AIMD, MinLimit: 2, MaxLimit: 10, BackoffRatio: 0.8}},
+		"gradient":          {cfg: Config{Algorithm: Gradient, Tolerance: 2, Smoothing: 0.5}},
+		"unknown algorithm": {cfg: Config{Algorithm: "vegas"}, wantErr: true},
+		"min above max":     {cfg: Config{Algorithm: AIMD, MinLimit: 20, MaxLimit: 10}, wantErr: true},
+		"backoff ratio":     {cfg: Config{Algorithm: AIMD, BackoffRatio: 1}, wantErr: true},
+		"tolerance":         {cfg: Config{Algorithm: Gradient, Tolerance: 0.5}, wantErr: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := test.cfg.Validate(); (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// number of points each entry gets on the ring.
+const virtualNodes = 100
+
+// bodies larger than this aren't read for a hash key, they are hashed on the client IP.
+const hashBodyLimit = 64 << 10
+
+type ringPoint struct {
+	hash      uint64
+	forwarder Forwarder
+}
+
+// consistentHash maps a request key onto a hash ring.
+type consistentHash struct {
+	source    string
+	header    string
+	bodyField string
+	ring      []ringPoint
+}
+
+func newConsistentHash(cfg *BalancerConfig) (*consistentHash, error) {
+	b := &consistentHash{source: cfg.HashKey, header: cfg.HashHeader, bodyField: cfg.HashBodyField}
+	switch b.source {
+	case "":
+		b.source = HashKeyClientIP
+		if b.header != "" {
+			b.source = HashKeyHeader
+		}
+	case HashKeyClientIP, HashKeyPath:
+	case HashKeyHeader:
+		if b.header == "" {
+			return nil, fmt.Errorf("hash key %q needs a header", b.source)
+		}
+	case HashKeyBodyField:
+		if b.bodyField == "" {
+			return nil, fmt.Errorf("hash key %q needs a body field", b.source)
+		}
+	default:
+		return nil, fmt.Errorf("unknown hash key %q", b.source)
+	}
+	return b, nil
+}
+
+func (b *consistentHash) Pick(entries []Forwarder, req *http.Request) (Forwarder, error) {
+	if len(b.ring) == 0 {
+		b.Update(entries)
+	}
+
+	h := hashKey(b.key(req))
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+
+	// walk the ring clockwise until we find an entry that can take the call
+	seen := map[string]bool{}
+	for n := 0; n < len(b.ring) && len(seen) < len(entries); n++ {
+		point := b.ring[(start+n)%len(b.ring)]
+		host := point.forwarder.Host()
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+		if point.forwarder.CanForward() {
+			return point.forwarder, nil
+		}
+	}
+	return nil, errNoClientsAvailable
+}
+
+func (b *consistentHash) Update(entries []Forwarder) {
+	ring := make([]ringPoint, 0, len(entries)*virtualNodes)
+	for _, e := range entries {
+		for i := 0; i < virtualNodes; i++ {
+			ring = append(ring, ringPoint{hash: hashKey(e.Host() + "#" + strconv.Itoa(i)), forwarder: e})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	b.ring = ring
+}
+
+type hashKeyCtx struct{}
+
+// readKey is the key withKey read, and the balancer that read it.
+type readKey struct {
+	balancer *consistentHash
+	key      string
+}
+
+// withKey reads the key of a body field up front. The body is put back in req for the Forwarder.
+func (b *consistentHash) withKey(req *http.Request) *http.Request {
+	if b.source != HashKeyBodyField {
+		return req
+	}
+	key := readKey{balancer: b, key: b.bodyKey(req)}
+	return req.WithContext(context.WithValue(req.Context(), hashKeyCtx{}, key))
+}
+
+func (b *consistentHash) key(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	var key string
+	switch b.source {
+	case HashKeyHeader:
+		key = req.Header.Get(b.header)
+	case HashKeyPath:
+		key = req.URL.Path
+	case HashKeyBodyField:
+		if read, ok := req.Context().Value(hashKeyCtx{}).(readKey); ok && read.balancer == b {
+			key = read.key
+		} else {
+			key = b.bodyKey(req)
+		}
+	}
+	if key != "" {
+		return key
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// bodyKey returns the value of the body field, empty when there's none.
+func (b *consistentHash) bodyKey(req *http.Request) string {
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength > hashBodyLimit {
+		return ""
+	}
+
+	var body []byte
+	if req.GetBody != nil {
+		// the body was buffered already, reading it again is cheap and leaves req.Body alone
+		rc, err := req.GetBody()
+		if err != nil {
+			return ""
+		}
+		body, err = io.ReadAll(io.LimitReader(rc, hashBodyLimit+1))
+		_ = rc.Close()
+		if err != nil {
+			return ""
+		}
+	} else {
+		buf, err := io.ReadAll(io.LimitReader(req.Body, hashBodyLimit+1))
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		if err != nil {
+			return ""
+		}
+		body = buf
+	}
+	if len(body) > hashBodyLimit {
+		return ""
+	}
+	return jsonField(body, b.bodyField)
+}
+
+// jsonField returns the string, number or bool at the dotted path.
+func jsonField(body []byte, path string) string {
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	var val any
+	if err := d.Decode(&val); err != nil {
+		return ""
+	}
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := val.(map[string]any)
+		if !ok {
+			return ""
+		}
+		if val, ok = obj[name]; !ok {
+			return ""
+		}
+	}
+	switch v := val.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+func hashKey(key string) uint64 {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(key))
+	// fnv alone clusters similar keys like 'host#1' and 'host#2'
+	x := f.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -1,41 +1,250 @@
 package pool
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"mrbarrel/lib/deadline"
+	"mrbarrel/lib/logging"
+	"mrbarrel/router/pool/circuitbreaker"
+	"mrbarrel/router/pool/concurrency"
 	"mrbarrel/router/pool/ratelimit"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Forwarder interface {
-	Forward(w http.ResponseWriter, req *http.Request)
+	// Forward proxies req to the backend. It only returns an error for requests marked WithRetry.
+	Forward(w http.ResponseWriter, req *http.Request) error
 	Host() string
 	CanForward() bool
+	// Weight is the relative share of traffic this Forwarder should get compared to the others.
+	Weight() int
+	SetWeight(weight int)
+	// InFlight is the number of requests currently being forwarded.
+	InFlight() int64
+	// Healthy is the outcome of the health checks.
+	Healthy() bool
+	SetHealthy(healthy bool)
+	// Status returns a point in time view of the Forwarder, for metrics and inspection.
+	Status() ForwarderStatus
+	// AdminState is set by operators, only an active Forwarder can forward.
+	AdminState() AdminState
+	SetAdminState(state AdminState)
+	// reconfigure applies the settings of a reloaded pool config.
+	reconfigure(cfg forwarderConfig)
+	// close closes the idle connections of a removed Forwarder.
+	close()
+}
+
+type AdminState int32
+
+const (
+	StateActive AdminState = iota
+	// StateDraining takes the Forwarder out of rotation, letting the requests in flight finish.
+	StateDraining
+	// StateDisabled takes the Forwarder out of rotation until it is enabled again.
+	StateDisabled
+)
+
+func (s AdminState) String() string {
+	switch s {
+	case StateActive:
+		return "ACTIVE"
+	case StateDraining:
+		return "DRAINING"
+	case StateDisabled:
+		return "DISABLED"
+	}
+	return "UNKNOWN"
+}
+
+type ForwarderStatus struct {
+	Addr     string
+	Weight   int
+	InFlight int64
+	Healthy  bool
+	// Stage, Score and WaitTime come from the rate limiter.
+	Stage    string
+	Score    float64
+	WaitTime time.Duration
+	Breaker  string
+	State    AdminState
+	// LastNotif and Static are filled in by the pool.
+	LastNotif time.Time
+	Static    bool
+	// StatusCodes counts the responses per status, 502 includes the calls without one.
+	StatusCodes map[int]uint64
+	// ConnsNew and ConnsReused count the new and reused connections.
+	ConnsNew    uint64
+	ConnsReused uint64
+	// ConcurrencyLimit is 0 when not limited.
+	ConcurrencyLimit int
 }
 type forwardHandler struct {
 	addr        string
 	proxy       *httputil.ReverseProxy
+	transport   *transport
+	latencies   *latencyWindow
 	rateLimiter *ratelimit.RateLimiter
+	breaker     *circuitbreaker.CircuitBreaker
+	limiter     *concurrency.Limiter
+	weight      int
+	inFlight    atomic.Int64
+	unhealthy   atomic.Bool
+	adminState  atomic.Int32
+	closed      atomic.Bool
+	codesLock   sync.Mutex
+	statusCodes map[int]uint64
 }
 
-func newForwardHandler(addr string, slowThreshold time.Duration) Forwarder {
-	uri, _ := url.Parse(fmt.Sprintf("http://%s", addr)) // TODO: should the 'http://' be here or in the client's registration data?
+// forwarderConfig holds the settings every forwardHandler in a pool is created with.
+type forwarderConfig struct {
+	slowThreshold time.Duration
+	breaker       circuitbreaker.Config
+	concurrency   concurrency.Config
+	transport     transportSettings
+	// latencies is shared by all Forwarders of the pool, it stays the same on reconfigure.
+	latencies *latencyWindow
+}
+
+func newForwardHandler(addr string, cfg forwarderConfig) Forwarder {
+	uri, _ := url.Parse(backendURL(addr))
 	proxy := httputil.NewSingleHostReverseProxy(uri)
-	return &forwardHandler{
+	h := &forwardHandler{
 		addr:        addr,
 		proxy:       proxy,
-		rateLimiter: ratelimit.NewRateLimiter(slowThreshold),
+		transport:   newTransport(uri.Hostname(), cfg.transport),
+		latencies:   cfg.latencies,
+		rateLimiter: ratelimit.NewRateLimiter(cfg.slowThreshold, addr),
+		breaker:     circuitbreaker.New(cfg.breaker),
+		limiter:     concurrency.New(cfg.concurrency),
+		weight:      1,
+		statusCodes: map[int]uint64{},
 	}
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		deadline.Set(req.Context(), req.Header)
+	}
+	proxy.Transport = h.transport
+	proxy.ErrorHandler = h.handleProxyError
+	proxy.ModifyResponse = checkRetryableStatus
+	return h
+}
+
+// backendURL returns the URL of addr, a host:port is called over plain HTTP.
+func backendURL(addr string) string {
+	if strings.Contains(addr, "://") {
+		return addr
+	}
+	return "http://" + addr
+}
+
+func (h *forwardHandler) reconfigure(cfg forwarderConfig) {
+	h.rateLimiter.SetSlowThreshold(cfg.slowThreshold)
+	h.breaker.SetConfig(cfg.breaker)
+	h.limiter.SetConfig(cfg.concurrency)
+	h.transport.set(cfg.transport)
+}
+
+func (h *forwardHandler) close() {
+	h.closed.Store(true)
+	h.transport.closeIdle()
 }
 
-func (h *forwardHandler) Forward(w http.ResponseWriter, req *http.Request) {
+func (h *forwardHandler) Forward(w http.ResponseWriter, req *http.Request) error {
+	h.inFlight.Add(1)
+	defer h.inFlight.Add(-1)
+	h.breaker.OnRequest()
+	h.limiter.Acquire()
+
+	// the backend learns how much time it has left through the deadline header
+	ctx, cancel := h.transport.withTotalTimeout(req.Context())
+	defer cancel()
+
+	rec := &statusRecorder{ResponseRecorder: ResponseRecorder{ResponseWriter: w}}
 	start := time.Now()
-	h.proxy.ServeHTTP(w, req)
+	h.proxy.ServeHTTP(rec, req.WithContext(ctx))
 	duration := time.Since(start)
+	if h.closed.Load() {
+		// the call outlived the Forwarder, its connection went back to the idle ones
+		h.transport.closeIdle()
+	}
 
 	h.rateLimiter.TrackNewDuration(duration)
+	if rec.status != 0 && req.Context().Err() == nil {
+		// cancelled calls say nothing about the latency
+		h.latencies.add(duration)
+	}
+	h.trackOutcome(req, rec, duration)
+	if rec.retryErr != nil {
+		return rec.retryErr
+	}
+	return nil
+}
+
+func (h *forwardHandler) trackOutcome(req *http.Request, rec *statusRecorder, duration time.Duration) {
+	h.countStatus(rec)
+	if errors.Is(req.Context().Err(), context.Canceled) {
+		// the client went away, that says nothing about the backend
+		h.breaker.Release()
+		h.limiter.Release()
+		return
+	}
+
+	h.limiter.OnResult(duration, rec.failed())
+	before := h.breaker.State()
+	h.breaker.OnResult(!rec.failed())
+	if state := h.breaker.State(); state != before {
+		logger.Info("circuit breaker changed state", logging.BackendKey, h.addr, logging.FromKey, before, logging.ToKey, state)
+	}
+}
+
+func (h *forwardHandler) countStatus(rec *statusRecorder) {
+	status := rec.status
+	if status == 0 && rec.retryErr != nil {
+		status = rec.retryErr.Status
+	}
+	if status == 0 {
+		status = http.StatusBadGateway
+	}
+	h.codesLock.Lock()
+	defer h.codesLock.Unlock()
+	h.statusCodes[status]++
+}
+
+// handleProxyError tracks the error, and writes nothing when the request can be retried.
+func (h *forwardHandler) handleProxyError(w http.ResponseWriter, req *http.Request, err error) {
+	rec, isRec := w.(*statusRecorder)
+	if isRec {
+		rec.proxyErr = err
+	}
+	if _, canRetry := retryPolicyFrom(req.Context()); canRetry && isRec {
+		if retryErr, ok := asRetryable(err); ok {
+			logger.Warn("while forwarding, will retry", logging.BackendKey, h.addr,
+				logging.RequestIDKey, req.Header.Get(logging.RequestIDHeader), "error", err)
+			rec.retryErr = retryErr
+			return
+		}
+	}
+	logger.Error("while forwarding", logging.BackendKey, h.addr, logging.RequestIDKey, req.Header.Get(logging.RequestIDHeader), "error", err)
+	if isTimeout(err) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// isTimeout tells whether err is the backend running out of time, rather than failing.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
 }
 
 func (h *forwardHandler) Host() string {
@@ -43,5 +252,62 @@ func (h *forwardHandler) Host() string {
 }
 
 func (h *forwardHandler) CanForward() bool {
-	return h.rateLimiter.CanHandleCall()
+	return h.AdminState() == StateActive && h.Healthy() && h.breaker.Allow() && h.limiter.Allow() && h.rateLimiter.CanHandleCall()
+}
+
+func (h *forwardHandler) Weight() int {
+	return h.weight
+}
+
+// SetWeight is only called while the pool holds its lock, same as the balancers reading it.
+func (h *forwardHandler) SetWeight(weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	h.weight = weight
+}
+
+func (h *forwardHandler) InFlight() int64 {
+	return h.inFlight.Load()
+}
+
+func (h *forwardHandler) Healthy() bool {
+	return !h.unhealthy.Load()
+}
+
+func (h *forwardHandler) SetHealthy(healthy bool) {
+	h.unhealthy.Store(!healthy)
+}
+
+func (h *forwardHandler) Status() ForwarderStatus {
+	h.codesLock.Lock()
+	codes := make(map[int]uint64, len(h.statusCodes))
+	for code, count := range h.statusCodes {
+		codes[code] = count
+	}
+	h.codesLock.Unlock()
+
+	return ForwarderStatus{
+		Addr:             h.addr,
+		Weight:           h.weight,
+		InFlight:         h.InFlight(),
+		Healthy:          h.Healthy(),
+		Stage:            h.rateLimiter.Stage(),
+		Score:            h.rateLimiter.Score(),
+		WaitTime:         h.rateLimiter.WaitTime(),
+		Breaker:          h.breaker.State().String(),
+		State:            h.AdminState(),
+		StatusCodes:      codes,
+		ConnsNew:         h.transport.connsNew.Load(),
+		ConnsReused:      h.transport.connsReused.Load(),
+		ConcurrencyLimit: h.limiter.Limit(),
+	}
+}
+
+func (h *forwardHandler) AdminState() AdminState {
+	return AdminState(h.adminState.Load())
+}
+
+func (h *forwardHandler) SetAdminState(state AdminState) {
+	h.adminState.Store(int32(state))
 }
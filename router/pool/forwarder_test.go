@@ -0,0 +1,273 @@
+package pool
+
+import (
+	"mrbarrel/lib/deadline"
+	"mrbarrel/lib/tlsconfig"
+	"mrbarrel/lib/tlsconfig/tlstest"
+	"mrbarrel/router/pool/circuitbreaker"
+	"mrbarrel/router/pool/concurrency"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForwardTripsBreaker(t *testing.T) {
+	unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	unreachableAddr := strings.TrimPrefix(unreachable.URL, "http://")
+	unreachable.Close()
+
+	tests := map[string]struct {
+		addr        func(t *testing.T) string
+		wantStatus  int
+		wantForward bool
+	}{
+		"backend answering 200": {
+			addr:        serverAddr(http.StatusOK),
+			wantStatus:  http.StatusOK,
+			wantForward: true,
+		},
+		"backend answering 404": {
+			addr:        serverAddr(http.StatusNotFound),
+			wantStatus:  http.StatusNotFound,
+			wantForward: true,
+		},
+		"backend answering 502 fast": {
+			addr:        serverAddr(http.StatusBadGateway),
+			wantStatus:  http.StatusBadGateway,
+			wantForward: false,
+		},
+		"backend refusing connections": {
+			addr:        func(t *testing.T) string { return unreachableAddr },
+			wantStatus:  http.StatusBadGateway,
+			wantForward: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := newForwardHandler(test.addr(t), forwarderConfig{
+				slowThreshold: time.Second,
+				breaker:       circuitbreaker.Config{ConsecutiveFailures: 3, OpenDuration: time.Hour},
+			})
+			for i := 0; i < 3; i++ {
+				res := httptest.NewRecorder()
+				h.Forward(res, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"foo":123}`)))
+				if res.Code != test.wantStatus {
+					t.Fatalf("got status %d want %d", res.Code, test.wantStatus)
+				}
+			}
+			if h.CanForward() != test.wantForward {
+				t.Fatalf("got can forward %v want %v", h.CanForward(), test.wantForward)
+			}
+		})
+	}
+}
+
+func serverAddr(status int) func(t *testing.T) string {
+	return func(t *testing.T) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(status)
+		}))
+		t.Cleanup(server.Close)
+		return strings.TrimPrefix(server.URL, "http://")
+	}
+}
+
+func TestForwardTimeouts(t *testing.T) {
+	tests := map[string]struct {
+		timeouts     TimeoutConfig
+		delay        time.Duration
+		clientHeader string
+		wantStatus   int
+		wantDeadline func(ms int) bool
+	}{
+		"no timeouts": {
+			clientHeader: "10",
+			wantStatus:   http.StatusOK,
+			wantDeadline: func(ms int) bool { return ms == -1 },
+		},
+		"answers in time": {
+			timeouts:     TimeoutConfig{Connect: time.Second, ResponseHeader: time.Second, Total: 2 * time.Second},
+			wantStatus:   http.StatusOK,
+			wantDeadline: func(ms int) bool { return ms > 1000 && ms <= 2000 },
+		},
+		"hangs before answering": {
+			timeouts:     TimeoutConfig{ResponseHeader: 50 * time.Millisecond},
+			delay:        time.Second,
+			wantStatus:   http.StatusGatewayTimeout,
+			wantDeadline: func(ms int) bool { return ms == -1 },
+		},
+		"takes longer than the total": {
+			timeouts:     TimeoutConfig{Total: 50 * time.Millisecond},
+			delay:        time.Second,
+			wantStatus:   http.StatusGatewayTimeout,
+			wantDeadline: func(ms int) bool { return ms >= 0 && ms <= 50 },
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			gotDeadline := make(chan int, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				ms, err := strconv.Atoi(req.Header.Get(deadline.Header))
+				if err != nil {
+					ms = -1
+				}
+				gotDeadline <- ms
+				select {
+				case <-time.After(test.delay):
+				case <-req.Context().Done():
+				}
+			}))
+			defer server.Close()
+
+			h := newForwardHandler(strings.TrimPrefix(server.URL, "http://"), forwarderConfig{slowThreshold: time.Second, transport: transportSettings{timeouts: test.timeouts, transport: DefaultTransportConfig()}})
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.clientHeader != "" {
+				req.Header.Set(deadline.Header, test.clientHeader)
+			}
+			res := httptest.NewRecorder()
+			start := time.Now()
+			h.Forward(res, req)
+
+			if res.Code != test.wantStatus {
+				t.Fatalf("got status %d want %d", res.Code, test.wantStatus)
+			}
+			if took := time.Since(start); took > test.delay/2+500*time.Millisecond {
+				t.Fatalf("took %v, the timeout didn't cut it short", took)
+			}
+			if ms := <-gotDeadline; !test.wantDeadline(ms) {
+				t.Fatalf("backend got unexpected deadline header %d", ms)
+			}
+		})
+	}
+}
+
+func TestForwardReusesConnections(t *testing.T) {
+	tests := map[string]struct {
+		transport  TransportConfig
+		wantNew    uint64
+		wantReused uint64
+	}{
+		"idle connections kept": {
+			transport:  DefaultTransportConfig(),
+			wantNew:    1,
+			wantReused: 4,
+		},
+		"no idle connections": {
+			transport:  TransportConfig{MaxIdleConnsPerHost: -1},
+			wantNew:    5,
+			wantReused: 0,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := newForwardHandler(serverAddr(http.StatusOK)(t), forwarderConfig{
+				slowThreshold: time.Second,
+				transport:     transportSettings{transport: test.transport},
+			})
+			for i := 0; i < 5; i++ {
+				h.Forward(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			}
+
+			status := h.Status()
+			if status.ConnsNew != test.wantNew || status.ConnsReused != test.wantReused {
+				t.Fatalf("got %d new and %d reused connections, want %d and %d", status.ConnsNew, status.ConnsReused, test.wantNew, test.wantReused)
+			}
+		})
+	}
+}
+
+func TestForwardConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	h := newForwardHandler(strings.TrimPrefix(server.URL, "http://"), forwarderConfig{
+		slowThreshold: time.Second,
+		concurrency:   concurrency.Config{Algorithm: concurrency.AIMD, InitialLimit: 2, LatencyThreshold: time.Minute},
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		if !h.CanForward() {
+			t.Fatalf("can't forward call %d, below the limit", i)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.Forward(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}()
+	}
+	for h.InFlight() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if h.CanForward() {
+		t.Fatalf("can forward at the limit")
+	}
+
+	// both calls were fast while the backend was busy, the limit grows
+	close(release)
+	wg.Wait()
+	if !h.CanForward() || h.Status().ConcurrencyLimit != 3 {
+		t.Fatalf("got can forward %v and limit %d, want true and 3", h.CanForward(), h.Status().ConcurrencyLimit)
+	}
+}
+
+func TestForwardHTTPS(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	routerCert, routerKey := ca.Issue(t, "router")
+	server := newTLSBackend(t, ca, "backend", "127.0.0.1")
+	// a certificate of the same CA, for another backend
+	impostor := newTLSBackend(t, ca, "impostor", "10.0.0.1", "other.test")
+	trusted := tlsconfig.Config{CertFile: routerCert, KeyFile: routerKey, CAFile: ca.CertFile}
+
+	tests := map[string]struct {
+		cfg        tlsconfig.Config
+		backend    *httptest.Server
+		wantStatus int
+	}{
+		"router certificate":   {cfg: trusted, backend: server, wantStatus: http.StatusOK},
+		"no certificate":       {cfg: tlsconfig.Config{CAFile: ca.CertFile}, backend: server, wantStatus: http.StatusBadGateway},
+		"backend not trusted":  {cfg: tlsconfig.Config{CertFile: routerCert, KeyFile: routerKey}, backend: server, wantStatus: http.StatusBadGateway},
+		"other backend's cert": {cfg: trusted, backend: impostor, wantStatus: http.StatusBadGateway},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			files, err := loadTLS(test.cfg)
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			h := newForwardHandler(test.backend.URL, forwarderConfig{
+				slowThreshold: time.Second,
+				transport:     transportSettings{tls: files},
+			})
+			rec := httptest.NewRecorder()
+			h.Forward(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != test.wantStatus {
+				t.Fatalf("got status %d, want %d", rec.Code, test.wantStatus)
+			}
+		})
+	}
+}
+
+// newTLSBackend starts a backend that presents a certificate of ca for names, and asks for the router's.
+func newTLSBackend(t *testing.T, ca *tlstest.CA, name string, names ...string) *httptest.Server {
+	certFile, keyFile := ca.Issue(t, name, names...)
+	files, err := tlsconfig.Load(tlsconfig.Config{CertFile: certFile, KeyFile: keyFile, CAFile: ca.CertFile})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	server.TLS = files.ServerConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
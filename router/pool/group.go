@@ -0,0 +1,190 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mrbarrel/lib/tlsconfig"
+	"slices"
+	"sync"
+)
+
+// DefaultPool gets the clients that don't name a pool and the requests no route matches.
+const DefaultPool = "default"
+
+// Group holds the named pools, created on first use with the same PoolConfig.
+type Group struct {
+	lock sync.Mutex
+	cfg  *PoolConfig
+	// tlsFiles is shared by the pools.
+	tlsFiles *tlsconfig.Files
+	pools    map[string]*ForwarderPool
+	// configured are the pools clients can register to, besides DefaultPool.
+	configured map[string]bool
+	// ctx is set once Run is called, pools created after that are started right away.
+	ctx context.Context
+	wg  sync.WaitGroup
+}
+
+func NewGroup(cfg *PoolConfig) (*Group, error) {
+	// fail early instead of on the first pool that gets created
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	tlsFiles, err := loadTLS(cfg.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	return &Group{
+		cfg:        cfg,
+		tlsFiles:   tlsFiles,
+		pools:      map[string]*ForwarderPool{},
+		configured: map[string]bool{},
+	}, nil
+}
+
+// Pool returns the named pool, creating it if needed. The empty name is DefaultPool.
+func (g *Group) Pool(name string) (ForwarderProvider, ClientRegistrar) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	p := g.pool(name)
+	return p, p
+}
+
+// Registrar is Pool for registering clients, false when the pool isn't configured.
+func (g *Group) Registrar(name string) (ClientRegistrar, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	name = poolName(name)
+	if name != DefaultPool && !g.configured[name] {
+		return nil, false
+	}
+	return g.pool(name), true
+}
+
+// SetPools sets the pools clients can register to, besides DefaultPool.
+func (g *Group) SetPools(names []string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	configured := make(map[string]bool, len(names))
+	for _, name := range names {
+		configured[poolName(name)] = true
+	}
+	g.configured = configured
+}
+
+// Lookup returns the pool with the given name, without creating it.
+func (g *Group) Lookup(name string) (ForwarderProvider, ClientRegistrar, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	p, ok := g.pools[poolName(name)]
+	if !ok {
+		return nil, nil, false
+	}
+	return p, p, true
+}
+
+// Names returns the names of all pools, sorted.
+func (g *Group) Names() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	res := make([]string, 0, len(g.pools))
+	for name := range g.pools {
+		res = append(res, name)
+	}
+	slices.Sort(res)
+	return res
+}
+
+// Run runs all pools until ctx is done.
+func (g *Group) Run(ctx context.Context) {
+	g.lock.Lock()
+	g.ctx = ctx
+	for _, p := range g.pools {
+		g.start(p)
+	}
+	g.lock.Unlock()
+
+	<-ctx.Done()
+	g.wg.Wait()
+}
+
+// Reconfigure applies cfg to all pools, the previous config is kept when it fails.
+func (g *Group) Reconfigure(cfg *PoolConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	tlsFiles := g.tlsFiles
+	if !cfg.TLS.Equal(g.cfg.TLS) {
+		var err error
+		if tlsFiles, err = loadTLS(cfg.TLS); err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+	}
+	var errs []error
+	for _, p := range g.pools {
+		errs = append(errs, p.reconfigure(cfg, tlsFiles))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	g.cfg, g.tlsFiles = cfg, tlsFiles
+	return nil
+}
+
+// SetStaticClients sets the static clients of every pool.
+func (g *Group) SetStaticClients(clients []StaticClient) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	perPool := map[string][]StaticClient{}
+	for _, c := range clients {
+		name := poolName(c.Pool)
+		perPool[name] = append(perPool[name], c)
+	}
+	for name := range perPool {
+		g.pool(name)
+	}
+	for name, p := range g.pools {
+		p.SetStaticClients(perPool[name])
+	}
+}
+
+// pool must be called with the lock held.
+func (g *Group) pool(name string) *ForwarderPool {
+	name = poolName(name)
+	if p, ok := g.pools[name]; ok {
+		return p
+	}
+
+	p, err := newForwarderPool(g.cfg, g.tlsFiles)
+	if err != nil {
+		// the config was checked, and its TLS files loaded, by NewGroup and Reconfigure
+		panic(err)
+	}
+	g.pools[name] = p
+	if g.ctx != nil {
+		g.start(p)
+	}
+	logger.Info("created pool", "pool", name)
+	return p
+}
+
+// start must be called with the lock held.
+func (g *Group) start(p *ForwarderPool) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		p.Run(g.ctx)
+	}()
+}
+
+func poolName(name string) string {
+	if name == "" {
+		return DefaultPool
+	}
+	return name
+}
@@ -0,0 +1,107 @@
+package pool
+
+import (
+	"mrbarrel/lib/tlsconfig"
+	"mrbarrel/lib/tlsconfig/tlstest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGroup(t *testing.T) {
+	if _, err := NewGroup(&PoolConfig{Balancer: &BalancerConfig{Strategy: "random"}}); err == nil {
+		t.Fatalf("expected error for unknown balancer")
+	}
+
+	g, err := NewGroup(&PoolConfig{MaxAgeNoNotif: time.Hour, SlowThreshold: time.Second})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if _, _, ok := g.Lookup("payments"); ok {
+		t.Fatalf("lookup created a pool")
+	}
+
+	_, registrar := g.Pool("")
+	registrar.RegisterClient("purple", 1)
+	_, registrar = g.Pool("payments")
+	registrar.RegisterClient("green", 1)
+	g.SetStaticClients([]StaticClient{{Addr: "yellow", Weight: 1, Pool: "shop"}})
+
+	if got, want := g.Names(), []string{DefaultPool, "payments", "shop"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got pools %v want %v", got, want)
+	}
+	for name, want := range map[string]string{DefaultPool: "purple", "payments": "green", "shop": "yellow"} {
+		clients, _, ok := g.Lookup(name)
+		if !ok {
+			t.Fatalf("pool %s not found", name)
+		}
+		if got := clients.Statuses(); len(got) != 1 || got[0].Addr != want {
+			t.Fatalf("got %v in pool %s, want only %s", got, name, want)
+		}
+	}
+
+	if err := g.Reconfigure(&PoolConfig{Balancer: &BalancerConfig{Strategy: "random"}}); err == nil {
+		t.Fatalf("expected error for unknown balancer")
+	}
+}
+
+func TestGroupTLSFiles(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	missing := tlsconfig.Config{CAFile: ca.CertFile + ".missing"}
+
+	if _, err := NewGroup(&PoolConfig{MaxAgeNoNotif: time.Hour, SlowThreshold: time.Second, TLS: missing}); err == nil {
+		t.Fatalf("expected error for a missing CA file")
+	}
+
+	cfg := &PoolConfig{MaxAgeNoNotif: time.Hour, SlowThreshold: time.Second, TLS: tlsconfig.Config{CAFile: ca.CertFile}}
+	g, err := NewGroup(cfg)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	_, registrar := g.Pool("")
+	registrar.RegisterClient("purple", 1)
+
+	if err := g.Reconfigure(&PoolConfig{MaxAgeNoNotif: time.Hour, SlowThreshold: time.Second, TLS: missing}); err == nil {
+		t.Fatalf("expected error for a missing CA file")
+	}
+	// the rejected config isn't used for the pools created after it
+	_, registrar = g.Pool("payments")
+	registrar.RegisterClient("green", 1)
+	if g.cfg != cfg {
+		t.Fatalf("got config %+v after a rejected reconfigure, want the previous one", g.cfg)
+	}
+}
+
+func TestGroupRegistrar(t *testing.T) {
+	g, err := NewGroup(&PoolConfig{MaxAgeNoNotif: time.Hour, SlowThreshold: time.Second})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	g.SetPools([]string{"payments"})
+
+	tests := []struct {
+		name   string
+		pools  []string
+		pool   string
+		wantOK bool
+	}{
+		{name: "default pool", pool: "", wantOK: true},
+		{name: "configured pool", pool: "payments", wantOK: true},
+		{name: "unknown pool", pool: "shop"},
+		{name: "pool added by a reload", pools: []string{"shop"}, pool: "shop", wantOK: true},
+		{name: "pool removed by a reload", pool: "payments"},
+	}
+
+	// steps depend on each other, so no map here
+	for _, test := range tests {
+		if test.pools != nil {
+			g.SetPools(test.pools)
+		}
+		if _, ok := g.Registrar(test.pool); ok != test.wantOK {
+			t.Fatalf("%s: got %t want %t", test.name, ok, test.wantOK)
+		}
+	}
+	if got, want := g.Names(), []string{DefaultPool, "payments", "shop"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got pools %v want %v", got, want)
+	}
+}
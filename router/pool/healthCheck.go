@@ -0,0 +1,147 @@
+package pool
+
+import (
+	"context"
+	"mrbarrel/lib/logging"
+	"mrbarrel/lib/tlsconfig"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type HealthCheckConfig struct {
+	// Path is requested on every client, health checking is disabled when empty.
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// UnhealthyThreshold is the number of failed checks in a row to mark a client unhealthy.
+	UnhealthyThreshold int
+	// HealthyThreshold is the number of good checks in a row to mark it healthy again.
+	HealthyThreshold int
+}
+
+type probeCounts struct {
+	successes int
+	failures  int
+}
+
+// healthChecker probes the clients of the pool, wedged ones keep sending heartbeats.
+type healthChecker struct {
+	cfg      *HealthCheckConfig
+	client   *http.Client
+	tlsFiles *tlsconfig.Files
+	// only touched from the checker's own goroutine, no locking needed.
+	counts map[string]*probeCounts
+	// tlsClients has a client per backend with TLS, to verify its host.
+	tlsClients map[string]*http.Client
+}
+
+func newHealthChecker(cfg *HealthCheckConfig, tlsFiles *tlsconfig.Files) *healthChecker {
+	return &healthChecker{
+		cfg:        cfg,
+		client:     &http.Client{Timeout: cfg.Timeout},
+		tlsFiles:   tlsFiles,
+		counts:     map[string]*probeCounts{},
+		tlsClients: map[string]*http.Client{},
+	}
+}
+
+func (hc *healthChecker) clientFor(host string) *http.Client {
+	if hc.tlsFiles == nil {
+		return hc.client
+	}
+	client, found := hc.tlsClients[host]
+	if !found {
+		uri, _ := url.Parse(backendURL(host))
+		rt := http.DefaultTransport.(*http.Transport).Clone()
+		rt.TLSClientConfig = hc.tlsFiles.ClientConfig(uri.Hostname())
+		client = &http.Client{Timeout: hc.cfg.Timeout, Transport: rt}
+		hc.tlsClients[host] = client
+	}
+	return client
+}
+
+func (hc *healthChecker) run(ctx context.Context, entries func() []Forwarder) {
+	t := time.NewTicker(hc.cfg.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			hc.checkAll(ctx, entries())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkAll probes all entries in parallel and waits for all of them, so rounds never overlap.
+func (hc *healthChecker) checkAll(ctx context.Context, entries []Forwarder) {
+	results := make([]bool, len(entries))
+	var wg sync.WaitGroup
+	wg.Add(len(entries))
+	for i, e := range entries {
+		client := hc.clientFor(e.Host())
+		go func(i int, e Forwarder) {
+			defer wg.Done()
+			results[i] = hc.probe(ctx, client, e)
+		}(i, e)
+	}
+	wg.Wait()
+
+	present := make(map[string]bool, len(entries))
+	for i, e := range entries {
+		present[e.Host()] = true
+		hc.track(e, results[i])
+	}
+	for host := range hc.counts {
+		if !present[host] {
+			delete(hc.counts, host)
+		}
+	}
+	for host, client := range hc.tlsClients {
+		if !present[host] {
+			client.CloseIdleConnections()
+			delete(hc.tlsClients, host)
+		}
+	}
+}
+
+func (hc *healthChecker) probe(ctx context.Context, client *http.Client, e Forwarder) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, backendURL(e.Host())+hc.cfg.Path, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+func (hc *healthChecker) track(e Forwarder, ok bool) {
+	counts, found := hc.counts[e.Host()]
+	if !found {
+		counts = &probeCounts{}
+		hc.counts[e.Host()] = counts
+	}
+
+	if ok {
+		counts.successes++
+		counts.failures = 0
+		if !e.Healthy() && counts.successes >= hc.cfg.HealthyThreshold {
+			logger.Info("backend healthy again", logging.BackendKey, e.Host(), "successes", counts.successes)
+			e.SetHealthy(true)
+		}
+		return
+	}
+
+	counts.failures++
+	counts.successes = 0
+	if e.Healthy() && counts.failures >= hc.cfg.UnhealthyThreshold {
+		logger.Warn("backend marked unhealthy", logging.BackendKey, e.Host(), "failures", counts.failures)
+		e.SetHealthy(false)
+	}
+}
@@ -0,0 +1,135 @@
+package pool
+
+import (
+	"context"
+	"mrbarrel/lib/tlsconfig"
+	"mrbarrel/lib/tlsconfig/tlstest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	hc := newHealthChecker(&HealthCheckConfig{
+		Path:               "/healthz",
+		Timeout:            time.Second,
+		UnhealthyThreshold: 3,
+		HealthyThreshold:   2,
+	}, nil)
+	entry := newForwardHandler(strings.TrimPrefix(server.URL, "http://"), forwarderConfig{slowThreshold: time.Second})
+	entries := []Forwarder{entry}
+
+	steps := []struct {
+		status      int
+		wantHealthy bool
+	}{
+		{status: http.StatusOK, wantHealthy: true},
+		{status: http.StatusInternalServerError, wantHealthy: true},
+		{status: http.StatusInternalServerError, wantHealthy: true},
+		{status: http.StatusInternalServerError, wantHealthy: false},
+		{status: http.StatusOK, wantHealthy: false},
+		{status: http.StatusServiceUnavailable, wantHealthy: false},
+		{status: http.StatusOK, wantHealthy: false},
+		{status: http.StatusOK, wantHealthy: true},
+	}
+
+	for i, step := range steps {
+		status.Store(int32(step.status))
+		hc.checkAll(context.Background(), entries)
+		if entry.Healthy() != step.wantHealthy {
+			t.Fatalf("step %d: got healthy %v want %v", i, entry.Healthy(), step.wantHealthy)
+		}
+		if entry.CanForward() != step.wantHealthy {
+			t.Fatalf("step %d: got can forward %v want %v", i, entry.CanForward(), step.wantHealthy)
+		}
+	}
+}
+
+func TestHealthCheckUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	addr := strings.TrimPrefix(server.URL, "http://")
+	server.Close()
+
+	hc := newHealthChecker(&HealthCheckConfig{
+		Path:               "/healthz",
+		Timeout:            time.Second,
+		UnhealthyThreshold: 1,
+		HealthyThreshold:   1,
+	}, nil)
+	entry := newForwardHandler(addr, forwarderConfig{slowThreshold: time.Second})
+	hc.checkAll(context.Background(), []Forwarder{entry})
+	if entry.Healthy() {
+		t.Fatalf("expected unreachable client to be unhealthy")
+	}
+
+	// removed clients are forgotten
+	hc.checkAll(context.Background(), []Forwarder{})
+	if len(hc.counts) != 0 {
+		t.Fatalf("got %d tracked clients want 0", len(hc.counts))
+	}
+}
+
+func TestHealthCheckTLS(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	routerCert, routerKey := ca.Issue(t, "router")
+	files, err := loadTLS(tlsconfig.Config{CertFile: routerCert, KeyFile: routerKey, CAFile: ca.CertFile})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	backend := newForwardHandler(newTLSBackend(t, ca, "backend", "127.0.0.1").URL, forwarderConfig{slowThreshold: time.Second})
+	impostor := newForwardHandler(newTLSBackend(t, ca, "impostor", "10.0.0.1").URL, forwarderConfig{slowThreshold: time.Second})
+
+	hc := newHealthChecker(&HealthCheckConfig{
+		Path:               "/healthz",
+		Timeout:            time.Second,
+		UnhealthyThreshold: 1,
+		HealthyThreshold:   1,
+	}, files)
+	hc.checkAll(context.Background(), []Forwarder{backend, impostor})
+	if !backend.Healthy() || impostor.Healthy() {
+		t.Fatalf("got healthy %v and %v, want the backend healthy and not the impostor", backend.Healthy(), impostor.Healthy())
+	}
+
+	// the clients of removed backends are closed
+	hc.checkAll(context.Background(), []Forwarder{backend})
+	if len(hc.tlsClients) != 1 {
+		t.Fatalf("got %d clients want 1", len(hc.tlsClients))
+	}
+}
+
+func TestNextSkipsUnhealthy(t *testing.T) {
+	pool := &ForwarderPool{
+		maxAgeNoNotif: time.Hour,
+		balancer:      &roundRobin{},
+		entries:       []Forwarder{},
+		notifTimes:    map[string]time.Time{},
+	}
+	pool.RegisterClient("purple", 1)
+	pool.RegisterClient("green", 1)
+	pool.RegisterClient("yellow", 1)
+	pool.entries[1].SetHealthy(false)
+
+	for i := 0; i < 6; i++ {
+		n, err := pool.Next(nil)
+		if err != nil {
+			t.Fatalf("got unexpected error: %v", err)
+		}
+		if n.Host() == "green" {
+			t.Fatalf("got unhealthy client")
+		}
+	}
+}
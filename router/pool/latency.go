@@ -0,0 +1,62 @@
+package pool
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// number of recent call durations a pool keeps to compute its latency percentiles.
+	latencyWindowSize = 1000
+	// percentiles of fewer calls than this say too little, none are given.
+	minLatencySamples = 20
+	// the percentiles are computed again after this many new calls, instead of on every ask.
+	latencyRefresh = 50
+)
+
+// latencyWindow keeps the durations of the last calls the Forwarders of a pool answered.
+type latencyWindow struct {
+	lock    sync.Mutex
+	samples []time.Duration
+	next    int
+	sorted  []time.Duration
+	added   int
+}
+
+func newLatencyWindow() *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, 0, latencyWindowSize)}
+}
+
+// add is a no-op on a nil window, Forwarders that aren't part of a pool don't track their latency.
+func (w *latencyWindow) add(d time.Duration) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, d)
+	} else {
+		w.samples[w.next] = d
+	}
+	w.next = (w.next + 1) % latencyWindowSize
+	w.added++
+}
+
+// percentile returns the p (0-1) percentile of the recent calls, false when there are too few.
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.samples) < minLatencySamples {
+		return 0, false
+	}
+	if w.sorted == nil || w.added >= latencyRefresh {
+		w.sorted = slices.Clone(w.samples)
+		slices.Sort(w.sorted)
+		w.added = 0
+	}
+	idx := int(math.Ceil(p*float64(len(w.sorted)))) - 1
+	return w.sorted[min(max(idx, 0), len(w.sorted)-1)], true
+}
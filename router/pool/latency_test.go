@@ -0,0 +1,51 @@
+package pool
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyPercentile(t *testing.T) {
+	tests := map[string]struct {
+		samples int
+		p       float64
+		want    time.Duration
+		wantOk  bool
+	}{
+		"too few calls": {
+			samples: minLatencySamples - 1,
+			p:       0.95,
+		},
+		"p95": {
+			samples: 100,
+			p:       0.95,
+			want:    95 * time.Millisecond,
+			wantOk:  true,
+		},
+		"p50": {
+			samples: 100,
+			p:       0.5,
+			want:    50 * time.Millisecond,
+			wantOk:  true,
+		},
+		"only the last calls count": {
+			samples: latencyWindowSize + 500,
+			p:       0,
+			want:    501 * time.Millisecond,
+			wantOk:  true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := newLatencyWindow()
+			for i := 1; i <= test.samples; i++ {
+				w.add(time.Duration(i) * time.Millisecond)
+			}
+			got, ok := w.percentile(test.p)
+			if ok != test.wantOk || got != test.want {
+				t.Fatalf("got %v, %v want %v, %v", got, ok, test.want, test.wantOk)
+			}
+		})
+	}
+}
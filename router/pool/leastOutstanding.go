@@ -0,0 +1,40 @@
+package pool
+
+import "net/http"
+
+// leastOutstanding picks the entry with the fewest requests in flight, round robin on ties.
+type leastOutstanding struct {
+	startIdx int
+}
+
+func (b *leastOutstanding) Pick(entries []Forwarder, _ *http.Request) (Forwarder, error) {
+	if b.startIdx >= len(entries) {
+		b.startIdx = 0
+	}
+
+	var best Forwarder
+	bestIdx := 0
+	for n := 0; n < len(entries); n++ {
+		idx := (b.startIdx + n) % len(entries)
+		e := entries[idx]
+		if !e.CanForward() {
+			continue
+		}
+		if best == nil || e.InFlight() < best.InFlight() {
+			best = e
+			bestIdx = idx
+		}
+	}
+	if best == nil {
+		return nil, errNoClientsAvailable
+	}
+
+	b.startIdx = (bestIdx + 1) % len(entries)
+	return best, nil
+}
+
+func (b *leastOutstanding) Update(entries []Forwarder) {
+	if b.startIdx >= len(entries) {
+		b.startIdx = 0
+	}
+}
@@ -3,113 +3,243 @@ package pool
 import (
 	"context"
 	"errors"
-	"log"
+	"fmt"
+	"mrbarrel/lib/logging"
+	"mrbarrel/lib/tlsconfig"
+	"mrbarrel/router/pool/circuitbreaker"
+	"mrbarrel/router/pool/concurrency"
+	"net/http"
 	"sync"
 	"time"
 )
 
 var errEmptyClients = errors.New("empty hosts list to proxy request to")
 var errNoClientsAvailable = errors.New("no available host to proxy request to")
+var ErrUnknownClient = errors.New("unknown client")
 
 type ForwarderProvider interface {
-	Next() (Forwarder, error)
+	Next(req *http.Request) (Forwarder, error)
 	Run(ctx context.Context)
+	// Statuses returns the status of every Forwarder in the pool.
+	Statuses() []ForwarderStatus
+	// Reconfigure applies cfg to the pool and its Forwarders.
+	Reconfigure(cfg *PoolConfig) error
+	// LatencyPercentile returns the p (0-1) percentile of the recent calls, false when there were too few.
+	LatencyPercentile(p float64) (time.Duration, bool)
 }
 
 type ClientRegistrar interface {
-	RegisterClient(addr string)
+	RegisterClient(addr string, weight int)
 	DeRegisterClient(addr string)
+	// DrainClient, DisableClient and EnableClient return ErrUnknownClient for clients not in the pool.
+	DrainClient(addr string) error
+	DisableClient(addr string) error
+	EnableClient(addr string) error
+	// ClientStatus returns the status of a single client, or ErrUnknownClient.
+	ClientStatus(addr string) (ForwarderStatus, error)
+	// SetStaticClients replaces the clients that are in the pool without registering themselves.
+	SetStaticClients(clients []StaticClient)
 }
 
+var logger = logging.Logger(logging.Pool)
+
 type PoolConfig struct {
 	MaxAgeNoNotif time.Duration
 	SlowThreshold time.Duration
+	// Balancer picks the Forwarder of each request, defaults to weighted round robin.
+	Balancer *BalancerConfig
+	// HealthCheck enables active health checking of the clients when set. It's only read by NewPool.
+	HealthCheck *HealthCheckConfig
+	// Breaker configures the circuit breaker of every client, the zero value never trips.
+	Breaker circuitbreaker.Config
+	// Concurrency limits the calls in flight per client, the zero value doesn't.
+	Concurrency concurrency.Config
+	// Affinity keeps clients on the same backend when set.
+	Affinity *AffinityConfig
+	// Timeouts bound the calls to the clients, the zero value waits forever.
+	Timeouts TimeoutConfig
+	// Transport tunes the connections to the clients, defaults to DefaultTransportConfig.
+	Transport *TransportConfig
+	// TLS is used to call the clients that registered an https:// address.
+	TLS tlsconfig.Config
 }
 
 type ForwarderPool struct {
 	lock          sync.Mutex
 	maxAgeNoNotif time.Duration
-	lastEntryIdx  int
+	balancer      Balancer
+	affinity      *affinity
 	entries       []Forwarder
 	notifTimes    map[string]time.Time
-	slowThreshold time.Duration
+	// static clients never expire, they don't send heartbeats.
+	static        map[string]bool
+	forwarderCfg  forwarderConfig
+	healthChecker *healthChecker
+	latencies     *latencyWindow
+	// tlsFiles is nil without TLS config.
+	tlsCfg   tlsconfig.Config
+	tlsFiles *tlsconfig.Files
 }
 
-func NewPool(cfg *PoolConfig) (ForwarderProvider, ClientRegistrar) {
+func NewPool(cfg *PoolConfig) (ForwarderProvider, ClientRegistrar, error) {
+	tlsFiles, err := loadTLS(cfg.TLS)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := newForwarderPool(cfg, tlsFiles)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, p, nil
+}
+
+// newForwarderPool creates a pool calling the https:// clients with tlsFiles, loaded from cfg.TLS.
+func newForwarderPool(cfg *PoolConfig, tlsFiles *tlsconfig.Files) (*ForwarderPool, error) {
+	balancer, err := cfg.newBalancer()
+	if err != nil {
+		return nil, err
+	}
+	affinity, err := newAffinity(cfg.Affinity)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Concurrency.Validate(); err != nil {
+		return nil, err
+	}
+	latencies := newLatencyWindow()
 	p := &ForwarderPool{
 		maxAgeNoNotif: cfg.MaxAgeNoNotif,
-		lastEntryIdx:  0,
+		balancer:      balancer,
+		affinity:      affinity,
 		entries:       []Forwarder{},
 		notifTimes:    map[string]time.Time{},
-		slowThreshold: cfg.SlowThreshold,
+		static:        map[string]bool{},
+		forwarderCfg: forwarderConfig{
+			slowThreshold: cfg.SlowThreshold,
+			breaker:       cfg.Breaker,
+			concurrency:   cfg.Concurrency,
+			transport:     cfg.transportSettings(tlsFiles),
+			latencies:     latencies,
+		},
+		latencies: latencies,
+		tlsCfg:    cfg.TLS,
+		tlsFiles:  tlsFiles,
+	}
+	if cfg.HealthCheck != nil && cfg.HealthCheck.Path != "" {
+		p.healthChecker = newHealthChecker(cfg.HealthCheck, tlsFiles)
 	}
-	return p, p
+	return p, nil
 }
 
-func (cp *ForwarderPool) Next() (Forwarder, error) {
-	cp.lock.Lock()
-	defer cp.lock.Unlock()
+// newBalancer creates a Balancer for a single pool, they have state.
+func (cfg *PoolConfig) newBalancer() (Balancer, error) {
+	if cfg.Balancer == nil {
+		return newWeightedRoundRobin(), nil
+	}
+	return NewBalancer(cfg.Balancer)
+}
 
-	if len(cp.entries) == 0 {
-		return nil, errEmptyClients
+func (cfg *PoolConfig) transportSettings(tlsFiles *tlsconfig.Files) transportSettings {
+	transport := DefaultTransportConfig()
+	if cfg.Transport != nil {
+		transport = *cfg.Transport
 	}
+	return transportSettings{timeouts: cfg.Timeouts, transport: transport, tls: tlsFiles}
+}
 
-	if cp.lastEntryIdx >= len(cp.entries) {
-		cp.lastEntryIdx = 0
+// loadTLS returns nil when cfg is empty.
+func loadTLS(cfg tlsconfig.Config) (*tlsconfig.Files, error) {
+	if cfg.IsZero() {
+		return nil, nil
 	}
+	return tlsconfig.Load(cfg)
+}
 
-	idx := cp.lastEntryIdx
+// Validate checks cfg without reading the TLS files.
+func (cfg *PoolConfig) Validate() error {
+	if _, err := cfg.newBalancer(); err != nil {
+		return err
+	}
+	if err := cfg.Concurrency.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.TLS.Validate(); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	_, err := newAffinity(cfg.Affinity)
+	return err
+}
 
-	var hostEntry Forwarder
-	found := false
-	// check whether this Forwarder can actually handle the call; if not, try the next one.
-	// If you went through the complete list and haven't found anything, return error.
-	for {
-		hostEntry = cp.entries[idx]
-		idx++
-		if hostEntry.CanForward() {
-			found = true
-			break
-		}
+func (cp *ForwarderPool) Next(req *http.Request) (Forwarder, error) {
+	if kb, ok := cp.currentBalancer().(keyedBalancer); ok && req != nil {
+		req = kb.withKey(req)
+	}
 
-		if idx >= len(cp.entries) {
-			idx = 0
-		}
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
 
-		if idx == cp.lastEntryIdx {
-			break
-		}
+	if len(cp.entries) == 0 {
+		return nil, errEmptyClients
 	}
-	if !found {
-		return nil, errNoClientsAvailable
+
+	if cp.affinity == nil {
+		return cp.balancer.Pick(cp.entries, req)
+	}
+	if f := cp.affinity.pick(cp.entries, req); f != nil {
+		return f, nil
+	}
+	f, err := cp.balancer.Pick(cp.entries, req)
+	if err != nil {
+		return nil, err
 	}
+	return cp.affinity.bind(f, req), nil
+}
 
-	cp.lastEntryIdx = idx
-	return hostEntry, nil
+func (cp *ForwarderPool) currentBalancer() Balancer {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	return cp.balancer
 }
 
-func (cp *ForwarderPool) RegisterClient(addr string) {
+func (cp *ForwarderPool) RegisterClient(addr string, weight int) {
 	cp.lock.Lock()
 	defer cp.lock.Unlock()
 	if _, ok := cp.notifTimes[addr]; ok {
-		// we already have this addr, only update the last notif time
+		// we already have this addr, only update the last notif time & the weight in case it changed
 		cp.notifTimes[addr] = time.Now()
+		cp.setWeight(addr, weight)
 		return
 	}
 
 	// this is a new client
-	cp.entries = append(cp.entries, newForwardHandler(addr, cp.slowThreshold))
+	entry := newForwardHandler(addr, cp.forwarderCfg)
+	entry.SetWeight(weight)
+	cp.entries = append(cp.entries, entry)
 	cp.notifTimes[addr] = time.Now()
-	log.Printf("INFO: added client %s for a total of %d", addr, len(cp.entries))
+	cp.balancer.Update(cp.entries)
+	logger.Info("added backend", logging.BackendKey, addr, "weight", weight, "total", len(cp.entries))
 }
 
+// setWeight must be called with the lock held.
+func (cp *ForwarderPool) setWeight(addr string, weight int) {
+	for _, e := range cp.entries {
+		if e.Host() == addr && e.Weight() != weight {
+			logger.Info("backend changed weight", logging.BackendKey, addr, logging.FromKey, e.Weight(), logging.ToKey, weight)
+			e.SetWeight(weight)
+		}
+	}
+}
+
+// DeRegisterClient removes the client from the pool, static clients included.
 func (cp *ForwarderPool) DeRegisterClient(addr string) {
 	cp.lock.Lock()
 	defer cp.lock.Unlock()
 
 	delete(cp.notifTimes, addr)
+	delete(cp.static, addr)
 	for i := 0; i < len(cp.entries); i++ {
 		if cp.entries[i].Host() == addr {
+			cp.entries[i].close()
 			if i == len(cp.entries)-1 {
 				cp.entries = cp.entries[:i] // If it's the last element, return up to the last
 			} else {
@@ -118,29 +248,21 @@ func (cp *ForwarderPool) DeRegisterClient(addr string) {
 			break
 		}
 	}
-	if cp.lastEntryIdx >= len(cp.entries) {
-		// reset when necessary. Next() checks for proper value, but better to be explicit.
-		cp.lastEntryIdx = 0
-	}
-	log.Printf("INFO: deregistered client %s for a total of %d", addr, len(cp.entries))
+	cp.balancer.Update(cp.entries)
+	logger.Info("deregistered backend", logging.BackendKey, addr, "total", len(cp.entries))
 }
 
 func (cp *ForwarderPool) Run(ctx context.Context) {
+	if cp.healthChecker != nil {
+		go cp.healthChecker.run(ctx, cp.snapshot)
+	}
+
 	t := time.NewTicker(time.Second)
-	var needsClean bool
 
 	for {
 		select {
 		case <-t.C:
-			needsClean = false
-			for _, notifTime := range cp.notifTimes {
-				if notifTime.Add(cp.maxAgeNoNotif).Before(time.Now()) {
-					needsClean = true
-					break
-				}
-			}
-
-			if needsClean {
+			if cp.needsClean() {
 				cp.cleanPool()
 			}
 		case <-ctx.Done():
@@ -149,6 +271,136 @@ func (cp *ForwarderPool) Run(ctx context.Context) {
 	}
 }
 
+func (cp *ForwarderPool) Reconfigure(cfg *PoolConfig) error {
+	cp.lock.Lock()
+	tlsCfg, tlsFiles := cp.tlsCfg, cp.tlsFiles
+	cp.lock.Unlock()
+	if !cfg.TLS.Equal(tlsCfg) {
+		var err error
+		if tlsFiles, err = loadTLS(cfg.TLS); err != nil {
+			return err
+		}
+	}
+	return cp.reconfigure(cfg, tlsFiles)
+}
+
+// reconfigure is Reconfigure with the files of cfg.TLS already loaded.
+func (cp *ForwarderPool) reconfigure(cfg *PoolConfig, tlsFiles *tlsconfig.Files) error {
+	balancer, err := cfg.newBalancer()
+	if err != nil {
+		return err
+	}
+	affinity, err := newAffinity(cfg.Affinity)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Concurrency.Validate(); err != nil {
+		return err
+	}
+
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	cp.maxAgeNoNotif = cfg.MaxAgeNoNotif
+	cp.balancer = balancer
+	cp.balancer.Update(cp.entries)
+	cp.affinity = affinity
+	cp.forwarderCfg = forwarderConfig{
+		slowThreshold: cfg.SlowThreshold,
+		breaker:       cfg.Breaker,
+		concurrency:   cfg.Concurrency,
+		transport:     cfg.transportSettings(tlsFiles),
+		latencies:     cp.latencies,
+	}
+	cp.tlsCfg, cp.tlsFiles = cfg.TLS, tlsFiles
+	for _, e := range cp.entries {
+		e.reconfigure(cp.forwarderCfg)
+	}
+	logger.Info("pool reconfigured", "kept", len(cp.entries))
+	return nil
+}
+
+func (cp *ForwarderPool) LatencyPercentile(p float64) (time.Duration, bool) {
+	return cp.latencies.percentile(p)
+}
+
+func (cp *ForwarderPool) Statuses() []ForwarderStatus {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	res := make([]ForwarderStatus, 0, len(cp.entries))
+	for _, e := range cp.entries {
+		status := e.Status()
+		status.LastNotif = cp.notifTimes[e.Host()]
+		status.Static = cp.static[e.Host()]
+		res = append(res, status)
+	}
+	return res
+}
+
+func (cp *ForwarderPool) ClientStatus(addr string) (ForwarderStatus, error) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	for _, e := range cp.entries {
+		if e.Host() == addr {
+			status := e.Status()
+			status.LastNotif = cp.notifTimes[addr]
+			status.Static = cp.static[addr]
+			return status, nil
+		}
+	}
+	return ForwarderStatus{}, ErrUnknownClient
+}
+
+func (cp *ForwarderPool) DrainClient(addr string) error {
+	return cp.setAdminState(addr, StateDraining)
+}
+
+func (cp *ForwarderPool) DisableClient(addr string) error {
+	return cp.setAdminState(addr, StateDisabled)
+}
+
+func (cp *ForwarderPool) EnableClient(addr string) error {
+	return cp.setAdminState(addr, StateActive)
+}
+
+func (cp *ForwarderPool) setAdminState(addr string, state AdminState) error {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	for _, e := range cp.entries {
+		if e.Host() == addr {
+			logger.Info("backend changed admin state", logging.BackendKey, addr, logging.FromKey, e.AdminState(), logging.ToKey, state)
+			e.SetAdminState(state)
+			return nil
+		}
+	}
+	return ErrUnknownClient
+}
+
+// snapshot returns a copy of the current entries, safe to use without holding the lock.
+func (cp *ForwarderPool) snapshot() []Forwarder {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	res := make([]Forwarder, len(cp.entries))
+	copy(res, cp.entries)
+	return res
+}
+
+func (cp *ForwarderPool) needsClean() bool {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	for addr, notifTime := range cp.notifTimes {
+		if cp.expired(addr, notifTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// expired must be called with the lock held.
+func (cp *ForwarderPool) expired(addr string, notifTime time.Time) bool {
+	return !cp.static[addr] && notifTime.Add(cp.maxAgeNoNotif).Before(time.Now())
+}
+
 func (cp *ForwarderPool) cleanPool() {
 	cp.lock.Lock()
 	defer cp.lock.Unlock()
@@ -159,7 +411,8 @@ func (cp *ForwarderPool) cleanPool() {
 	for _, hostEntry := range cp.entries {
 		addr := hostEntry.Host()
 		notifTime := cp.notifTimes[addr]
-		if notifTime.Add(cp.maxAgeNoNotif).Before(time.Now()) {
+		if cp.expired(addr, notifTime) {
+			hostEntry.close()
 			removed = append(removed, addr)
 			continue
 		}
@@ -169,9 +422,9 @@ func (cp *ForwarderPool) cleanPool() {
 
 	cp.entries = newHostEntries
 	cp.notifTimes = newNotifTimes
-	if cp.lastEntryIdx >= len(cp.entries) {
-		// reset when necessary. Next() checks for proper value, but better to be explicit.
-		cp.lastEntryIdx = 0
+	cp.balancer.Update(cp.entries)
+	for _, addr := range removed {
+		logger.Info("expired backend", logging.BackendKey, addr)
 	}
-	log.Printf("Pool cleanup done, removed %d items. New pool size: %d", len(removed), len(cp.entries))
+	logger.Debug("pool cleanup done", "removed", len(removed), "total", len(cp.entries))
 }
@@ -1,7 +1,12 @@
 package pool
 
 import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -10,12 +15,12 @@ func TestEmptyPool(t *testing.T) {
 
 	pool := &ForwarderPool{
 		maxAgeNoNotif: time.Hour,
-		lastEntryIdx:  0,
+		balancer:      &roundRobin{},
 		entries:       []Forwarder{},
 		notifTimes:    map[string]time.Time{},
 	}
 
-	if val, err := pool.Next(); err == nil {
+	if val, err := pool.Next(nil); err == nil {
 		t.Fatalf("expected error but got %v", val)
 	}
 }
@@ -71,7 +76,7 @@ func TestPoolNext(t *testing.T) {
 				a := []Forwarder{}
 				m := map[string]time.Time{}
 				for _, e := range entries {
-					a = append(a, newForwardHandler(e, time.Second))
+					a = append(a, newForwardHandler(e, forwarderConfig{slowThreshold: time.Second}))
 					m[e] = time.Now()
 				}
 				return a, m
@@ -79,14 +84,14 @@ func TestPoolNext(t *testing.T) {
 
 			pool := &ForwarderPool{
 				maxAgeNoNotif: time.Hour, // not used in this test anyway
-				lastEntryIdx:  test.startIndex,
+				balancer:      &roundRobin{lastIdx: test.startIndex},
 				entries:       hostEntries,
 				notifTimes:    notifTimes,
 			}
 
 			var res []string
 			for i := 0; i < 10; i++ {
-				n, err := pool.Next()
+				n, err := pool.Next(nil)
 				if err != nil {
 					t.Fatalf("got unexpected error: %v", err)
 				}
@@ -134,12 +139,12 @@ func TestPoolRegisterClient(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			pool := &ForwarderPool{
 				maxAgeNoNotif: time.Hour,
-				lastEntryIdx:  0,
+				balancer:      &roundRobin{},
 				entries:       []Forwarder{},
 				notifTimes:    map[string]time.Time{},
 			}
 			for _, addr := range test.addrsToRegister {
-				pool.RegisterClient(addr)
+				pool.RegisterClient(addr, 1)
 			}
 
 			gotAddrs := []string{}
@@ -154,6 +159,39 @@ func TestPoolRegisterClient(t *testing.T) {
 	}
 }
 
+func TestPoolRegisterClientWeight(t *testing.T) {
+	pool := &ForwarderPool{
+		maxAgeNoNotif: time.Hour,
+		balancer:      newWeightedRoundRobin(),
+		entries:       []Forwarder{},
+		notifTimes:    map[string]time.Time{},
+	}
+	pool.RegisterClient("somewhere.org", 3)
+	pool.RegisterClient("there.com", 1)
+
+	var got []string
+	for i := 0; i < 8; i++ {
+		n, err := pool.Next(nil)
+		if err != nil {
+			t.Fatalf("got unexpected error: %v", err)
+		}
+		got = append(got, n.Host())
+	}
+	want := []string{"somewhere.org", "somewhere.org", "there.com", "somewhere.org", "somewhere.org", "somewhere.org", "there.com", "somewhere.org"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("list differs: got %v want %v", got, want)
+	}
+
+	// a heartbeat with a new weight updates the existing entry
+	pool.RegisterClient("there.com", 3)
+	if len(pool.entries) != 2 {
+		t.Fatalf("got %d entries want 2", len(pool.entries))
+	}
+	if w := pool.entries[1].Weight(); w != 3 {
+		t.Fatalf("got weight %d want 3", w)
+	}
+}
+
 func TestCleanPool(t *testing.T) {
 	type testHostEntry struct {
 		addr      string
@@ -204,7 +242,7 @@ func TestCleanPool(t *testing.T) {
 				a := []Forwarder{}
 				m := map[string]time.Time{}
 				for _, e := range hosts {
-					a = append(a, newForwardHandler(e.addr, time.Second))
+					a = append(a, newForwardHandler(e.addr, forwarderConfig{slowThreshold: time.Second}))
 					m[e.addr] = e.lastNotif
 				}
 				return a, m
@@ -212,6 +250,7 @@ func TestCleanPool(t *testing.T) {
 
 			pool := &ForwarderPool{
 				maxAgeNoNotif: test.maxAgeNoNotif,
+				balancer:      &roundRobin{},
 				entries:       addrs,
 				notifTimes:    notifTimes,
 			}
@@ -270,7 +309,7 @@ func TestNextAndCleanInteraction(t *testing.T) {
 				a := []Forwarder{}
 				m := map[string]time.Time{}
 				for _, e := range hosts {
-					a = append(a, newForwardHandler(e.addr, time.Second))
+					a = append(a, newForwardHandler(e.addr, forwarderConfig{slowThreshold: time.Second}))
 					m[e.addr] = e.lastNotif
 				}
 				return a, m
@@ -278,13 +317,14 @@ func TestNextAndCleanInteraction(t *testing.T) {
 
 			pool := &ForwarderPool{
 				maxAgeNoNotif: test.maxAgeNoNotif,
+				balancer:      &roundRobin{},
 				entries:       addrs,
 				notifTimes:    notifTimes,
 			}
 
 			var beforeAddrs []string
 			for i := 0; i < 10; i++ {
-				a, err := pool.Next()
+				a, err := pool.Next(nil)
 				if err != nil {
 					t.Fatalf("unexpected error while Next: %v", err)
 				}
@@ -298,7 +338,7 @@ func TestNextAndCleanInteraction(t *testing.T) {
 
 			var afterAddrs []string
 			for i := 0; i < 10; i++ {
-				a, err := pool.Next()
+				a, err := pool.Next(nil)
 				if err != nil {
 					t.Fatalf("unexpected error while Next: %v", err)
 				}
@@ -344,12 +384,12 @@ func TestDeregisterClient(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			pool := &ForwarderPool{
 				maxAgeNoNotif: time.Hour,
-				lastEntryIdx:  0,
+				balancer:      &roundRobin{},
 				entries:       []Forwarder{},
 				notifTimes:    map[string]time.Time{},
 			}
 			for _, addr := range test.addrsToRegister {
-				pool.RegisterClient(addr)
+				pool.RegisterClient(addr, 1)
 			}
 
 			for _, addr := range test.addrsToDeregister {
@@ -367,3 +407,237 @@ func TestDeregisterClient(t *testing.T) {
 		})
 	}
 }
+
+func TestRemovedClientClosesConnections(t *testing.T) {
+	tests := map[string]struct {
+		remove func(pool *ForwarderPool, addr string)
+	}{
+		"deregistered": {remove: func(pool *ForwarderPool, addr string) { pool.DeRegisterClient(addr) }},
+		"expired": {remove: func(pool *ForwarderPool, addr string) {
+			pool.lock.Lock()
+			pool.notifTimes[addr] = time.Now().Add(-2 * time.Hour)
+			pool.lock.Unlock()
+			pool.cleanPool()
+		}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			closed := make(chan struct{}, 1)
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+			server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateClosed {
+					closed <- struct{}{}
+				}
+			}
+			server.Start()
+			defer server.Close()
+			addr := strings.TrimPrefix(server.URL, "http://")
+
+			pool, err := newForwarderPool(&PoolConfig{MaxAgeNoNotif: time.Hour, SlowThreshold: time.Second}, nil)
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			pool.RegisterClient(addr, 1)
+			forwarder, err := pool.Next(nil)
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			_ = forwarder.Forward(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			test.remove(pool, addr)
+			select {
+			case <-closed:
+			case <-time.After(time.Second):
+				t.Fatalf("the idle connection to %s was kept open", addr)
+			}
+		})
+	}
+}
+
+func TestNextSkipsInactive(t *testing.T) {
+	pool := &ForwarderPool{
+		maxAgeNoNotif: time.Hour,
+		balancer:      &roundRobin{},
+		entries:       []Forwarder{},
+		notifTimes:    map[string]time.Time{},
+	}
+	pool.RegisterClient("purple", 1)
+	pool.RegisterClient("green", 1)
+	pool.RegisterClient("yellow", 1)
+
+	if err := pool.DrainClient("purple"); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if err := pool.DisableClient("yellow"); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if err := pool.DisableClient("blue"); err != ErrUnknownClient {
+		t.Fatalf("got error %v want %v", err, ErrUnknownClient)
+	}
+
+	var res []string
+	for i := 0; i < 3; i++ {
+		n, err := pool.Next(nil)
+		if err != nil {
+			t.Fatalf("got unexpected error: %v", err)
+		}
+		res = append(res, n.Host())
+	}
+	if !reflect.DeepEqual(res, repeat("green", 3)) {
+		t.Fatalf("list differs: got %v want %v", res, repeat("green", 3))
+	}
+
+	if err := pool.EnableClient("yellow"); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	n, _ := pool.Next(nil)
+	if n.Host() != "yellow" {
+		t.Fatalf("got %s want yellow", n.Host())
+	}
+}
+
+func TestPoolReconfigure(t *testing.T) {
+	pool := &ForwarderPool{
+		maxAgeNoNotif: time.Hour,
+		balancer:      &roundRobin{},
+		entries:       []Forwarder{},
+		notifTimes:    map[string]time.Time{},
+	}
+	pool.RegisterClient("purple", 1)
+	pool.RegisterClient("green", 3)
+
+	err := pool.Reconfigure(&PoolConfig{
+		MaxAgeNoNotif: time.Minute,
+		SlowThreshold: time.Second,
+		Balancer:      &BalancerConfig{Strategy: BalancerWeightedRoundRobin},
+	})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+
+	if len(pool.entries) != 2 || pool.maxAgeNoNotif != time.Minute {
+		t.Fatalf("got %d entries and max age %v, want 2 entries and 1m", len(pool.entries), pool.maxAgeNoNotif)
+	}
+	var res []string
+	for i := 0; i < 4; i++ {
+		n, err := pool.Next(nil)
+		if err != nil {
+			t.Fatalf("got unexpected error: %v", err)
+		}
+		res = append(res, n.Host())
+	}
+	if want := []string{"green", "purple", "green", "green"}; !reflect.DeepEqual(res, want) {
+		t.Fatalf("list differs: got %v want %v", res, want)
+	}
+}
+
+func TestConsistentHashChurn(t *testing.T) {
+	const keys = 10000
+
+	backends := func(n int) []string {
+		var res []string
+		for i := 0; i < n; i++ {
+			res = append(res, fmt.Sprintf("10.0.0.%d:8080", i))
+		}
+		return res
+	}
+
+	tests := map[string]struct {
+		before []string
+		after  []string
+	}{
+		"backend joins": {
+			before: backends(10),
+			after:  backends(11),
+		},
+		"backend leaves": {
+			before: backends(10),
+			after:  backends(10)[1:],
+		},
+		"backend replaced": {
+			before: backends(10),
+			after:  append(backends(10)[1:], "10.0.1.1:8080"),
+		},
+		"small pool": {
+			before: backends(3),
+			after:  backends(4),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pool, err := newForwarderPool(&PoolConfig{
+				MaxAgeNoNotif: time.Hour,
+				Balancer:      &BalancerConfig{Strategy: BalancerConsistentHash, HashKey: HashKeyPath},
+			}, nil)
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			for _, addr := range test.before {
+				pool.RegisterClient(addr, 1)
+			}
+
+			pick := func() []string {
+				var res []string
+				for i := 0; i < keys; i++ {
+					f, err := pool.Next(httptest.NewRequest(http.MethodGet, fmt.Sprintf("/objects/%d", i), nil))
+					if err != nil {
+						t.Fatalf("got unexpected error: %v", err)
+					}
+					res = append(res, f.Host())
+				}
+				return res
+			}
+			before := pick()
+
+			kept := map[string]bool{}
+			for _, addr := range test.after {
+				kept[addr] = true
+			}
+			for _, addr := range test.before {
+				if !kept[addr] {
+					pool.DeRegisterClient(addr)
+				}
+			}
+			for _, addr := range test.after {
+				pool.RegisterClient(addr, 1)
+			}
+			after := pick()
+
+			// keys only move off a backend that left or onto one that joined
+			existed := map[string]bool{}
+			for _, addr := range test.before {
+				existed[addr] = true
+			}
+			moved := 0
+			for i := range before {
+				if before[i] == after[i] {
+					continue
+				}
+				moved++
+				if kept[before[i]] && existed[after[i]] {
+					t.Fatalf("key %d moved between %s and %s which both stayed", i, before[i], after[i])
+				}
+			}
+
+			// that's about 1/N of them for every backend that changed
+			changed := 0
+			for addr := range kept {
+				if !existed[addr] {
+					changed++
+				}
+			}
+			for addr := range existed {
+				if !kept[addr] {
+					changed++
+				}
+			}
+			n := max(len(test.before), len(test.after))
+			want := float64(keys*changed) / float64(n)
+			if float64(moved) > 1.5*want || float64(moved) < 0.5*want {
+				t.Fatalf("%d of %d keys moved, want about %.0f", moved, keys, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package pool
+
+import (
+	"math/rand/v2"
+	"net/http"
+)
+
+// powerOfTwo picks two random entries and uses the one with the fewest requests in flight.
+type powerOfTwo struct {
+	intN func(n int) int
+}
+
+func newPowerOfTwo() *powerOfTwo {
+	return &powerOfTwo{intN: rand.IntN}
+}
+
+func (b *powerOfTwo) Pick(entries []Forwarder, _ *http.Request) (Forwarder, error) {
+	eligible := make([]Forwarder, 0, len(entries))
+	for _, e := range entries {
+		if e.CanForward() {
+			eligible = append(eligible, e)
+		}
+	}
+
+	switch len(eligible) {
+	case 0:
+		return nil, errNoClientsAvailable
+	case 1:
+		return eligible[0], nil
+	}
+
+	i := b.intN(len(eligible))
+	j := b.intN(len(eligible) - 1)
+	if j >= i {
+		// skip i itself, so we always end up with 2 different entries
+		j++
+	}
+
+	if eligible[j].InFlight() < eligible[i].InFlight() {
+		return eligible[j], nil
+	}
+	return eligible[i], nil
+}
+
+func (b *powerOfTwo) Update(_ []Forwarder) {}
@@ -1,12 +1,16 @@
 package ratelimit
 
 import (
+	"log/slog"
+	"mrbarrel/lib/logging"
 	"sync"
 	"time"
 )
 
 const windowSize = 100
 
+var logger = logging.Logger(logging.RateLimit)
+
 type speed int
 
 const (
@@ -26,14 +30,17 @@ type RateLimiter struct {
 	lastHandleTime  time.Time
 	currentWaitTime time.Duration
 	slowThreshold   time.Duration
+	logger          *slog.Logger
 }
 
-func NewRateLimiter(slowThreshold time.Duration) *RateLimiter {
+// NewRateLimiter returns a RateLimiter for the backend at addr, addr is only logged.
+func NewRateLimiter(slowThreshold time.Duration, addr string) *RateLimiter {
 	return &RateLimiter{
 		window:        make([]speed, windowSize),
 		currentStage:  stage_ok,
 		slowThreshold: slowThreshold,
 		fastCount:     100, // start out as if it's fast all the way
+		logger:        logger.With(logging.BackendKey, addr),
 	}
 }
 
@@ -86,6 +93,10 @@ func (w *RateLimiter) updateStage() {
 			w.currentWaitTime = s.calculateNewWaitTime(oldStage, w.currentWaitTime, newScore, w.scoreLastN(10))
 		}
 	}
+	if w.currentStage != oldStage {
+		w.logger.Info("stage changed", logging.FromKey, oldStage.String(), logging.ToKey, w.currentStage.String(),
+			"score", newScore, "wait_time", w.currentWaitTime.String())
+	}
 }
 
 func (w *RateLimiter) score() float64 {
@@ -127,6 +138,34 @@ func (w *RateLimiter) scoreLastN(n int) float64 {
 	return float64(fastCount) / float64(slowCount+fastCount)
 }
 
+// Stage returns the name of the current stage: OK, SLOW or DEAD.
+func (w *RateLimiter) Stage() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.currentStage.String()
+}
+
+// Score returns the share of fast calls over the window (0-1).
+func (w *RateLimiter) Score() float64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.score()
+}
+
+// WaitTime returns the time to wait between two calls in the current stage.
+func (w *RateLimiter) WaitTime() time.Duration {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.currentWaitTime
+}
+
+// SetSlowThreshold changes the duration above which calls are slow.
+func (w *RateLimiter) SetSlowThreshold(slowThreshold time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.slowThreshold = slowThreshold
+}
+
 func (w *RateLimiter) CanHandleCall() bool {
 	return time.Now().After(w.lastHandleTime.Add(w.currentWaitTime))
 }
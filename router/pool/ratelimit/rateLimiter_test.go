@@ -41,7 +41,7 @@ func TestScore(t *testing.T) {
 	}
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			rl := NewRateLimiter(slowThreshold)
+			rl := NewRateLimiter(slowThreshold, "purple:80")
 			for _, d := range test.durations {
 				rl.TrackNewDuration(d)
 			}
@@ -105,7 +105,7 @@ func TestScoreLastN(t *testing.T) {
 	}
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			rl := NewRateLimiter(slowThreshold)
+			rl := NewRateLimiter(slowThreshold, "purple:80")
 			for _, d := range test.durations {
 				rl.TrackNewDuration(d)
 			}
@@ -160,7 +160,7 @@ func TestTrackNewDuration(t *testing.T) {
 	}
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			rl := NewRateLimiter(slowThreshold)
+			rl := NewRateLimiter(slowThreshold, "purple:80")
 			for i, d := range test.durations {
 				_ = i
 				rl.TrackNewDuration(d)
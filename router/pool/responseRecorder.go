@@ -0,0 +1,45 @@
+package pool
+
+import "net/http"
+
+// ResponseRecorder records the status and body size written to a ResponseWriter.
+type ResponseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (r *ResponseRecorder) WriteHeader(code int) {
+	// informational 1xx responses can come before the real one
+	if r.status == 0 && code >= http.StatusOK {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *ResponseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush the original ResponseWriter.
+func (r *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Status returns the status code that was sent, net/http sends 200 when nothing was written at all.
+func (r *ResponseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// Written returns the number of bytes of the body that were sent.
+func (r *ResponseRecorder) Written() int64 {
+	return r.written
+}
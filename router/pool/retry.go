@@ -0,0 +1,68 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+)
+
+// RetryableError is returned by Forward when nothing was written, so another Forwarder can take the request.
+type RetryableError struct {
+	Err error
+	// Status is the status code the backend answered with, 0 when it never answered.
+	Status int
+}
+
+func (e *RetryableError) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("retryable status %d: %v", e.Status, e.Err)
+	}
+	return fmt.Sprintf("retryable error: %v", e.Err)
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+var errRetryableStatus = errors.New("backend answered with retryable status")
+
+type retryPolicyKey struct{}
+
+type retryPolicy struct {
+	statuses []int
+}
+
+// WithRetry makes Forward return a RetryableError on dial errors and statuses, instead of answering.
+func WithRetry(req *http.Request, statuses []int) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), retryPolicyKey{}, &retryPolicy{statuses: statuses}))
+}
+
+func retryPolicyFrom(ctx context.Context) (*retryPolicy, bool) {
+	p, ok := ctx.Value(retryPolicyKey{}).(*retryPolicy)
+	return p, ok
+}
+
+// checkRetryableStatus is the ReverseProxy's ModifyResponse, an error has it call the ErrorHandler.
+func checkRetryableStatus(resp *http.Response) error {
+	policy, ok := retryPolicyFrom(resp.Request.Context())
+	if !ok || !slices.Contains(policy.statuses, resp.StatusCode) {
+		return nil
+	}
+	return &RetryableError{Err: errRetryableStatus, Status: resp.StatusCode}
+}
+
+// asRetryable returns the error for the caller of Forward when err allows a retry.
+func asRetryable(err error) (*RetryableError, bool) {
+	var retryErr *RetryableError
+	if errors.As(err, &retryErr) {
+		return retryErr, true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return &RetryableError{Err: err}, true
+	}
+	return nil, false
+}
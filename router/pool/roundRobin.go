@@ -0,0 +1,50 @@
+package pool
+
+import "net/http"
+
+// roundRobin hands out the entries one after the other, skipping the ones that can't forward.
+type roundRobin struct {
+	lastIdx int
+}
+
+func (b *roundRobin) Pick(entries []Forwarder, _ *http.Request) (Forwarder, error) {
+	if b.lastIdx >= len(entries) {
+		b.lastIdx = 0
+	}
+
+	idx := b.lastIdx
+
+	var hostEntry Forwarder
+	found := false
+	// check whether this Forwarder can actually handle the call; if not, try the next one.
+	// If you went through the complete list and haven't found anything, return error.
+	for {
+		hostEntry = entries[idx]
+		idx++
+		if hostEntry.CanForward() {
+			found = true
+			break
+		}
+
+		if idx >= len(entries) {
+			idx = 0
+		}
+
+		if idx == b.lastIdx {
+			break
+		}
+	}
+	if !found {
+		return nil, errNoClientsAvailable
+	}
+
+	b.lastIdx = idx
+	return hostEntry, nil
+}
+
+func (b *roundRobin) Update(entries []Forwarder) {
+	if b.lastIdx >= len(entries) {
+		// reset when necessary. Pick() checks for proper value, but better to be explicit.
+		b.lastIdx = 0
+	}
+}
@@ -0,0 +1,81 @@
+package pool
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mrbarrel/lib/logging"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StaticClient is a client that is configured instead of registering itself, it never expires.
+type StaticClient struct {
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"`
+	// Pool is only used by Group, the empty name is DefaultPool.
+	Pool string `json:"pool,omitempty"`
+}
+
+// ParseStaticClients reads 'addr' or 'addr=weight' separated by commas or newlines, '#' starts a comment.
+func ParseStaticClients(r io.Reader) ([]StaticClient, error) {
+	var res []StaticClient
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+
+			addr, weightStr, hasWeight := strings.Cut(entry, "=")
+			client := StaticClient{Addr: strings.TrimSpace(addr), Weight: 1}
+			if hasWeight {
+				weight, err := strconv.Atoi(strings.TrimSpace(weightStr))
+				if err != nil || weight <= 0 {
+					return nil, fmt.Errorf("invalid weight in static client %q", entry)
+				}
+				client.Weight = weight
+			}
+			if client.Addr == "" {
+				return nil, fmt.Errorf("missing address in static client %q", entry)
+			}
+			res = append(res, client)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// SetStaticClients replaces the static clients, the ones no longer listed need heartbeats to stay.
+func (cp *ForwarderPool) SetStaticClients(clients []StaticClient) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	newStatic := make(map[string]bool, len(clients))
+	for _, c := range clients {
+		newStatic[c.Addr] = true
+		if _, ok := cp.notifTimes[c.Addr]; ok {
+			// already in the pool, possibly registered dynamically too
+			cp.setWeight(c.Addr, c.Weight)
+			continue
+		}
+		entry := newForwardHandler(c.Addr, cp.forwarderCfg)
+		entry.SetWeight(c.Weight)
+		cp.entries = append(cp.entries, entry)
+		cp.notifTimes[c.Addr] = time.Now()
+		logger.Info("added static backend", logging.BackendKey, c.Addr, "weight", c.Weight, "total", len(cp.entries))
+	}
+	for addr := range cp.static {
+		if !newStatic[addr] {
+			logger.Info("backend is no longer static, it will expire without heartbeats", logging.BackendKey, addr)
+		}
+	}
+
+	cp.static = newStatic
+	cp.balancer.Update(cp.entries)
+}
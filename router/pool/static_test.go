@@ -0,0 +1,105 @@
+package pool
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStaticClients(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		want    []StaticClient
+		wantErr bool
+	}{
+		"empty": {
+			input: "",
+		},
+		"comma separated": {
+			input: "purple:8080, green:8080=3",
+			want:  []StaticClient{{Addr: "purple:8080", Weight: 1}, {Addr: "green:8080", Weight: 3}},
+		},
+		"one per line with comments": {
+			input: "# legacy backends\npurple:8080\n\ngreen:8080=2 # the big one\n",
+			want:  []StaticClient{{Addr: "purple:8080", Weight: 1}, {Addr: "green:8080", Weight: 2}},
+		},
+		"invalid weight": {
+			input:   "purple:8080=heavy",
+			wantErr: true,
+		},
+		"zero weight": {
+			input:   "purple:8080=0",
+			wantErr: true,
+		},
+		"missing address": {
+			input:   "=2",
+			wantErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseStaticClients(strings.NewReader(test.input))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error but got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStaticClients(t *testing.T) {
+	pool := &ForwarderPool{
+		maxAgeNoNotif: time.Second,
+		balancer:      &roundRobin{},
+		entries:       []Forwarder{},
+		notifTimes:    map[string]time.Time{},
+		forwarderCfg:  forwarderConfig{slowThreshold: time.Second},
+	}
+
+	pool.SetStaticClients([]StaticClient{{Addr: "purple", Weight: 2}, {Addr: "green", Weight: 1}})
+	pool.RegisterClient("yellow", 1)
+
+	// age everything, only the dynamic client should go
+	for addr := range pool.notifTimes {
+		pool.notifTimes[addr] = time.Now().Add(-time.Hour)
+	}
+	pool.cleanPool()
+	if got := hosts(pool.entries); !reflect.DeepEqual(got, []string{"purple", "green"}) {
+		t.Fatalf("got %v after clean, want the static clients only", got)
+	}
+
+	// green is no longer static and expires like any other client
+	pool.SetStaticClients([]StaticClient{{Addr: "purple", Weight: 4}})
+	for addr := range pool.notifTimes {
+		pool.notifTimes[addr] = time.Now().Add(-time.Hour)
+	}
+	pool.cleanPool()
+	if got := hosts(pool.entries); !reflect.DeepEqual(got, []string{"purple"}) {
+		t.Fatalf("got %v after clean, want [purple]", got)
+	}
+	status, err := pool.ClientStatus("purple")
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if !status.Static || status.Weight != 4 {
+		t.Fatalf("got static %v weight %d, want static with weight 4", status.Static, status.Weight)
+	}
+}
+
+func hosts(entries []Forwarder) []string {
+	res := []string{}
+	for _, e := range entries {
+		res = append(res, e.Host())
+	}
+	return res
+}
@@ -0,0 +1,14 @@
+package pool
+
+import "net/http"
+
+// statusRecorder is a ResponseRecorder that keeps the proxy error.
+type statusRecorder struct {
+	ResponseRecorder
+	proxyErr error
+	retryErr *RetryableError
+}
+
+func (r *statusRecorder) failed() bool {
+	return r.proxyErr != nil || r.status >= http.StatusInternalServerError
+}
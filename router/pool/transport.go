@@ -0,0 +1,131 @@
+package pool
+
+import (
+	"context"
+	"crypto/tls"
+	"mrbarrel/lib/tlsconfig"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// TimeoutConfig bounds the calls to the backends, a zero value means no timeout.
+type TimeoutConfig struct {
+	// Connect is the time to set up the connection to a backend.
+	Connect time.Duration
+	// ResponseHeader is the time a backend has to answer with its headers once the request is sent.
+	ResponseHeader time.Duration
+	// Total is the time a backend has for the whole call, including the response body.
+	Total time.Duration
+}
+
+// TransportConfig tunes the connections to each backend. The dial timeout is TimeoutConfig.Connect.
+type TransportConfig struct {
+	// MaxIdleConnsPerHost is 2 when 0, a negative value keeps none.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost caps the connections to a backend, 0 means no limit.
+	MaxConnsPerHost int
+	// IdleConnTimeout closes connections that have been idle for that long, 0 keeps them.
+	IdleConnTimeout time.Duration
+	// KeepAlive is the interval of the TCP keep-alive probes, a negative value disables them.
+	KeepAlive time.Duration
+	// HTTP2 lets calls to TLS backends use HTTP/2.
+	HTTP2 bool
+}
+
+// DefaultTransportConfig is http.DefaultTransport with more idle connections per host.
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     90 * time.Second,
+		KeepAlive:           30 * time.Second,
+		HTTP2:               true,
+	}
+}
+
+// transportSettings is comparable, so a reconfigure can tell when it changed.
+type transportSettings struct {
+	timeouts  TimeoutConfig
+	transport TransportConfig
+	// tls is nil when the pool has no TLS config, it reloads the certificates by itself.
+	tls *tlsconfig.Files
+}
+
+// transport is the RoundTripper of a forwardHandler, a reconfigure swaps in a new http.Transport.
+type transport struct {
+	// host is the name or IP of the backend, its certificate has to be valid for it.
+	host        string
+	current     atomic.Pointer[transportState]
+	connsNew    atomic.Uint64
+	connsReused atomic.Uint64
+}
+
+type transportState struct {
+	settings transportSettings
+	rt       *http.Transport
+}
+
+func newTransport(host string, settings transportSettings) *transport {
+	t := &transport{host: host}
+	t.set(settings)
+	return t
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// WithClientTrace keeps the ReverseProxy's trace
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{GotConn: t.gotConn}))
+	return t.current.Load().rt.RoundTrip(req)
+}
+
+func (t *transport) gotConn(info httptrace.GotConnInfo) {
+	if info.Reused {
+		t.connsReused.Add(1)
+		return
+	}
+	t.connsNew.Add(1)
+}
+
+// set replaces the http.Transport when the settings changed.
+func (t *transport) set(settings transportSettings) {
+	old := t.current.Load()
+	if old != nil && old.settings == settings {
+		return
+	}
+
+	cfg := settings.transport
+	rt := http.DefaultTransport.(*http.Transport).Clone()
+	rt.DialContext = (&net.Dialer{Timeout: settings.timeouts.Connect, KeepAlive: cfg.KeepAlive}).DialContext
+	rt.ResponseHeaderTimeout = settings.timeouts.ResponseHeader
+	// every transport only talks to a single backend
+	rt.MaxIdleConns = cfg.MaxIdleConnsPerHost
+	rt.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	rt.MaxConnsPerHost = cfg.MaxConnsPerHost
+	rt.IdleConnTimeout = cfg.IdleConnTimeout
+	rt.ForceAttemptHTTP2 = cfg.HTTP2
+	if settings.tls != nil {
+		rt.TLSClientConfig = settings.tls.ClientConfig(t.host)
+	}
+	if !cfg.HTTP2 {
+		// a non-nil empty map is how http.Transport is told not to upgrade to HTTP/2
+		rt.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	t.current.Store(&transportState{settings: settings, rt: rt})
+	if old != nil {
+		old.rt.CloseIdleConnections()
+	}
+}
+
+// closeIdle closes the connections that aren't used by a call.
+func (t *transport) closeIdle() {
+	t.current.Load().rt.CloseIdleConnections()
+}
+
+// withTotalTimeout bounds ctx by the total timeout, when that's set.
+func (t *transport) withTotalTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if total := t.current.Load().settings.timeouts.Total; total > 0 {
+		return context.WithTimeout(ctx, total)
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,49 @@
+package pool
+
+import "net/http"
+
+// weightedRoundRobin is smooth weighted round robin, like nginx's.
+type weightedRoundRobin struct {
+	current map[string]int
+}
+
+func newWeightedRoundRobin() *weightedRoundRobin {
+	return &weightedRoundRobin{current: map[string]int{}}
+}
+
+func (b *weightedRoundRobin) Pick(entries []Forwarder, _ *http.Request) (Forwarder, error) {
+	var best Forwarder
+	total := 0
+	for _, e := range entries {
+		if !e.CanForward() {
+			continue
+		}
+		weight := e.Weight()
+		if weight <= 0 {
+			continue
+		}
+		b.current[e.Host()] += weight
+		total += weight
+		if best == nil || b.current[e.Host()] > b.current[best.Host()] {
+			best = e
+		}
+	}
+	if best == nil {
+		return nil, errNoClientsAvailable
+	}
+
+	b.current[best.Host()] -= total
+	return best, nil
+}
+
+func (b *weightedRoundRobin) Update(entries []Forwarder) {
+	present := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		present[e.Host()] = true
+	}
+	for host := range b.current {
+		if !present[host] {
+			delete(b.current, host)
+		}
+	}
+}